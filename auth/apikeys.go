@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+)
+
+// APIKeyPrefix starts every API key so that they are easy to recognise
+const APIKeyPrefix = "rsk_"
+
+// touchInterval limits how often the last used time of a key is written
+const touchInterval = time.Minute
+
+// APIKeys authenticates API keys of the form rsk_<id>.<secret> against the
+// salted hashes held in the database
+type APIKeys struct {
+	db *data.Client
+}
+
+// NewAPIKeys returns an authenticator backed by the database
+func NewAPIKeys(db *data.Client) *APIKeys {
+	return &APIKeys{db: db}
+}
+
+// NewAPIKey generates a key for an organisation. The key returned in the
+// string is the only copy of the secret and must be handed to the caller.
+func NewAPIKey(organisationID, name string, roles []string) (*data.APIKey, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	salt := make([]byte, 16)
+	for _, b := range [][]byte{id, secret, salt} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	key := &data.APIKey{
+		ID:             hex.EncodeToString(id),
+		OrganisationID: organisationID,
+		Name:           name,
+		Roles:          roles,
+		Salt:           salt,
+		Hash:           hashSecret(salt, encoded),
+		CreatedAt:      time.Now().UTC(),
+	}
+	return key, APIKeyPrefix + key.ID + "." + encoded, nil
+}
+
+// Authenticate verifies an API key in the bearer token
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	token := BearerToken(r)
+	if !strings.HasPrefix(token, APIKeyPrefix) {
+		return nil, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, APIKeyPrefix), ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCredentials
+	}
+	db := a.db.WithContext(r.Context())
+	key, err := db.FetchAPIKey(parts[0])
+	if err != nil {
+		if err.Error() != "not found" {
+			logging.FromContext(r.Context()).Errorf("Error getting API key: %s", err)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if subtle.ConstantTimeCompare(hashSecret(key.Salt, parts[1]), key.Hash) != 1 || !key.Active() {
+		return nil, ErrInvalidCredentials
+	}
+	now := time.Now().UTC()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > touchInterval {
+		if err := db.TouchAPIKey(key.ID, now); err != nil {
+			logging.FromContext(r.Context()).Errorf("Error recording API key use: %s", err)
+		}
+	}
+	return &Principal{
+		Subject:        "apikey:" + key.ID,
+		OrganisationID: key.OrganisationID,
+		Roles:          key.Roles,
+	}, nil
+}
+
+func hashSecret(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
@@ -0,0 +1,112 @@
+// Package auth identifies the caller of the API and the organisation they act for
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/adampointer/restservice/logging"
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+// RoleSuperAdmin is held by support staff who may act for any organisation
+const RoleSuperAdmin = "super-admin"
+
+// ErrInvalidCredentials is returned when credentials are supplied but not accepted
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Principal is an authenticated caller
+type Principal struct {
+	Subject        string   `json:"subject"`
+	OrganisationID string   `json:"organisation_id"`
+	Roles          []string `json:"roles"`
+	Scopes         []string `json:"scopes"`
+}
+
+// HasRole reports whether the principal holds a role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the principal was granted a scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSuperAdmin reports whether the principal may act for any organisation
+func (p *Principal) IsSuperAdmin() bool {
+	return p.HasRole(RoleSuperAdmin)
+}
+
+type contextKey int
+
+const principalKey contextKey = 0
+
+// NewContext returns a context carrying the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// FromContext returns the principal from a request context
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	return p, ok && p != nil
+}
+
+// Authenticator identifies the caller of a request. It returns a nil principal
+// and nil error when the request does not carry the kind of credentials it
+// understands, so that the next authenticator can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Middleware rejects requests which none of the authenticators accept and
+// adds the principal to the context of those which are
+func Middleware(authenticators ...Authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			detail := "credentials required"
+			if len(r.Header.Get("Authorization")) > 0 {
+				detail = ErrInvalidCredentials.Error()
+			}
+			for _, a := range authenticators {
+				p, err := a.Authenticate(r)
+				if err != nil {
+					logging.FromContext(r.Context()).Debugf("authentication failed: %s", err)
+					detail = err.Error()
+					break
+				}
+				if p != nil {
+					logging.AddField(r.Context(), "subject", p.Subject)
+					logging.AddField(r.Context(), "organisation", p.OrganisationID)
+					next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+					return
+				}
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			problem.Write(w, http.StatusUnauthorized, detail)
+		})
+	}
+}
+
+// BearerToken returns the token from an `Authorization: Bearer` header
+func BearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareStaticToken(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	static := NewStatic([]*StaticCredential{{
+		TokenSHA256: hex.EncodeToString(sum[:]),
+		Principal:   Principal{Subject: "support", Roles: []string{RoleSuperAdmin}},
+	}})
+	var seen *Principal
+	handler := Middleware(static)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = FromContext(r.Context())
+	}))
+
+	for token, expected := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "s3cret": http.StatusOK} {
+		seen = nil
+		req, err := http.NewRequest("GET", "/payments", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("token '%s': middleware returned wrong status code: got '%v' want '%v'", token, status, expected)
+		}
+		if expected == http.StatusOK && (seen == nil || !seen.IsSuperAdmin()) {
+			t.Errorf("token '%s': principal was not added to the context", token)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minRefreshInterval stops tokens with unknown key IDs forcing a reload of
+// the key set on every request
+const minRefreshInterval = 30 * time.Second
+
+// ErrUnknownKey is returned when no key in the set matches a token
+var ErrUnknownKey = errors.New("no matching key for token")
+
+// jwk is a JSON Web Key as found in a key set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// Symmetric
+	K string `json:"k"`
+}
+
+// JWKS is a set of keys for verifying tokens, loaded from a local file or a
+// URL. Keys are selected by the key ID in the token header.
+type JWKS struct {
+	source string
+	client *http.Client
+
+	mu   sync.RWMutex
+	keys map[string]interface{}
+	// attempted is when the set was last reloaded, or failed to be
+	attempted time.Time
+	// refreshing collapses reloads for unknown key IDs into one at a time
+	refreshing sync.Mutex
+}
+
+// NewJWKS loads a key set from a file path or an http(s) URL
+func NewJWKS(source string) (*JWKS, error) {
+	k := &JWKS{
+		source: source,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := k.Refresh(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Refresh reloads the key set from its source
+func (k *JWKS) Refresh() error {
+	defer func() {
+		k.mu.Lock()
+		k.attempted = time.Now()
+		k.mu.Unlock()
+	}()
+	var r io.ReadCloser
+	if strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://") {
+		resp, err := k.client.Get(k.source)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("fetching key set: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(k.source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]interface{})
+	for _, j := range set.Keys {
+		if len(j.Use) > 0 && j.Use != "sig" {
+			continue
+		}
+		key, err := j.publicKey()
+		if err != nil {
+			return fmt.Errorf("key '%s': %s", j.Kid, err)
+		}
+		keys[j.Kid] = key
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// RefreshEvery reloads the key set periodically until stop is closed
+func (k *JWKS) RefreshEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := k.Refresh(); err != nil {
+				log.Errorf("Error refreshing key set: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// key returns the key for a key ID, reloading the set once in a while if the
+// ID is unknown in case the keys have been rotated. A failed reload waits as
+// long as a successful one, and requests arriving while one is under way wait
+// for it rather than reloading again.
+func (k *JWKS) key(kid string) (interface{}, error) {
+	key, ok, stale := k.lookup(kid)
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, ErrUnknownKey
+	}
+	k.refreshing.Lock()
+	defer k.refreshing.Unlock()
+	// Another request may have reloaded the set while this one waited
+	key, ok, stale = k.lookup(kid)
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, ErrUnknownKey
+	}
+	if err := k.Refresh(); err != nil {
+		log.Errorf("Error refreshing key set: %s", err)
+		return nil, ErrUnknownKey
+	}
+	if key, ok, _ = k.lookup(kid); !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// lookup returns the key for a key ID, whether there is one, and whether the
+// set is due a reload
+func (k *JWKS) lookup(kid string) (interface{}, bool, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	return key, ok, time.Since(k.attempted) > minRefreshInterval
+}
+
+func (j *jwk) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve '%s'", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(j.K)
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", j.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMalformedToken is returned for tokens which cannot be decoded
+	ErrMalformedToken = errors.New("malformed token")
+	// ErrUnsupportedAlgorithm is returned for tokens not signed with RS256, ES256 or HS256
+	ErrUnsupportedAlgorithm = errors.New("unsupported token algorithm")
+	// ErrBadSignature is returned when a token's signature does not verify
+	ErrBadSignature = errors.New("invalid token signature")
+	// ErrTokenExpired is returned for tokens past their exp claim
+	ErrTokenExpired = errors.New("token expired")
+	// ErrTokenNotYetValid is returned for tokens before their nbf claim
+	ErrTokenNotYetValid = errors.New("token not yet valid")
+	// ErrWrongIssuer is returned for tokens from another issuer
+	ErrWrongIssuer = errors.New("token issuer not accepted")
+	// ErrWrongAudience is returned for tokens intended for another audience
+	ErrWrongAudience = errors.New("token audience not accepted")
+)
+
+// JWTConfig describes which tokens are accepted and how their claims map to
+// a principal
+type JWTConfig struct {
+	// JWKS is the path or URL of the key set
+	JWKS string `json:"jwks"`
+	// RefreshSeconds is how often to reload the key set, zero to never
+	RefreshSeconds int `json:"refresh_seconds"`
+	// Issuer and Audience must match the iss and aud claims
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// OrganisationClaim names the claim holding the caller's organisation,
+	// org_id by default
+	OrganisationClaim string `json:"organisation_claim"`
+	// LeewaySeconds allows for clock skew when checking exp and nbf
+	LeewaySeconds int `json:"leeway_seconds"`
+}
+
+// JWT authenticates bearer tokens signed by a key in a JWKS
+type JWT struct {
+	keys *JWKS
+	cfg  JWTConfig
+	now  func() time.Time
+}
+
+// NewJWT returns an authenticator for tokens signed by keys
+func NewJWT(keys *JWKS, cfg JWTConfig) *JWT {
+	if len(cfg.OrganisationClaim) == 0 {
+		cfg.OrganisationClaim = "org_id"
+	}
+	return &JWT{keys: keys, cfg: cfg, now: time.Now}
+}
+
+// LoadJWT reads a JSON JWTConfig from path and loads its key set
+func LoadJWT(path string) (*JWT, *JWTConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var cfg JWTConfig
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, nil, err
+	}
+	keys, err := NewJWKS(cfg.JWKS)
+	if err != nil {
+		// Not a missing config, even when the key set file is missing
+		return nil, nil, fmt.Errorf("key set %s: %s", cfg.JWKS, err)
+	}
+	return NewJWT(keys, cfg), &cfg, nil
+}
+
+// Keys returns the key set used to verify tokens
+func (j *JWT) Keys() *JWKS {
+	return j.keys
+}
+
+// Authenticate verifies a JWT in the bearer token
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token := BearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	return j.Verify(token)
+}
+
+// Verify checks the signature and claims of a token and returns the
+// principal it identifies
+func (j *JWT) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformedToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	key, err := j.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if err := j.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	p := &Principal{
+		Subject:        stringClaim(claims, "sub"),
+		OrganisationID: stringClaim(claims, j.cfg.OrganisationClaim),
+		Roles:          listClaim(claims, "roles"),
+		Scopes:         strings.Fields(stringClaim(claims, "scope")),
+	}
+	if len(p.Scopes) == 0 {
+		p.Scopes = listClaim(claims, "scp")
+	}
+	return p, nil
+}
+
+func (j *JWT) checkClaims(claims map[string]interface{}) error {
+	now := j.now()
+	leeway := time.Duration(j.cfg.LeewaySeconds) * time.Second
+	exp, ok := timeClaim(claims, "exp")
+	if !ok || now.After(exp.Add(leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := timeClaim(claims, "nbf"); ok && now.Add(leeway).Before(nbf) {
+		return ErrTokenNotYetValid
+	}
+	if stringClaim(claims, "iss") != j.cfg.Issuer {
+		return ErrWrongIssuer
+	}
+	for _, aud := range listClaim(claims, "aud") {
+		if aud == j.cfg.Audience {
+			return nil
+		}
+	}
+	return ErrWrongAudience
+}
+
+// verifySignature checks the signature using a key of the type the algorithm
+// requires, so that a public key can never be used as an HMAC secret
+func verifySignature(alg string, key interface{}, signed string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnknownKey
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) != nil {
+			return ErrBadSignature
+		}
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrUnknownKey
+		}
+		if len(sig) != 64 {
+			return ErrBadSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) {
+			return ErrBadSignature
+		}
+	case "HS256":
+		k, ok := key.([]byte)
+		if !ok {
+			return ErrUnknownKey
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrBadSignature
+		}
+	default:
+		return ErrUnsupportedAlgorithm
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func stringClaim(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// listClaim reads a claim which may be a single string or an array of them
+func listClaim(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func timeClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(secs), 0), true
+}
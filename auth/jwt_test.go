@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testKeys struct {
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	secret []byte
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{rsa: rsaKey, ec: ecKey, secret: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (k *testKeys) jwks() []byte {
+	set := map[string][]map[string]string{"keys": {
+		{"kty": "RSA", "kid": "rsa", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(k.ec.X.Bytes()), "y": b64(k.ec.Y.Bytes())},
+		{"kty": "oct", "kid": "hmac", "k": b64(k.secret)},
+	}}
+	b, _ := json.Marshal(set)
+	return b
+}
+
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, sum[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, sum[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":    "reporting-job",
+		"iss":    "https://platform.example",
+		"aud":    []string{"restservice"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"nbf":    time.Now().Add(-time.Minute).Unix(),
+		"org_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
+		"scope":  "payments:read payments:write",
+	}
+}
+
+func writeJWKS(t *testing.T, b []byte) string {
+	dir, err := ioutil.TempDir("", "jwks_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTVerify(t *testing.T) {
+	k := newTestKeys(t)
+	path := writeJWKS(t, k.jwks())
+	defer os.RemoveAll(filepath.Dir(path))
+	keys, err := NewJWKS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := NewJWT(keys, JWTConfig{Issuer: "https://platform.example", Audience: "restservice"})
+
+	claimsWith := func(name string, value interface{}) map[string]interface{} {
+		c := validClaims()
+		c[name] = value
+		return c
+	}
+	tests := []struct {
+		name     string
+		token    string
+		expected error
+	}{
+		{"RS256", k.sign(t, "RS256", "rsa", validClaims()), nil},
+		{"ES256", k.sign(t, "ES256", "ec", validClaims()), nil},
+		{"HS256", k.sign(t, "HS256", "hmac", validClaims()), nil},
+		{"unknown kid", k.sign(t, "RS256", "other", validClaims()), ErrUnknownKey},
+		{"alg confusion", k.sign(t, "HS256", "rsa", validClaims()), ErrUnknownKey},
+		{"none", k.sign(t, "none", "rsa", validClaims()), ErrUnsupportedAlgorithm},
+		{"tampered", k.sign(t, "RS256", "rsa", validClaims())[1:], ErrMalformedToken},
+		{"expired", k.sign(t, "RS256", "rsa", claimsWith("exp", time.Now().Add(-time.Hour).Unix())), ErrTokenExpired},
+		{"not before", k.sign(t, "RS256", "rsa", claimsWith("nbf", time.Now().Add(time.Hour).Unix())), ErrTokenNotYetValid},
+		{"issuer", k.sign(t, "RS256", "rsa", claimsWith("iss", "https://evil.example")), ErrWrongIssuer},
+		{"audience", k.sign(t, "RS256", "rsa", claimsWith("aud", "other")), ErrWrongAudience},
+	}
+	for _, test := range tests {
+		p, err := j.Verify(test.token)
+		if err != test.expected {
+			t.Errorf("%s: got error '%v' want '%v'", test.name, err, test.expected)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if p.OrganisationID != "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb" || !p.HasScope("payments:write") || p.Subject != "reporting-job" {
+			t.Errorf("%s: unexpected principal %+v", test.name, p)
+		}
+	}
+}
+
+func TestJWKSRefreshFromURL(t *testing.T) {
+	old := newTestKeys(t)
+	current := newTestKeys(t)
+	served := old.jwks()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	}))
+	defer srv.Close()
+
+	keys, err := NewJWKS(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := NewJWT(keys, JWTConfig{Issuer: "https://platform.example", Audience: "restservice"})
+	token := current.sign(t, "ES256", "ec", validClaims())
+	if _, err := j.Verify(token); err != ErrBadSignature {
+		t.Fatalf("got error '%v' want '%v'", err, ErrBadSignature)
+	}
+
+	// Rotate the keys behind the URL and reload them
+	served = current.jwks()
+	if err := keys.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Verify(token); err != nil {
+		t.Fatalf("got error '%v' after refreshing keys", err)
+	}
+}
+
+func TestJWKSRefreshFailureWaits(t *testing.T) {
+	keys := newTestKeys(t)
+	var mu sync.Mutex
+	fetches, failing := 0, false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(keys.jwks())
+	}))
+	defer srv.Close()
+
+	set, err := NewJWKS(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	fetches, failing = 0, true
+	mu.Unlock()
+	set.mu.Lock()
+	set.attempted = time.Now().Add(-time.Minute)
+	set.mu.Unlock()
+
+	// Requests for unknown keys arriving together reload the set once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := set.key("rotated"); err != ErrUnknownKey {
+				t.Errorf("got error '%v' want '%v'", err, ErrUnknownKey)
+			}
+		}()
+	}
+	wg.Wait()
+	// and a failed reload is not retried straight away
+	if _, err := set.key("rotated"); err != ErrUnknownKey {
+		t.Errorf("got error '%v' want '%v'", err, ErrUnknownKey)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 1 {
+		t.Errorf("key set fetched %d times, want once", fetches)
+	}
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+// Permissions, which are granted as token scopes or through roles
+const (
+	PaymentsRead    = "payments:read"
+	PaymentsWrite   = "payments:write"
+	PaymentsDelete  = "payments:delete"
+	PaymentsApprove = "payments:approve"
+	Admin           = "admin"
+)
+
+// Policy decides which callers may use each named route. A route is allowed
+// when the caller holds any of the permissions listed for it, either as a
+// scope or through a role. Routes listing no permissions, or missing from the
+// policy, are never allowed, except to super-admins who may do anything.
+type Policy struct {
+	// Roles grants each role a set of permissions
+	Roles map[string][]string `json:"roles"`
+	// Routes lists the permissions, any one of which allows a route
+	Routes map[string][]string `json:"routes"`
+}
+
+// DefaultPolicy is used when no policy file is supplied
+func DefaultPolicy() *Policy {
+	read := []string{PaymentsRead}
+	write := []string{PaymentsWrite}
+	admin := []string{Admin}
+	// No permission allows these, leaving them to super-admins
+	superAdmin := []string{}
+	return &Policy{
+		Roles: map[string][]string{
+			"reader":   {PaymentsRead},
+			"writer":   {PaymentsRead, PaymentsWrite},
+			"approver": {PaymentsRead, PaymentsApprove},
+			"admin":    {PaymentsRead, PaymentsWrite, PaymentsDelete, PaymentsApprove, Admin},
+		},
+		Routes: map[string][]string{
+			"payments.list":        read,
+			"payments.get":         read,
+			"payments.create":      write,
+			"payments.replace":     write,
+			"payments.update":      write,
+			"payments.patch":       write,
+			"payments.delete":      {PaymentsDelete},
+			"payments.history":     read,
+			"payments.settle":      write,
+			"approvals.list":       read,
+			"approvals.create":     {PaymentsApprove},
+			"transactions.list":    read,
+			"returns.list":         read,
+			"returns.create":       write,
+			"reversals.list":       read,
+			"reversals.create":     write,
+			"parties.list":         read,
+			"parties.get":          read,
+			"parties.create":       write,
+			"parties.update":       write,
+			"parties.delete":       {PaymentsDelete},
+			"accounts.list":        read,
+			"accounts.get":         read,
+			"accounts.create":      admin,
+			"accounts.update":      admin,
+			"accounts.delete":      admin,
+			"accounts.balance":     read,
+			"accounts.entries":     read,
+			"organisations.list":   read,
+			"organisations.get":    read,
+			"organisations.create": superAdmin,
+			"organisations.update": superAdmin,
+			"organisations.delete": superAdmin,
+			"keys.list":            superAdmin,
+			"keys.issue":           superAdmin,
+			"keys.revoke":          superAdmin,
+		},
+	}
+}
+
+// LoadPolicy reads a JSON policy from path
+func LoadPolicy(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p Policy
+	if err := json.NewDecoder(f).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks that every named route of the router is covered by the
+// policy, so a new route cannot be forgotten and silently refused
+func (p *Policy) Validate(router *mux.Router) error {
+	var missing []string
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		name := route.GetName()
+		if len(name) == 0 {
+			tpl, _ := route.GetPathTemplate()
+			missing = append(missing, tpl)
+		} else if _, ok := p.Routes[name]; !ok {
+			missing = append(missing, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("no policy for routes: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Allowed reports whether the principal may use a route
+func (p *Policy) Allowed(principal *Principal, route string) bool {
+	if principal.IsSuperAdmin() {
+		return true
+	}
+	for _, perm := range p.Routes[route] {
+		if principal.HasScope(perm) {
+			return true
+		}
+		for _, role := range principal.Roles {
+			for _, granted := range p.Roles[role] {
+				if granted == perm {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Middleware refuses requests for routes the caller is not allowed to use.
+// It must run after authentication has added the principal to the context.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := FromContext(r.Context())
+		if !ok {
+			problem.Write(w, http.StatusUnauthorized, "credentials required")
+			return
+		}
+		var name string
+		if route := mux.CurrentRoute(r); route != nil {
+			name = route.GetName()
+		}
+		if !p.Allowed(principal, name) {
+			detail := "requires a super-admin"
+			if perms := p.Routes[name]; len(perms) > 0 {
+				detail = fmt.Sprintf("requires one of: %s", strings.Join(perms, ", "))
+			}
+			problem.Write(w, http.StatusForbidden, detail)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+func policyRouter(p *Policy, principal *Principal) *mux.Router {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", ok).Methods("GET").Name("payments.get")
+	router.HandleFunc("/payments/{id}", ok).Methods("PUT").Name("payments.create")
+	router.HandleFunc("/payments/{id}", ok).Methods("DELETE").Name("payments.delete")
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), principal)))
+		})
+	}, p.Middleware)
+	return router
+}
+
+func TestPolicyMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *Principal
+		method    string
+		expected  int
+	}{
+		{"read scope may read", &Principal{Scopes: []string{PaymentsRead}}, "GET", http.StatusOK},
+		{"read scope may not delete", &Principal{Scopes: []string{PaymentsRead}}, "DELETE", http.StatusForbidden},
+		{"writer role may create", &Principal{Roles: []string{"writer"}}, "PUT", http.StatusOK},
+		{"writer role may not delete", &Principal{Roles: []string{"writer"}}, "DELETE", http.StatusForbidden},
+		{"admin role may delete", &Principal{Roles: []string{"admin"}}, "DELETE", http.StatusOK},
+		{"no permissions", &Principal{}, "GET", http.StatusForbidden},
+		{"super-admin", &Principal{Roles: []string{RoleSuperAdmin}}, "DELETE", http.StatusOK},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "/payments/foobar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		policyRouter(DefaultPolicy(), test.principal).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expected {
+			t.Errorf("%s: middleware returned wrong status code: got '%v' want '%v'", test.name, status, test.expected)
+		}
+		if test.expected == http.StatusForbidden && rr.Header().Get("Content-Type") != problem.ContentType {
+			t.Errorf("%s: middleware did not return a problem response", test.name)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	p := DefaultPolicy()
+	router := policyRouter(p, &Principal{})
+	if err := p.Validate(router); err != nil {
+		t.Fatalf("unexpected error validating policy: %s", err)
+	}
+
+	// Any route the policy does not know about is an error
+	router.HandleFunc("/payments/{id}/secret", func(w http.ResponseWriter, r *http.Request) {}).Name("payments.secret")
+	if err := p.Validate(router); err == nil {
+		t.Fatal("expected an error for a route missing from the policy")
+	}
+}
+
+func TestPolicySuperAdminRoutes(t *testing.T) {
+	p := DefaultPolicy()
+	for _, route := range []string{"organisations.create", "organisations.update", "organisations.delete",
+		"keys.list", "keys.issue", "keys.revoke"} {
+		if p.Allowed(&Principal{Roles: []string{"admin"}}, route) {
+			t.Errorf("%s: admin role allowed a route only super-admins may use", route)
+		}
+		if !p.Allowed(&Principal{Roles: []string{RoleSuperAdmin}}, route) {
+			t.Errorf("%s: super-admin refused", route)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// StaticCredential is a bearer token issued out of band, such as to support
+// staff. Only the SHA-256 hash of the token is kept.
+type StaticCredential struct {
+	TokenSHA256 string `json:"token_sha256"`
+	Principal
+}
+
+// Static authenticates bearer tokens listed in a credentials file
+type Static struct {
+	principals map[string]*Principal
+}
+
+// NewStatic returns an authenticator for a set of credentials
+func NewStatic(creds []*StaticCredential) *Static {
+	s := &Static{principals: make(map[string]*Principal)}
+	for _, c := range creds {
+		p := c.Principal
+		s.principals[c.TokenSHA256] = &p
+	}
+	return s
+}
+
+// LoadStatic reads a JSON array of credentials from path
+func LoadStatic(path string) (*Static, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var creds []*StaticCredential
+	if err := json.NewDecoder(f).Decode(&creds); err != nil {
+		return nil, err
+	}
+	return NewStatic(creds), nil
+}
+
+// Authenticate looks up the hash of the bearer token
+func (s *Static) Authenticate(r *http.Request) (*Principal, error) {
+	token := BearerToken(r)
+	if len(token) == 0 {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(token))
+	p, ok := s.principals[hex.EncodeToString(sum[:])]
+	if !ok {
+		// Leave the token for any other authenticator to try
+		return nil, nil
+	}
+	return p, nil
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNoClientCAs is returned when a client CA bundle holds no certificates
+	ErrNoClientCAs = errors.New("no certificates in client CA bundle")
+	// ErrUnknownClientCertificate is returned for verified client certificates with no principal
+	ErrUnknownClientCertificate = errors.New("client certificate not recognised")
+)
+
+// TLSConfig describes how the server terminates TLS and which client
+// certificates it accepts
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM server certificate chain and key
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile is a PEM bundle of the CAs which sign client certificates,
+	// none are asked for when empty
+	ClientCAFile string `json:"client_ca_file"`
+	// RequireClientCert refuses connections without a client certificate,
+	// otherwise callers may authenticate in other ways instead
+	RequireClientCert bool `json:"require_client_cert"`
+	// ReloadSeconds is how often to check the files for rotated
+	// certificates, zero to never
+	ReloadSeconds int `json:"reload_seconds"`
+	// ClientCertificates map client certificate subjects to principals
+	ClientCertificates []*ClientCertificate `json:"client_certificates"`
+}
+
+// Certificates holds the server certificate and client CAs, which are
+// swapped for new ones when the files are rotated
+type Certificates struct {
+	cfg      TLSConfig
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modified time.Time
+}
+
+// NewCertificates loads the files named by cfg
+func NewCertificates(cfg TLSConfig) (*Certificates, error) {
+	c := &Certificates{cfg: cfg}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadTLS reads a JSON TLSConfig from path and loads its certificates
+func LoadTLS(path string) (*Certificates, *TLSConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var cfg TLSConfig
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, nil, err
+	}
+	certs, err := NewCertificates(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, &cfg, nil
+}
+
+// Reload reads the certificate, key and client CAs from their files. The
+// current ones are kept when any of the files cannot be loaded.
+func (c *Certificates) Reload() error {
+	modified, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if len(c.cfg.ClientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrNoClientCAs
+		}
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCA = pool
+	c.modified = modified
+	c.mu.Unlock()
+	return nil
+}
+
+// ReloadEvery reloads the certificates whenever one of the files has changed,
+// checking periodically until stop is closed
+func (c *Certificates) ReloadEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			modified, err := c.lastModified()
+			if err != nil {
+				log.Errorf("Error checking certificates: %s", err)
+				continue
+			}
+			c.mu.RLock()
+			changed := modified.After(c.modified)
+			c.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := c.Reload(); err != nil {
+				log.Errorf("Error reloading certificates: %s", err)
+			} else {
+				log.Info("reloaded TLS certificates")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ServerConfig returns a TLS configuration which always uses the most
+// recently loaded certificates
+func (c *Certificates) ServerConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// net/http only adds HTTP/2 to the server's own config, which the
+		// config for each client replaces, so it is offered here
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	cfg := base.Clone()
+	// Lets ListenAndServeTLS start without certificate files
+	cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return c.cert, nil
+	}
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		client := base.Clone()
+		client.Certificates = []tls.Certificate{*c.cert}
+		if c.clientCA != nil {
+			client.ClientCAs = c.clientCA
+			client.ClientAuth = tls.VerifyClientCertIfGiven
+			if c.cfg.RequireClientCert {
+				client.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		return client, nil
+	}
+	return cfg
+}
+
+// lastModified returns the latest modification time of the files
+func (c *Certificates) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.cfg.CertFile, c.cfg.KeyFile, c.cfg.ClientCAFile} {
+		if len(path) == 0 {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ClientCertificate maps the subject of a client certificate, either its full
+// distinguished name or just its common name, to a principal
+type ClientCertificate struct {
+	Subject string `json:"subject"`
+	Principal
+}
+
+// ClientCertificates authenticates callers by the client certificate they
+// presented, which the TLS handshake has already verified against the CAs
+type ClientCertificates struct {
+	principals map[string]*Principal
+}
+
+// NewClientCertificates returns an authenticator for a set of subjects
+func NewClientCertificates(certs []*ClientCertificate) *ClientCertificates {
+	c := &ClientCertificates{principals: make(map[string]*Principal)}
+	for _, cert := range certs {
+		p := cert.Principal
+		if len(p.Subject) == 0 {
+			p.Subject = fmt.Sprintf("cert:%s", cert.Subject)
+		}
+		c.principals[cert.Subject] = &p
+	}
+	return c
+}
+
+// Authenticate looks up the subject of the verified client certificate
+func (c *ClientCertificates) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if p, ok := c.principals[subject.String()]; ok {
+		return p, nil
+	}
+	if p, ok := c.principals[subject.CommonName]; ok {
+		return p, nil
+	}
+	return nil, ErrUnknownClientCertificate
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate signed by parent, or a self-signed CA
+// certificate when parent is nil
+func newTestCert(t *testing.T, parent *testCert, serial int64, subject pkix.Name) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certPath, keyPath string) {
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if len(keyPath) == 0 {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, nil, 1, pkix.Name{CommonName: "Test CA"})
+	ca.write(t, filepath.Join(dir, "ca.pem"), "")
+	newTestCert(t, ca, 2, pkix.Name{CommonName: "server"}).
+		write(t, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	cfg := []byte(`{
+		"cert_file": "` + filepath.Join(dir, "cert.pem") + `",
+		"key_file": "` + filepath.Join(dir, "key.pem") + `",
+		"client_ca_file": "` + filepath.Join(dir, "ca.pem") + `",
+		"client_certificates": [{"subject": "acme-payments", "organisation_id": "acme", "roles": ["writer"]}]
+	}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "tls.json"), cfg, 0600); err != nil {
+		t.Fatal(err)
+	}
+	certs, tlsConfig, err := LoadTLS(filepath.Join(dir, "tls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certs.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Middleware(NewClientCertificates(tlsConfig.ClientCertificates))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := FromContext(r.Context())
+			json.NewEncoder(w).Encode(p)
+		}))
+	go http.Serve(ln, handler)
+	defer ln.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(client *testCert) (*http.Response, error) {
+		cfg := &tls.Config{RootCAs: roots}
+		if client != nil {
+			cfg.Certificates = []tls.Certificate{client.tls()}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true}}
+		return c.Get("https://" + ln.Addr().String() + "/")
+	}
+
+	// A known client certificate identifies the organisation
+	resp, err := get(newTestCert(t, ca, 3, pkix.Name{CommonName: "acme-payments", Organization: []string{"Acme"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Principal
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if p.OrganisationID != "acme" || p.Subject != "cert:acme-payments" || !p.HasRole("writer") {
+		t.Errorf("unexpected principal: %+v", p)
+	}
+
+	// Unknown subjects and missing certificates are not authenticated
+	for _, client := range []*testCert{newTestCert(t, ca, 4, pkix.Name{CommonName: "stranger"}), nil} {
+		resp, err := get(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("got status %d, we expected %d", resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// Certificates signed by another CA are never accepted
+	other := newTestCert(t, nil, 5, pkix.Name{CommonName: "Other CA"})
+	resp, err = get(newTestCert(t, other, 6, pkix.Name{CommonName: "acme-payments"}))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("got status %d, we expected %d", resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// A rotated server certificate is used once reloaded
+	newTestCert(t, ca, 7, pkix.Name{CommonName: "server"}).
+		write(t, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 7 {
+		t.Errorf("server presented certificate %d, we expected 7", serial)
+	}
+}
+
+func TestTLSNegotiatesHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, nil, 1, pkix.Name{CommonName: "Test CA"})
+	ca.write(t, filepath.Join(dir, "ca.pem"), "")
+	newTestCert(t, ca, 2, pkix.Name{CommonName: "server"}).
+		write(t, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	cfg := []byte(`{
+		"cert_file": "` + filepath.Join(dir, "cert.pem") + `",
+		"key_file": "` + filepath.Join(dir, "key.pem") + `",
+		"client_ca_file": "` + filepath.Join(dir, "ca.pem") + `"
+	}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "tls.json"), cfg, 0600); err != nil {
+		t.Fatal(err)
+	}
+	certs, _, err := LoadTLS(filepath.Join(dir, "tls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Served as main serves it, where net/http sets up HTTP/2
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.NotFoundHandler(), TLSConfig: certs.ServerConfig()}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Errorf("negotiated protocol '%s', we expected 'h2'", proto)
+	}
+}
@@ -0,0 +1,280 @@
+// Package client calls the payments API of restservice, retrying idempotent
+// requests and turning error responses into Go errors
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adampointer/restservice/problem"
+	"github.com/adampointer/restservice/tracing"
+)
+
+// IdempotencyKeyHeader names a create so that retries of it only create once
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy chooses how often, and how far apart, idempotent requests are
+// retried when the server is unavailable, overloaded or cannot be reached
+type RetryPolicy struct {
+	// MaxAttempts is how many times a request is sent, at least once
+	MaxAttempts int
+	// MinBackoff is the wait before the first retry, doubling for each
+	// retry after it up to MaxBackoff, with some jitter
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetry sends a request up to three times
+var DefaultRetry = RetryPolicy{MaxAttempts: 3, MinBackoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second}
+
+// NoRetry sends each request once
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// backoff returns the wait before a retry, which is at least as long as the
+// server asked for
+func (p RetryPolicy) backoff(retry int, err error) time.Duration {
+	d := p.MinBackoff << uint(retry-1)
+	if d > p.MaxBackoff || d <= 0 {
+		d = p.MaxBackoff
+	}
+	if d > 0 {
+		// Jittered, so that clients which failed together do not retry together
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	if e, ok := err.(*Error); ok && e.RetryAfter > d {
+		d = e.RetryAfter
+	}
+	return d
+}
+
+// Client calls the API at a base URL with a bearer token. Its fields may be
+// changed before it is first used.
+type Client struct {
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// Retry chooses how idempotent requests are retried
+	Retry RetryPolicy
+	// Organisation is sent as X-Organisation-ID, for a super-admin acting for
+	// an organisation
+	Organisation string
+	// UserAgent is sent with each request
+	UserAgent string
+
+	base  string
+	token string
+}
+
+// New returns a client of the API at baseURL, such as
+// https://payments.example.com, which authenticates with token
+func New(baseURL, token string) *Client {
+	return &Client{
+		Retry:     DefaultRetry,
+		UserAgent: "restservice-client",
+		base:      strings.TrimSuffix(baseURL, "/"),
+		token:     token,
+	}
+}
+
+// request is a call of the API, which is retried when idempotent
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+	// idempotent requests may be sent more than once
+	idempotent bool
+}
+
+// document is a response from the API, holding a resource or a page of them
+type document struct {
+	Data  json.RawMessage `json:"data"`
+	Links struct {
+		Next string `json:"next"`
+	} `json:"links"`
+	Meta struct {
+		Total    int `json:"total"`
+		Page     int `json:"page"`
+		PageSize int `json:"page_size"`
+	} `json:"meta"`
+}
+
+func newRequest(method, path string, body interface{}) (*request, error) {
+	req := &request{method: method, path: path, header: make(http.Header)}
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		req.idempotent = true
+	}
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		req.body = b
+		req.header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// do sends a request, retrying it while it fails in a way which may pass,
+// and returns the document of the response, or nil when it has no body
+func (c *Client) do(ctx context.Context, req *request) (*document, http.Header, error) {
+	attempts := c.Retry.MaxAttempts
+	if !req.idempotent || attempts < 1 {
+		attempts = 1
+	}
+	for retry := 1; ; retry++ {
+		doc, header, err := c.send(ctx, req)
+		if err == nil || retry >= attempts || !temporary(ctx, err) {
+			return doc, header, err
+		}
+		wait := time.NewTimer(c.Retry.backoff(retry, err))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return nil, nil, ctx.Err()
+		case <-wait.C:
+		}
+	}
+}
+
+// temporary reports whether a request which failed may succeed if retried
+func temporary(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if _, ok := err.(*url.Error); ok {
+		// The server could not be reached or did not answer
+		return true
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (c *Client) send(ctx context.Context, req *request) (*document, http.Header, error) {
+	u := c.base + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	r, err := http.NewRequest(req.method, u, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	r = r.WithContext(ctx)
+	for k, v := range req.header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Accept", "application/json")
+	if len(c.token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if len(c.Organisation) > 0 {
+		r.Header.Set("X-Organisation-ID", c.Organisation)
+	}
+	if len(c.UserAgent) > 0 {
+		r.Header.Set("User-Agent", c.UserAgent)
+	}
+	// Continues the trace of the caller, when ctx is part of one
+	tracing.Inject(ctx, r.Header)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, resp.Header, newError(resp, b)
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, resp.Header, nil
+	}
+	var doc document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, resp.Header, fmt.Errorf("restservice: malformed response: %s", err)
+	}
+	return &doc, resp.Header, nil
+}
+
+// Error is an error response from the API, with the problem details the
+// server gave, or the status text when it gave none
+type Error struct {
+	StatusCode int
+	Type       string
+	Title      string
+	Detail     string
+	// RetryAfter is how long the server asked to be left before a retry
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if len(e.Detail) == 0 {
+		return fmt.Sprintf("restservice: %d %s", e.StatusCode, e.Title)
+	}
+	return fmt.Sprintf("restservice: %d %s: %s", e.StatusCode, e.Title, e.Detail)
+}
+
+func newError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Title: http.StatusText(resp.StatusCode)}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), problem.ContentType) {
+		var p problem.Problem
+		if json.Unmarshal(body, &p) == nil {
+			e.Type, e.Title, e.Detail = p.Type, p.Title, p.Detail
+		}
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// IsNotFound reports whether err is a response that there is no such
+// resource, or none the caller may see
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsVersionMismatch reports whether err is a response that a resource has
+// changed since the version the caller sent
+func IsVersionMismatch(err error) bool {
+	return hasStatus(err, http.StatusPreconditionFailed)
+}
+
+// IsRateLimited reports whether err is a response that the caller has made
+// too many requests
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
+
+func hasStatus(err error, status int) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == status
+}
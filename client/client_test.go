@@ -0,0 +1,278 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/handlers"
+	"github.com/adampointer/restservice/problem"
+	"github.com/adampointer/restservice/tracing"
+	"github.com/gorilla/mux"
+)
+
+const (
+	testOrganisation = "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"
+	testToken        = "secret"
+)
+
+// testServer serves the payments API for an organisation, authenticated by
+// testToken
+func testServer(t *testing.T) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "client_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := data.NewClient(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := &data.Organisation{ID: testOrganisation, Attributes: &data.OrganisationAttributes{Name: "Test"}}
+	if err := db.CreateOrganisation(org); err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewPayments(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", h.GetAll).Methods("GET")
+	router.HandleFunc("/payments", h.Create).Methods("POST")
+	router.HandleFunc("/payments/{id}", h.GetOne).Methods("GET")
+	router.HandleFunc("/payments/{id}", h.Replace).Methods("PUT")
+	router.HandleFunc("/payments/{id}", h.Delete).Methods("DELETE")
+	sum := sha256.Sum256([]byte(testToken))
+	router.Use(auth.Middleware(auth.NewStatic([]*auth.StaticCredential{{
+		TokenSHA256: hex.EncodeToString(sum[:]),
+		Principal:   auth.Principal{Subject: "test", OrganisationID: testOrganisation},
+	}})))
+	srv := httptest.NewServer(router)
+	return srv, func() {
+		srv.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testPayment(t *testing.T) *data.Payment {
+	b, err := ioutil.ReadFile("../example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pmt data.Payment
+	if err := json.Unmarshal(b, &pmt); err != nil {
+		t.Fatal(err)
+	}
+	pmt.ID = ""
+	return &pmt
+}
+
+func TestClientPayments(t *testing.T) {
+	srv, cleanUp := testServer(t)
+	defer cleanUp()
+	c := New(srv.URL+"/", testToken)
+	ctx := context.Background()
+
+	created, err := c.CreatePayment(ctx, testPayment(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !data.ValidID(created.ID) || created.Attributes.Status != data.StatusPending {
+		t.Errorf("unexpected payment created %+v", created)
+	}
+	got, err := c.GetPayment(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Attributes.Amount != "100.21" || got.Attributes.BeneficiaryParty.Name != "Wilfred Jeremiah Owens" {
+		t.Errorf("unexpected payment %+v", got.Attributes)
+	}
+
+	// Creating again with a key returns the payment first created
+	again, err := c.CreatePaymentWithKey(ctx, testPayment(t), "order-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, err := c.CreatePaymentWithKey(ctx, testPayment(t), "order-42"); err != nil || same.ID != again.ID {
+		t.Errorf("expected payment %s again, got %v %v", again.ID, same, err)
+	}
+
+	got.Attributes.Reference = "Invoice 42"
+	updated, err := c.UpdatePayment(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != 1 || updated.Attributes.Reference != "Invoice 42" {
+		t.Errorf("unexpected payment updated %+v", updated)
+	}
+	// The version sent is now stale
+	if _, err := c.UpdatePayment(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UpdatePayment(ctx, updated); !IsVersionMismatch(err) {
+		t.Errorf("expected a version mismatch, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.CreatePayment(ctx, testPayment(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pages := c.ListPayments(ctx, &ListOptions{PageSize: 2, Fields: []string{"amount"}})
+	var sizes []int
+	seen := make(map[string]bool)
+	for pages.Next() {
+		page := pages.Page()
+		if page.Total != 5 || page.Size != 2 {
+			t.Errorf("unexpected page %d of %d with %d in total", page.Number, page.Size, page.Total)
+		}
+		sizes = append(sizes, len(page.Payments))
+		for _, pmt := range page.Payments {
+			seen[pmt.ID] = true
+			if pmt.Attributes.Amount != "100.21" || len(pmt.Attributes.Currency) > 0 {
+				t.Errorf("expected only the amount, got %+v", pmt.Attributes)
+			}
+		}
+	}
+	if err := pages.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 3 || sizes[2] != 1 || len(seen) != 5 {
+		t.Errorf("expected pages of 2, 2 and 1 payments, got %v with %d payments", sizes, len(seen))
+	}
+
+	if err := c.DeletePayment(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetPayment(ctx, created.ID); !IsNotFound(err) {
+		t.Errorf("expected the payment not to be found, got %v", err)
+	}
+	all, err := c.ListPayments(ctx, nil).All()
+	if err != nil || len(all) != 4 {
+		t.Errorf("expected 4 payments, got %d %v", len(all), err)
+	}
+
+	// Problems are decoded
+	_, err = New(srv.URL, "wrong").GetPayment(ctx, created.ID)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusUnauthorized || len(e.Detail) == 0 {
+		t.Errorf("expected problem details of a 401, got %#v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls int32
+	fail := int32(2)
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+		if atomic.AddInt32(&calls, 1) <= atomic.LoadInt32(&fail) {
+			w.Header().Set("Retry-After", "0")
+			problem.Write(w, http.StatusServiceUnavailable, "draining")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"type": "Payment", "id": "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"}}`))
+	}))
+	defer srv.Close()
+	c := New(srv.URL, testToken)
+	c.Retry = RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+	ctx := context.Background()
+
+	if _, err := c.GetPayment(ctx, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"); err != nil || calls != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d", err, calls)
+	}
+
+	// A create is retried with the same key
+	calls, keys = 0, nil
+	if _, err := c.CreatePayment(ctx, &data.Payment{}); err != nil || calls != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d", err, calls)
+	}
+	if len(keys) != 3 || len(keys[0]) == 0 || keys[1] != keys[0] || keys[2] != keys[0] {
+		t.Errorf("expected the same idempotency key each time, got %q", keys)
+	}
+
+	// Attempts run out
+	calls, fail = 0, 5
+	_, err := c.GetPayment(ctx, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable || e.Detail != "draining" ||
+		calls != 3 {
+		t.Errorf("expected 503 after 3 attempts, got %v after %d", err, calls)
+	}
+
+	// Nor is a cancelled request retried
+	calls = 0
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.GetPayment(cancelled, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"); err == nil || calls > 1 {
+		t.Errorf("expected the cancelled request to fail at once, got %v after %d", err, calls)
+	}
+}
+
+func TestClientErrorsNotRetried(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	c := New(srv.URL, testToken)
+	_, err := c.GetPayment(context.Background(), "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43")
+	if !IsNotFound(err) || calls != 1 {
+		t.Errorf("expected one 404, got %v after %d", err, calls)
+	}
+	if !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("expected the status text, got %q", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, MinBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	for retry, max := range []time.Duration{100, 200, 300, 300} {
+		max *= time.Millisecond
+		if d := p.backoff(retry+1, nil); d < max/2 || d > max {
+			t.Errorf("retry %d: backoff %s, want between %s and %s", retry+1, d, max/2, max)
+		}
+	}
+	if d := p.backoff(1, &Error{RetryAfter: time.Second}); d != time.Second {
+		t.Errorf("expected to wait as long as asked, got %s", d)
+	}
+}
+
+type discardExporter struct{}
+
+func (discardExporter) Export(spans []*tracing.Span) error {
+	return nil
+}
+
+func TestClientPropagatesTrace(t *testing.T) {
+	var traceParent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent = r.Header.Get(tracing.HeaderTraceParent)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	c := New(srv.URL, testToken)
+
+	tracer := tracing.NewTracer(discardExporter{}, time.Hour)
+	defer tracer.Shutdown()
+	ctx, span := tracer.StartTrace(httptest.NewRequest("GET", "/", nil), "test")
+	c.GetPayment(ctx, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43")
+	if traceParent != span.TraceParent() {
+		t.Errorf("expected traceparent '%s', got '%s'", span.TraceParent(), traceParent)
+	}
+
+	// Nothing is sent outside a trace
+	c.GetPayment(context.Background(), "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43")
+	if len(traceParent) > 0 {
+		t.Errorf("expected no traceparent, got '%s'", traceParent)
+	}
+}
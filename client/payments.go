@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/adampointer/restservice/data"
+)
+
+// GetPayment returns the payment with an ID
+func (c *Client) GetPayment(ctx context.Context, id string) (*data.Payment, error) {
+	req, err := newRequest("GET", "/payments/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.payment(ctx, req)
+}
+
+// CreatePayment creates a payment with an ID chosen by the server, so the
+// payment must not have one, and returns it as created. It is sent with an
+// idempotency key, so that retries of it create the payment only once.
+func (c *Client) CreatePayment(ctx context.Context, pmt *data.Payment) (*data.Payment, error) {
+	key, err := data.NewID()
+	if err != nil {
+		return nil, err
+	}
+	return c.CreatePaymentWithKey(ctx, pmt, key)
+}
+
+// CreatePaymentWithKey creates a payment with an idempotency key chosen by the
+// caller, such as the ID of the order it pays for. Creating a payment again
+// with the same key returns the payment first created rather than another.
+func (c *Client) CreatePaymentWithKey(ctx context.Context, pmt *data.Payment, key string) (*data.Payment, error) {
+	req, err := newRequest("POST", "/payments", pmt)
+	if err != nil {
+		return nil, err
+	}
+	req.header.Set(IdempotencyKeyHeader, key)
+	req.idempotent = true
+	return c.payment(ctx, req)
+}
+
+// UpdatePayment replaces the payment with the ID of pmt in full, creating it
+// if there is none, and returns it as saved. A non-zero version must be that
+// of the stored payment, so a retry of an update which succeeded without the
+// caller hearing of it fails with a version mismatch.
+func (c *Client) UpdatePayment(ctx context.Context, pmt *data.Payment) (*data.Payment, error) {
+	if len(pmt.ID) == 0 {
+		return nil, fmt.Errorf("restservice: a payment to update must have an ID")
+	}
+	req, err := newRequest("PUT", "/payments/"+url.PathEscape(pmt.ID), pmt)
+	if err != nil {
+		return nil, err
+	}
+	return c.payment(ctx, req)
+}
+
+// DeletePayment deletes the payment with an ID
+func (c *Client) DeletePayment(ctx context.Context, id string) error {
+	req, err := newRequest("DELETE", "/payments/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(ctx, req)
+	return err
+}
+
+func (c *Client) payment(ctx context.Context, req *request) (*data.Payment, error) {
+	doc, _, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("restservice: %s %s returned no payment", req.method, req.path)
+	}
+	var pmt data.Payment
+	if err := json.Unmarshal(doc.Data, &pmt); err != nil {
+		return nil, fmt.Errorf("restservice: malformed payment: %s", err)
+	}
+	return &pmt, nil
+}
+
+// ListOptions choose the pages of payments listed
+type ListOptions struct {
+	// PageSize is how many payments are on each page, the server's default
+	// when zero
+	PageSize int
+	// Page is the first page listed, from 1
+	Page int
+	// Fields are the only attributes of the payments returned, with fields
+	// of objects named with a dot, such as beneficiary_party.name
+	Fields []string
+}
+
+// PaymentPage is a page of payments
+type PaymentPage struct {
+	Payments []*data.Payment
+	// Number of the page, from 1
+	Number int
+	Size   int
+	// Total number of payments on all the pages
+	Total int
+}
+
+// PaymentPages iterates over the pages of payments, fetching each as it is
+// reached:
+//
+//	pages := c.ListPayments(ctx, nil)
+//	for pages.Next() {
+//		for _, pmt := range pages.Page().Payments {
+//			...
+//		}
+//	}
+//	if err := pages.Err(); err != nil {
+//		...
+//	}
+type PaymentPages struct {
+	c    *Client
+	ctx  context.Context
+	opts ListOptions
+	page *PaymentPage
+	next int
+	done bool
+	err  error
+}
+
+// ListPayments returns an iterator over the pages of payments
+func (c *Client) ListPayments(ctx context.Context, opts *ListOptions) *PaymentPages {
+	it := &PaymentPages{c: c, ctx: ctx, next: 1}
+	if opts != nil {
+		it.opts = *opts
+	}
+	if it.opts.Page > 1 {
+		it.next = it.opts.Page
+	}
+	return it
+}
+
+// Next fetches the next page, reporting whether there was one
+func (it *PaymentPages) Next() bool {
+	if it.done {
+		return false
+	}
+	req, err := newRequest("GET", "/payments", nil)
+	if err != nil {
+		return it.fail(err)
+	}
+	req.query = url.Values{"page[number]": {strconv.Itoa(it.next)}}
+	if it.opts.PageSize > 0 {
+		req.query.Set("page[size]", strconv.Itoa(it.opts.PageSize))
+	}
+	if len(it.opts.Fields) > 0 {
+		req.query.Set("fields[payments]", strings.Join(it.opts.Fields, ","))
+	}
+	doc, _, err := it.c.do(it.ctx, req)
+	if err != nil {
+		return it.fail(err)
+	}
+	if doc == nil {
+		return it.fail(fmt.Errorf("restservice: GET /payments returned no payments"))
+	}
+	page := &PaymentPage{Number: doc.Meta.Page, Size: doc.Meta.PageSize, Total: doc.Meta.Total}
+	if err := json.Unmarshal(doc.Data, &page.Payments); err != nil {
+		return it.fail(fmt.Errorf("restservice: malformed payments: %s", err))
+	}
+	// Only the last page has no link to the next, including when past the end
+	it.done = len(doc.Links.Next) == 0
+	if len(page.Payments) == 0 {
+		it.done = true
+		return false
+	}
+	it.page = page
+	it.next++
+	return true
+}
+
+func (it *PaymentPages) fail(err error) bool {
+	it.err = err
+	it.done = true
+	it.page = nil
+	return false
+}
+
+// Page returns the page Next fetched
+func (it *PaymentPages) Page() *PaymentPage {
+	return it.page
+}
+
+// Err returns the error which stopped the iteration, if any
+func (it *PaymentPages) Err() error {
+	return it.err
+}
+
+// All returns the payments of the pages not yet iterated over
+func (it *PaymentPages) All() ([]*data.Payment, error) {
+	var pmts []*data.Payment
+	for it.Next() {
+		pmts = append(pmts, it.Page().Payments...)
+	}
+	return pmts, it.Err()
+}
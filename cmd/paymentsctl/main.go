@@ -0,0 +1,466 @@
+// Command paymentsctl gets, lists, creates, updates, deletes, exports and
+// imports payments through the payments API
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/adampointer/restservice/client"
+	"github.com/adampointer/restservice/config"
+	"github.com/adampointer/restservice/data"
+)
+
+// EnvPrefix starts the name of every environment variable read
+const EnvPrefix = "PAYMENTSCTL_"
+
+const usage = `usage: paymentsctl [flags] <command> [command flags] [arguments]
+
+commands:
+  get <id>...                 show payments
+  list                        show a page of payments, or -all of them
+  create -f <file>            create a payment, with an ID chosen by the server
+  update -f <file> [<id>]     replace a payment in full, or create it with its ID
+  delete <id>...              delete payments
+  export [-f <file>]          write every payment as JSON
+  import -f <file>            create the payments of an export, keeping their IDs
+
+A file of - is standard input or output. Run a command with -h for its flags.
+
+flags:
+`
+
+// Profile is an environment to call, chosen by name from the profiles file
+type Profile struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	// TokenEnv names an environment variable holding the token, so that it
+	// need not be written in the file
+	TokenEnv string `json:"token_env"`
+	// Organisation is acted for, by a super-admin
+	Organisation string `json:"organisation"`
+	// Output is the format used unless another is asked for
+	Output string `json:"output"`
+}
+
+// Profiles is the profiles file, by default ~/.paymentsctl.yaml
+type Profiles struct {
+	// Default is the profile used unless another is asked for
+	Default  string              `json:"default"`
+	Profiles map[string]*Profile `json:"profiles"`
+}
+
+// cli is a run of the command
+type cli struct {
+	ctx    context.Context
+	client *client.Client
+	output string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// errUsage is returned when a command is called wrongly, after saying how
+var errUsage = errors.New("usage")
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	os.Exit(run(ctx, os.Args[1:], os.LookupEnv, os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command, returning its exit status
+func run(ctx context.Context, args []string, lookupEnv func(string) (string, bool), stdin io.Reader,
+	stdout, stderr io.Writer) int {
+	env := func(name string) string {
+		v, _ := lookupEnv(EnvPrefix + name)
+		return v
+	}
+	fs := flag.NewFlagSet("paymentsctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	profilesFile := fs.String("profiles", env("PROFILES"), "profiles file, ~/.paymentsctl.yaml by default (env "+
+		EnvPrefix+"PROFILES)")
+	profileName := fs.String("profile", env("PROFILE"), "profile to use (env "+EnvPrefix+"PROFILE)")
+	baseURL := fs.String("url", env("URL"), "URL of the API, overriding the profile (env "+EnvPrefix+"URL)")
+	output := fs.String("output", env("OUTPUT"), "output format: table, json or yaml (env "+EnvPrefix+"OUTPUT)")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	profile, err := loadProfile(*profilesFile, *profileName, lookupEnv)
+	if err != nil {
+		fmt.Fprintf(stderr, "paymentsctl: %s\n", err)
+		return 2
+	}
+	if len(*baseURL) > 0 {
+		profile.URL = *baseURL
+	}
+	if token := env("TOKEN"); len(token) > 0 {
+		profile.Token = token
+	}
+	if len(*output) > 0 {
+		profile.Output = *output
+	}
+	if len(profile.Output) == 0 {
+		profile.Output = outputTable
+	}
+	if _, ok := formats[profile.Output]; !ok {
+		fmt.Fprintf(stderr, "paymentsctl: unknown output %q, must be table, json or yaml\n", profile.Output)
+		return 2
+	}
+	c := client.New(profile.URL, profile.Token)
+	c.Organisation = profile.Organisation
+	c.UserAgent = "paymentsctl"
+	cmd := &cli{ctx: ctx, client: c, output: profile.Output, stdin: stdin, stdout: stdout, stderr: stderr}
+
+	commands := map[string]func([]string) error{
+		"get":    cmd.get,
+		"list":   cmd.list,
+		"create": cmd.create,
+		"update": cmd.update,
+		"delete": cmd.delete,
+		"export": cmd.export,
+		"import": cmd.importPayments,
+	}
+	name := fs.Arg(0)
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "paymentsctl: unknown command %q\n", name)
+		fs.Usage()
+		return 2
+	}
+	switch err := command(fs.Args()[1:]); err {
+	case nil, flag.ErrHelp:
+		return 0
+	case errUsage:
+		return 2
+	default:
+		fmt.Fprintf(stderr, "paymentsctl: %s\n", err)
+		return 1
+	}
+}
+
+// loadProfile returns the named profile, or the default one. A missing
+// profiles file is only an error when it or a profile in it was asked for.
+func loadProfile(path, name string, lookupEnv func(string) (string, bool)) (*Profile, error) {
+	explicit := len(path) > 0
+	if !explicit {
+		home, _ := lookupEnv("HOME")
+		path = filepath.Join(home, ".paymentsctl.yaml")
+	}
+	var profiles Profiles
+	if err := config.DecodeFile(path, &profiles); err != nil {
+		if !os.IsNotExist(err) || explicit || len(name) > 0 {
+			return nil, err
+		}
+	}
+	if len(name) == 0 {
+		name = profiles.Default
+	}
+	profile := &Profile{URL: "http://localhost:8080"}
+	if len(name) > 0 {
+		p, ok := profiles.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: no profile %q", path, name)
+		}
+		*profile = *p
+	}
+	if len(profile.TokenEnv) > 0 {
+		profile.Token, _ = lookupEnv(profile.TokenEnv)
+	}
+	return profile, nil
+}
+
+// flags returns a flag set for a command, which reports errors and help on
+// the command's standard error
+func (c *cli) flags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: paymentsctl %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags of a command, which takes from min to max
+// arguments, with max < 0 for any number
+func parse(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func (c *cli) get(args []string) error {
+	fs := c.flags("get", "<id>...")
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+	var pmts []*data.Payment
+	for _, id := range fs.Args() {
+		pmt, err := c.client.GetPayment(c.ctx, id)
+		if err != nil {
+			return fmt.Errorf("%s: %s", id, err)
+		}
+		pmts = append(pmts, pmt)
+	}
+	return c.write(pmts, fs.NArg() == 1)
+}
+
+func (c *cli) list(args []string) error {
+	fs := c.flags("list", "")
+	page := fs.Int("page", 1, "page to show, from 1")
+	pageSize := fs.Int("page-size", 0, "payments on each page, the server's default when 0")
+	fields := fs.String("fields", "", "only these attributes, comma separated, such as amount,beneficiary_party.name")
+	all := fs.Bool("all", false, "show every page from -page on")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	opts := &client.ListOptions{Page: *page, PageSize: *pageSize}
+	if len(*fields) > 0 {
+		opts.Fields = strings.Split(*fields, ",")
+	}
+	pages := c.client.ListPayments(c.ctx, opts)
+	var pmts []*data.Payment
+	for pages.Next() {
+		pmts = append(pmts, pages.Page().Payments...)
+		if !*all {
+			break
+		}
+	}
+	if err := pages.Err(); err != nil {
+		return err
+	}
+	return c.write(pmts, false)
+}
+
+func (c *cli) create(args []string) error {
+	fs := c.flags("create", "")
+	file := fs.String("f", "", "JSON file of the payment")
+	key := fs.String("idempotency-key", "", "create the payment once however often this is run with the key")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	var pmt data.Payment
+	if err := c.readJSON(*file, &pmt); err != nil {
+		return err
+	}
+	// IDs are chosen by the server, so one read from a file is left out
+	pmt.ID = ""
+	var created *data.Payment
+	var err error
+	if len(*key) > 0 {
+		created, err = c.client.CreatePaymentWithKey(c.ctx, &pmt, *key)
+	} else {
+		created, err = c.client.CreatePayment(c.ctx, &pmt)
+	}
+	if err != nil {
+		return err
+	}
+	return c.write([]*data.Payment{created}, true)
+}
+
+func (c *cli) update(args []string) error {
+	fs := c.flags("update", "[<id>]")
+	file := fs.String("f", "", "JSON file of the payment")
+	force := fs.Bool("force", false, "replace the payment whatever its version")
+	if err := parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+	var pmt data.Payment
+	if err := c.readJSON(*file, &pmt); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		pmt.ID = fs.Arg(0)
+	}
+	if *force {
+		pmt.Version = 0
+	}
+	updated, err := c.client.UpdatePayment(c.ctx, &pmt)
+	if err != nil {
+		if client.IsVersionMismatch(err) {
+			return fmt.Errorf("%s has changed since version %d, get it again or -force", pmt.ID, pmt.Version)
+		}
+		return err
+	}
+	return c.write([]*data.Payment{updated}, true)
+}
+
+func (c *cli) delete(args []string) error {
+	fs := c.flags("delete", "<id>...")
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+	for _, id := range fs.Args() {
+		if err := c.client.DeletePayment(c.ctx, id); err != nil {
+			return fmt.Errorf("%s: %s", id, err)
+		}
+		fmt.Fprintf(c.stderr, "deleted %s\n", id)
+	}
+	return nil
+}
+
+func (c *cli) export(args []string) error {
+	fs := c.flags("export", "")
+	file := fs.String("f", "-", "file to write")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	pmts, err := c.client.ListPayments(c.ctx, &client.ListOptions{PageSize: exportPageSize}).All()
+	if err != nil {
+		return err
+	}
+	if pmts == nil {
+		pmts = []*data.Payment{}
+	}
+	w := c.stdout
+	if *file != "-" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeJSON(w, pmts); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stderr, "exported %d payments\n", len(pmts))
+	return nil
+}
+
+// exportPageSize is the most the API returns at once
+const exportPageSize = 1000
+
+func (c *cli) importPayments(args []string) error {
+	fs := c.flags("import", "")
+	file := fs.String("f", "", "JSON file of an export, or of a single payment")
+	replace := fs.Bool("replace", false, "replace payments which exist already, rather than skip them")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	var raw json.RawMessage
+	if err := c.readJSON(*file, &raw); err != nil {
+		return err
+	}
+	var pmts []*data.Payment
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+		pmts = []*data.Payment{{}}
+		err := json.Unmarshal(raw, pmts[0])
+		if err != nil {
+			return fmt.Errorf("%s: %s", *file, err)
+		}
+	} else if err := json.Unmarshal(raw, &pmts); err != nil {
+		return fmt.Errorf("%s: %s", *file, err)
+	}
+
+	var created, replaced, skipped, failed int
+	for _, pmt := range pmts {
+		outcome, err := c.importPayment(pmt, *replace)
+		if err != nil {
+			fmt.Fprintf(c.stderr, "paymentsctl: %s: %s\n", pmt.ID, err)
+			failed++
+			continue
+		}
+		switch outcome {
+		case importCreated:
+			created++
+		case importReplaced:
+			replaced++
+		default:
+			skipped++
+		}
+	}
+	fmt.Fprintf(c.stderr, "created %d, replaced %d, skipped %d, failed %d\n", created, replaced, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d payments failed to import", failed, len(pmts))
+	}
+	return nil
+}
+
+const (
+	importCreated = iota
+	importReplaced
+	importSkipped
+)
+
+// importPayment creates a payment with its ID, or with an ID chosen by the
+// server when it has none, and replaces or skips one which exists already.
+// It belongs to the caller's organisation, whichever it was exported from.
+func (c *cli) importPayment(pmt *data.Payment, replace bool) (int, error) {
+	pmt.OrganisationID = ""
+	if len(pmt.ID) == 0 {
+		_, err := c.client.CreatePayment(c.ctx, pmt)
+		return importCreated, err
+	}
+	stored, err := c.client.GetPayment(c.ctx, pmt.ID)
+	switch {
+	case client.IsNotFound(err):
+		pmt.Version = 0
+		_, err = c.client.UpdatePayment(c.ctx, pmt)
+		return importCreated, err
+	case err != nil:
+		return 0, err
+	case !replace:
+		return importSkipped, nil
+	}
+	pmt.Version = stored.Version
+	_, err = c.client.UpdatePayment(c.ctx, pmt)
+	return importReplaced, err
+}
+
+// readJSON decodes a file, or standard input for -
+func (c *cli) readJSON(file string, v interface{}) error {
+	if len(file) == 0 {
+		return fmt.Errorf("a file is required, with -f")
+	}
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = ioutil.ReadAll(c.stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	return nil
+}
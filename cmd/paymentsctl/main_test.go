@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/handlers"
+	"github.com/gorilla/mux"
+)
+
+const (
+	testOrganisation = "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"
+	testToken        = "secret"
+)
+
+// testServer serves the payments API for an organisation, authenticated by
+// testToken, and returns a directory for files which is removed with it
+func testServer(t *testing.T) (*httptest.Server, string, func()) {
+	dir, err := ioutil.TempDir("", "paymentsctl_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := data.NewClient(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := &data.Organisation{ID: testOrganisation, Attributes: &data.OrganisationAttributes{Name: "Test"}}
+	if err := db.CreateOrganisation(org); err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewPayments(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", h.GetAll).Methods("GET")
+	router.HandleFunc("/payments", h.Create).Methods("POST")
+	router.HandleFunc("/payments/{id}", h.GetOne).Methods("GET")
+	router.HandleFunc("/payments/{id}", h.Replace).Methods("PUT")
+	router.HandleFunc("/payments/{id}", h.Delete).Methods("DELETE")
+	sum := sha256.Sum256([]byte(testToken))
+	router.Use(auth.Middleware(auth.NewStatic([]*auth.StaticCredential{{
+		TokenSHA256: hex.EncodeToString(sum[:]),
+		Principal:   auth.Principal{Subject: "test", OrganisationID: testOrganisation},
+	}})))
+	srv := httptest.NewServer(router)
+	return srv, dir, func() {
+		srv.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// paymentsctl runs the command, failing the test unless it exits with status
+func paymentsctl(t *testing.T, env map[string]string, status int, stdin string, args ...string) string {
+	var stdout, stderr bytes.Buffer
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	if got := run(context.Background(), args, lookupEnv, strings.NewReader(stdin), &stdout, &stderr); got != status {
+		t.Fatalf("paymentsctl %s exited with %d, want %d: %s", strings.Join(args, " "), got, status, stderr.String())
+	}
+	return stdout.String()
+}
+
+func TestCommands(t *testing.T) {
+	srv, dir, cleanUp := testServer(t)
+	defer cleanUp()
+	profiles := filepath.Join(dir, "profiles.yaml")
+	err := ioutil.WriteFile(profiles, []byte(`default: test
+profiles:
+  test:
+    url: `+srv.URL+`
+    token_env: TEST_TOKEN
+    output: json
+  other:
+    url: http://localhost:1
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"PAYMENTSCTL_PROFILES": profiles, "TEST_TOKEN": testToken}
+
+	// Created from standard input, with the ID in the file left out
+	example, err := ioutil.ReadFile("../../example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created data.Payment
+	out := paymentsctl(t, env, 0, string(example), "create", "-f", "-")
+	if err := json.Unmarshal([]byte(out), &created); err != nil {
+		t.Fatalf("unable to decode %s: %s", out, err)
+	}
+	if !data.ValidID(created.ID) || created.ID == "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43" {
+		t.Errorf("expected an ID chosen by the server, got %s", created.ID)
+	}
+	paymentsctl(t, env, 0, string(example), "create", "-f", "-", "-idempotency-key", "order-42")
+	paymentsctl(t, env, 0, string(example), "create", "-f", "-", "-idempotency-key", "order-42")
+
+	out = paymentsctl(t, env, 0, "", "-output", "table", "get", created.ID)
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "100.21") ||
+		!strings.Contains(lines[1], "Wilfred Jeremiah Owens") {
+		t.Errorf("unexpected table:\n%s", out)
+	}
+	out = paymentsctl(t, env, 0, "", "-output", "yaml", "get", created.ID)
+	for _, line := range []string{"id: " + created.ID, "  amount: \"100.21\"", "    - amount: \"5.00\"",
+		"      currency: GBP", "  numeric_reference: 1002001", "  processing_date: \"2017-01-18\"",
+		"  reference: Payment for Em's piano lessons"} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %q in the YAML:\n%s", line, out)
+		}
+	}
+
+	// Updated from a file, with the ID given
+	created.Attributes.Reference = "Invoice 42"
+	b, _ := json.Marshal(created)
+	file := filepath.Join(dir, "payment.json")
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out = paymentsctl(t, env, 0, "", "update", "-f", file, created.ID)
+	if !strings.Contains(out, `"reference": "Invoice 42"`) || !strings.Contains(out, `"version": 1`) {
+		t.Errorf("unexpected payment updated: %s", out)
+	}
+	if err := ioutil.WriteFile(file, []byte(out), 0600); err != nil {
+		t.Fatal(err)
+	}
+	paymentsctl(t, env, 0, "", "update", "-f", file)
+	// The version in the file is now stale
+	paymentsctl(t, env, 1, "", "update", "-f", file)
+	paymentsctl(t, env, 0, "", "update", "-force", "-f", file)
+
+	var pmts []*data.Payment
+	out = paymentsctl(t, env, 0, "", "list", "-page-size", "1", "-fields", "amount")
+	if err := json.Unmarshal([]byte(out), &pmts); err != nil || len(pmts) != 1 || pmts[0].Attributes.Currency != "" {
+		t.Errorf("expected a page of one payment with only the amount, got %s", out)
+	}
+	out = paymentsctl(t, env, 0, "", "list", "-page-size", "1", "-all")
+	if err := json.Unmarshal([]byte(out), &pmts); err != nil || len(pmts) != 2 {
+		t.Errorf("expected 2 payments, got %s", out)
+	}
+
+	export := filepath.Join(dir, "export.json")
+	paymentsctl(t, env, 0, "", "export", "-f", export)
+	paymentsctl(t, env, 0, "", "delete", created.ID)
+	paymentsctl(t, env, 1, "", "get", created.ID)
+
+	// The deleted payment comes back with its ID and the other is skipped
+	paymentsctl(t, env, 0, "", "import", "-f", export)
+	out = paymentsctl(t, env, 0, "", "get", created.ID)
+	if !strings.Contains(out, `"reference": "Invoice 42"`) {
+		t.Errorf("unexpected payment imported: %s", out)
+	}
+	paymentsctl(t, env, 0, "", "import", "-f", export, "-replace")
+	if out = paymentsctl(t, env, 0, "", "list"); !strings.Contains(out, `"version": 1`) {
+		t.Errorf("expected the skipped payment to be replaced, got %s", out)
+	}
+
+	paymentsctl(t, env, 2, "", "frobnicate")
+	paymentsctl(t, env, 2, "", "get")
+	paymentsctl(t, env, 2, "", "-output", "xml", "list")
+	paymentsctl(t, env, 2, "", "-profile", "missing", "list")
+}
+
+func TestLoadProfile(t *testing.T) {
+	env := func(name string) (string, bool) {
+		return map[string]string{"HOME": "/nonexistent", "STAGING_TOKEN": "s3cret"}[name], true
+	}
+	p, err := loadProfile("", "", env)
+	if err != nil || p.URL != "http://localhost:8080" {
+		t.Errorf("expected the default profile without a file, got %+v %v", p, err)
+	}
+	if _, err := loadProfile("", "staging", env); err == nil {
+		t.Error("expected an error for a profile without a file")
+	}
+
+	dir, err := ioutil.TempDir("", "paymentsctl_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "profiles.json")
+	err = ioutil.WriteFile(file, []byte(`{"profiles": {"staging": {"url": "https://staging.example.com",
+		"token_env": "STAGING_TOKEN", "organisation": "acme"}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = loadProfile(file, "staging", env)
+	if err != nil || p.URL != "https://staging.example.com" || p.Token != "s3cret" || p.Organisation != "acme" {
+		t.Errorf("unexpected staging profile %+v %v", p, err)
+	}
+	if _, err := loadProfile(file, "production", env); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	var buf bytes.Buffer
+	v := []interface{}{
+		map[string]interface{}{"b": []interface{}{}, "a": map[string]interface{}{"c": nil, "d": []interface{}{1, "x"}}},
+		"true",
+		map[string]interface{}{},
+		"a: b",
+		map[string]interface{}{"amount": json.Number("5.00"), "count": json.Number("12345678901234567")},
+	}
+	if err := writeYAML(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	want := `- a:
+    c: null
+    d:
+    - 1
+    - x
+  b: []
+- "true"
+- {}
+- 'a: b'
+- amount: "5.00"
+  count: 12345678901234567
+`
+	if buf.String() != want {
+		t.Errorf("got YAML:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
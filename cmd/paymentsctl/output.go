@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/adampointer/restservice/data"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Output formats
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// formats write payments, either one or a list of them
+var formats = map[string]func(w io.Writer, pmts []*data.Payment, one bool) error{
+	outputTable: writeTable,
+	outputJSON: func(w io.Writer, pmts []*data.Payment, one bool) error {
+		return writeJSON(w, value(pmts, one))
+	},
+	outputYAML: func(w io.Writer, pmts []*data.Payment, one bool) error {
+		return writeYAML(w, value(pmts, one))
+	},
+}
+
+func value(pmts []*data.Payment, one bool) interface{} {
+	if one && len(pmts) == 1 {
+		return pmts[0]
+	}
+	if pmts == nil {
+		return []*data.Payment{}
+	}
+	return pmts
+}
+
+func (c *cli) write(pmts []*data.Payment, one bool) error {
+	return formats[c.output](c.stdout, pmts, one)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// writeTable writes a line of the main attributes of each payment
+func writeTable(w io.Writer, pmts []*data.Payment, one bool) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tVERSION\tSTATUS\tAMOUNT\tCURRENCY\tBENEFICIARY\tREFERENCE")
+	for _, pmt := range pmts {
+		attrs := pmt.Attributes
+		if attrs == nil {
+			attrs = &data.PaymentAttributes{}
+		}
+		beneficiary := ""
+		if attrs.BeneficiaryParty != nil {
+			beneficiary = attrs.BeneficiaryParty.Name
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", pmt.ID, pmt.Version, attrs.Status, attrs.Amount,
+			attrs.Currency, beneficiary, attrs.Reference)
+	}
+	return tw.Flush()
+}
+
+// writeYAML writes the JSON encoding of v as YAML, with the members of
+// objects in order of their names
+func writeYAML(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	if b, err = yaml.Marshal(yamlNumbers(doc)); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// yamlNumbers replaces the integers in a decoded JSON value with ints, which
+// yaml writes as numbers. Decimals are written as strings, as a float would
+// not keep every digit of an amount such as 5.00.
+func yamlNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = yamlNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlNumbers(item)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		return v.String()
+	}
+	return v
+}
@@ -0,0 +1,567 @@
+// Package config loads the service configuration from defaults, a JSON or
+// YAML file, environment variables and command line flags, each overriding
+// the one before
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EnvPrefix starts the name of every environment variable read
+const EnvPrefix = "RESTSERVICE_"
+
+// Config is the configuration of the service
+type Config struct {
+	// Listen is the address to serve on
+	Listen string `json:"listen"`
+	// Database is the path of the bolt database
+	Database  string          `json:"database"`
+	Requests  RequestConfig   `json:"requests"`
+	Shutdown  ShutdownConfig  `json:"shutdown"`
+	Log       LogConfig       `json:"log"`
+	Auth      AuthConfig      `json:"auth"`
+	Tracing   TracingConfig   `json:"tracing"`
+	Health    HealthConfig    `json:"health"`
+	Metrics   MetricsConfig   `json:"metrics"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	Features  FeatureConfig   `json:"features"`
+}
+
+// RequestConfig limits what requests may carry
+type RequestConfig struct {
+	// MaxBodyBytes is the largest request body accepted
+	MaxBodyBytes int `json:"max_body_bytes"`
+}
+
+// ShutdownConfig bounds how long shutting down may take
+type ShutdownConfig struct {
+	// DrainTimeout is how long in-flight requests have to finish
+	DrainTimeout Duration `json:"drain_timeout"`
+	// GracePeriod is how long the whole shutdown may take, including
+	// background workers stopping and the database closing
+	GracePeriod Duration `json:"grace_period"`
+}
+
+// LogConfig controls logging
+type LogConfig struct {
+	// Level is a logrus level, such as debug or info
+	Level string `json:"level"`
+	// Format is text or json
+	Format string `json:"format"`
+	// Access writes a JSON access log line for every request to stdout
+	Access bool `json:"access"`
+}
+
+// AuthConfig names the files holding the authentication and authorisation
+// settings. Empty paths disable what they configure.
+type AuthConfig struct {
+	CredentialsFile string `json:"credentials_file"`
+	JWTFile         string `json:"jwt_file"`
+	PolicyFile      string `json:"policy_file"`
+	TLSFile         string `json:"tls_file"`
+}
+
+// Tracing exporters
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+)
+
+// TracingConfig chooses where spans are exported
+type TracingConfig struct {
+	// Exporter is none, stdout, file or otlp
+	Exporter string `json:"exporter"`
+	// Endpoint is the OTLP/HTTP traces URL of a collector
+	Endpoint string `json:"endpoint"`
+	// File is where the file exporter appends spans
+	File        string `json:"file"`
+	ServiceName string `json:"service_name"`
+	// Interval is how often batches of spans are exported
+	Interval Duration `json:"interval"`
+}
+
+// HealthConfig sets the thresholds of the readiness checks
+type HealthConfig struct {
+	// MinFreeMB is the free space, in megabytes, the disk holding the
+	// database must have for the service to be ready
+	MinFreeMB int `json:"min_free_mb"`
+}
+
+// MetricsConfig controls how metrics are served
+type MetricsConfig struct {
+	// Listen is the address metrics are served on, apart from the API, as
+	// they are scraped without credentials
+	Listen string `json:"listen"`
+	// CacheTTL is how long payment counts are reused before the payments
+	// are counted again
+	CacheTTL Duration `json:"cache_ttl"`
+}
+
+// Rate limiting keys
+const (
+	// KeyByOrganisation shares limits between every caller of an organisation
+	KeyByOrganisation = "organisation"
+	// KeyByClient gives each API key, token subject or certificate its own
+	KeyByClient = "client"
+)
+
+// DefaultTier applies to organisations without a tier of their own
+const DefaultTier = "default"
+
+// RateLimitConfig limits how often callers may make requests
+type RateLimitConfig struct {
+	// KeyBy is organisation or client
+	KeyBy string `json:"key_by"`
+	// Tiers are chosen by the tier of the caller's organisation
+	Tiers map[string]*TierConfig `json:"tiers"`
+}
+
+// TierConfig is the rate limit of a tier, which may be overridden for
+// named routes, and its daily quota
+type TierConfig struct {
+	Limit
+	// DailyQuota is the number of requests allowed each UTC day, or
+	// unlimited when zero
+	DailyQuota int64 `json:"daily_quota"`
+	// Routes have their own limits, separate from the tier's
+	Routes map[string]*Limit `json:"routes"`
+}
+
+// Limit is a token bucket, refilled at Rate requests per second and holding
+// up to Burst
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// FeatureConfig switches optional features on and off
+type FeatureConfig struct {
+	// APIKeys accepts API keys issued to organisations
+	APIKeys bool `json:"api_keys"`
+	// ClientCertificates accepts client certificates when serving TLS
+	ClientCertificates bool `json:"client_certificates"`
+	// Metrics serves Prometheus metrics at /metrics on metrics.listen
+	Metrics bool `json:"metrics"`
+	// RateLimit limits requests by rate_limit
+	RateLimit bool `json:"rate_limit"`
+	// LegacyRoutes still updates payments with POST to their URL, which is
+	// deprecated
+	LegacyRoutes bool `json:"legacy_routes"`
+	// OpenAPIValidation checks requests and responses against the OpenAPI
+	// document, for test environments
+	OpenAPIValidation bool `json:"openapi_validation"`
+}
+
+// Default returns the configuration used where nothing else is given
+func Default() *Config {
+	return &Config{
+		Listen:   ":8080",
+		Database: "data.db",
+		Requests: RequestConfig{MaxBodyBytes: 1 << 20},
+		Shutdown: ShutdownConfig{
+			DrainTimeout: Duration{10 * time.Second},
+			GracePeriod:  Duration{15 * time.Second},
+		},
+		Log: LogConfig{Level: "info", Format: "text", Access: true},
+		Auth: AuthConfig{
+			CredentialsFile: "credentials.json",
+			JWTFile:         "jwt.json",
+			PolicyFile:      "policy.json",
+			TLSFile:         "tls.json",
+		},
+		Tracing: TracingConfig{
+			Exporter:    ExporterNone,
+			Endpoint:    "http://localhost:4318/v1/traces",
+			File:        "traces.jsonl",
+			ServiceName: "restservice",
+			Interval:    Duration{5 * time.Second},
+		},
+		Health: HealthConfig{MinFreeMB: 100},
+		Metrics: MetricsConfig{
+			Listen:   "localhost:9090",
+			CacheTTL: Duration{time.Minute},
+		},
+		RateLimit: RateLimitConfig{
+			KeyBy: KeyByOrganisation,
+			Tiers: map[string]*TierConfig{
+				DefaultTier: {
+					Limit: Limit{Rate: 50, Burst: 100},
+					// Listing loads every payment of the organisation
+					Routes: map[string]*Limit{"payments.list": {Rate: 2, Burst: 10}},
+				},
+			},
+		},
+		Features: FeatureConfig{APIKeys: true, ClientCertificates: true, Metrics: true, RateLimit: true,
+			LegacyRoutes: true},
+	}
+}
+
+// Load builds the configuration from, in increasing precedence, the
+// defaults, the file named by the -config flag or RESTSERVICE_CONFIG, the
+// environment and the flags in args. Arguments left after the flags are
+// returned. lookup is usually os.LookupEnv.
+func Load(args []string, lookup func(string) (string, bool)) (*Config, []string, error) {
+	// Flags are parsed first, into a scratch configuration, but applied last
+	fs := flag.NewFlagSet("restservice", flag.ContinueOnError)
+	path := fs.String("config", "", "path of a JSON or YAML configuration file (env "+EnvPrefix+"CONFIG)")
+	for _, s := range Default().settings() {
+		fs.Var(s.value, s.flag(), fmt.Sprintf("%s (env %s)", s.usage, s.env()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if len(*path) == 0 {
+		*path, _ = lookup(EnvPrefix + "CONFIG")
+	}
+
+	cfg := Default()
+	if len(*path) > 0 {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, nil, err
+		}
+	}
+	settings := cfg.settings()
+	for _, s := range settings {
+		if v, ok := lookup(s.env()); ok {
+			if err := s.value.Set(v); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", s.env(), err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if err == nil && s.flag() == f.Name {
+				err = s.value.Set(f.Value.String())
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadFile merges a JSON or YAML file, chosen by its extension, over the
+// configuration
+func (c *Config) loadFile(path string) error {
+	return DecodeFile(path, c)
+}
+
+// DecodeFile decodes a JSON or YAML file, chosen by its extension, into v.
+// Unknown keys are an error so that typos are not ignored.
+func DecodeFile(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		doc, err := parseYAML(b)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if b, err = json.Marshal(doc); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	case ".json":
+	default:
+		return fmt.Errorf("%s: must be .json, .yaml or .yml", path)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// ValidationError lists every problem found with a configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks the configuration, reporting all of its problems at once
+func (c *Config) Validate() error {
+	var problems ValidationError
+	if problem := checkAddress("listen", c.Listen); len(problem) > 0 {
+		problems = append(problems, problem)
+	}
+	if len(c.Database) == 0 {
+		problems = append(problems, "database: a path is required")
+	}
+	if c.Requests.MaxBodyBytes < 1 {
+		problems = append(problems, "requests.max_body_bytes: must be positive")
+	}
+	if c.Shutdown.DrainTimeout.Duration <= 0 {
+		problems = append(problems, "shutdown.drain_timeout: must be positive")
+	}
+	if c.Shutdown.GracePeriod.Duration <= 0 {
+		problems = append(problems, "shutdown.grace_period: must be positive")
+	}
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level: %q is not a log level", c.Log.Level))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problems = append(problems, fmt.Sprintf("log.format: %q must be text or json", c.Log.Format))
+	}
+	switch c.Tracing.Exporter {
+	case ExporterNone, ExporterStdout:
+	case ExporterFile:
+		if len(c.Tracing.File) == 0 {
+			problems = append(problems, "tracing.file: a path is required by the file exporter")
+		}
+	case ExporterOTLP:
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, fmt.Sprintf("tracing.endpoint: %q is not an http(s) URL", c.Tracing.Endpoint))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter: %q must be none, stdout, file or otlp",
+			c.Tracing.Exporter))
+	}
+	if c.Tracing.Interval.Duration <= 0 {
+		problems = append(problems, "tracing.interval: must be positive")
+	}
+	if c.Health.MinFreeMB < 0 {
+		problems = append(problems, "health.min_free_mb: must not be negative")
+	}
+	if c.Features.Metrics {
+		if problem := checkAddress("metrics.listen", c.Metrics.Listen); len(problem) > 0 {
+			problems = append(problems, problem)
+		} else if c.Metrics.Listen == c.Listen {
+			problems = append(problems, "metrics.listen: must not be the address the API is served on")
+		}
+	}
+	if c.Metrics.CacheTTL.Duration <= 0 {
+		problems = append(problems, "metrics.cache_ttl: must be positive")
+	}
+	problems = append(problems, c.RateLimit.validate()...)
+	if c.Shutdown.DrainTimeout.Duration > c.Shutdown.GracePeriod.Duration {
+		problems = append(problems, "shutdown.drain_timeout: must not be longer than shutdown.grace_period")
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// checkAddress describes what is wrong with a host:port address, or returns
+// an empty string when nothing is
+func checkAddress(key, addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Sprintf("%s: %q is not a host:port address", key, addr)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Sprintf("%s: %q is not a valid port", key, port)
+	}
+	return ""
+}
+
+func (r *RateLimitConfig) validate() []string {
+	var problems []string
+	if r.KeyBy != KeyByOrganisation && r.KeyBy != KeyByClient {
+		problems = append(problems, fmt.Sprintf("rate_limit.key_by: %q must be organisation or client", r.KeyBy))
+	}
+	if r.Tiers[DefaultTier] == nil {
+		problems = append(problems, "rate_limit.tiers: a default tier is required")
+	}
+	names := make([]string, 0, len(r.Tiers))
+	for name := range r.Tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tier := r.Tiers[name]
+		key := "rate_limit.tiers." + name
+		if tier == nil {
+			problems = append(problems, key+": limits are required")
+			continue
+		}
+		problems = append(problems, tier.Limit.validate(key)...)
+		if tier.DailyQuota < 0 {
+			problems = append(problems, key+".daily_quota: must not be negative")
+		}
+		routes := make([]string, 0, len(tier.Routes))
+		for route := range tier.Routes {
+			routes = append(routes, route)
+		}
+		sort.Strings(routes)
+		for _, route := range routes {
+			if tier.Routes[route] == nil {
+				problems = append(problems, key+".routes."+route+": limits are required")
+				continue
+			}
+			problems = append(problems, tier.Routes[route].validate(key+".routes."+route)...)
+		}
+	}
+	return problems
+}
+
+func (l *Limit) validate(key string) []string {
+	var problems []string
+	if l.Rate <= 0 {
+		problems = append(problems, key+".rate: must be positive")
+	}
+	if l.Burst < 1 {
+		problems = append(problems, key+".burst: must be at least 1")
+	}
+	return problems
+}
+
+// ConfigureLogging applies the log settings to the standard logrus logger
+func (c *Config) ConfigureLogging() {
+	level, err := log.ParseLevel(c.Log.Level)
+	if err == nil {
+		log.SetLevel(level)
+	}
+	if c.Log.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+}
+
+// setting is a configuration value which may be set by a flag or environment
+// variable named after its key
+type setting struct {
+	key   string
+	usage string
+	value flag.Value
+}
+
+func (s setting) flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(s.key, ".", "_", -1))
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen", "address to serve on", (*stringValue)(&c.Listen)},
+		{"database", "path of the database", (*stringValue)(&c.Database)},
+		{"requests.max_body_bytes", "largest request body accepted", (*intValue)(&c.Requests.MaxBodyBytes)},
+		{"shutdown.drain_timeout", "time in-flight requests have to finish on shutdown", &c.Shutdown.DrainTimeout},
+		{"shutdown.grace_period", "time the whole shutdown may take", &c.Shutdown.GracePeriod},
+		{"log.level", "log level", (*stringValue)(&c.Log.Level)},
+		{"log.format", "log format, text or json", (*stringValue)(&c.Log.Format)},
+		{"log.access", "write a JSON access log line per request", (*boolValue)(&c.Log.Access)},
+		{"auth.credentials_file", "static credentials file", (*stringValue)(&c.Auth.CredentialsFile)},
+		{"auth.jwt_file", "JWT configuration file", (*stringValue)(&c.Auth.JWTFile)},
+		{"auth.policy_file", "authorisation policy file", (*stringValue)(&c.Auth.PolicyFile)},
+		{"auth.tls_file", "TLS configuration file", (*stringValue)(&c.Auth.TLSFile)},
+		{"tracing.exporter", "where to export spans: none, stdout, file or otlp", (*stringValue)(&c.Tracing.Exporter)},
+		{"tracing.endpoint", "OTLP/HTTP traces URL", (*stringValue)(&c.Tracing.Endpoint)},
+		{"tracing.file", "file the file exporter appends spans to", (*stringValue)(&c.Tracing.File)},
+		{"tracing.service_name", "service name reported with spans", (*stringValue)(&c.Tracing.ServiceName)},
+		{"tracing.interval", "how often spans are exported", &c.Tracing.Interval},
+		{"health.min_free_mb", "free disk space in MB needed to be ready", (*intValue)(&c.Health.MinFreeMB)},
+		{"metrics.listen", "address to serve metrics on, apart from the API", (*stringValue)(&c.Metrics.Listen)},
+		{"metrics.cache_ttl", "how long payment counts are reused by metrics", &c.Metrics.CacheTTL},
+		{"features.api_keys", "accept API keys", (*boolValue)(&c.Features.APIKeys)},
+		{"features.client_certificates", "accept client certificates", (*boolValue)(&c.Features.ClientCertificates)},
+		{"features.metrics", "serve Prometheus metrics at /metrics on metrics.listen",
+			(*boolValue)(&c.Features.Metrics)},
+		{"features.rate_limit", "limit request rates and daily quotas", (*boolValue)(&c.Features.RateLimit)},
+		{"features.legacy_routes", "update payments with the deprecated POST /payments/{id}",
+			(*boolValue)(&c.Features.LegacyRoutes)},
+		{"features.openapi_validation", "check requests and responses against the OpenAPI document",
+			(*boolValue)(&c.Features.OpenAPIValidation)},
+		{"rate_limit.key_by", "share limits by organisation or give each client its own",
+			(*stringValue)(&c.RateLimit.KeyBy)},
+	}
+}
+
+// Duration is a time.Duration written as a string such as "500ms"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"500ms\"")
+	}
+	return d.Set(s)
+}
+
+// Set parses a duration string, as a flag.Value
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+type stringValue string
+
+func (s *stringValue) Set(v string) error {
+	*s = stringValue(v)
+	return nil
+}
+
+func (s *stringValue) String() string {
+	return string(*s)
+}
+
+type intValue int
+
+func (i *intValue) Set(v string) error {
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%q is not a whole number", v)
+	}
+	*i = intValue(parsed)
+	return nil
+}
+
+func (i *intValue) String() string {
+	return strconv.Itoa(int(*i))
+}
+
+type boolValue bool
+
+func (b *boolValue) Set(v string) error {
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%q is not true or false", v)
+	}
+	*b = boolValue(parsed)
+	return nil
+}
+
+func (b *boolValue) String() string {
+	return strconv.FormatBool(bool(*b))
+}
+
+func (b *boolValue) IsBoolFlag() bool {
+	return true
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := vars[k]
+		return v, ok
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, args, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":8080" || cfg.Database != "data.db" || cfg.Shutdown.DrainTimeout.Duration != 10*time.Second {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+	if len(args) != 0 {
+		t.Errorf("unexpected arguments: %v", args)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+# Settings for the test
+listen: ":9000"
+database: /var/lib/payments.db   # overridden by env
+shutdown:
+  drain_timeout: 2s
+  grace_period: "5s"
+log:
+  level: debug
+  format: json
+features:
+  api_keys: false
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, args, err := Load(
+		[]string{"-config", path, "-log-level", "warn", "-features-api-keys", "config", "show"},
+		env(map[string]string{
+			"RESTSERVICE_DATABASE":  "/tmp/env.db",
+			"RESTSERVICE_LOG_LEVEL": "error",
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file overrides the defaults
+	if cfg.Listen != ":9000" || cfg.Shutdown.DrainTimeout.Duration != 2*time.Second || cfg.Log.Format != "json" {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	// The environment overrides the file
+	if cfg.Database != "/tmp/env.db" {
+		t.Errorf("database is '%s', we expected '/tmp/env.db'", cfg.Database)
+	}
+	// And flags override everything
+	if cfg.Log.Level != "warn" || !cfg.Features.APIKeys {
+		t.Errorf("flag settings not applied: %+v", cfg)
+	}
+	if strings.Join(args, " ") != "config show" {
+		t.Errorf("unexpected arguments: %v", args)
+	}
+}
+
+func TestLoadJSONFromEnv(t *testing.T) {
+	path := writeConfig(t, "config.json", `{"listen": "127.0.0.1:8443", "auth": {"tls_file": "/etc/restservice/tls.json"}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, _, err := Load(nil, env(map[string]string{"RESTSERVICE_CONFIG": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "127.0.0.1:8443" || cfg.Auth.TLSFile != "/etc/restservice/tls.json" {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	// Settings missing from the file keep their defaults
+	if cfg.Auth.PolicyFile != "policy.json" {
+		t.Errorf("policy file is '%s', we expected the default", cfg.Auth.PolicyFile)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		file    string
+		content string
+		errors  []string
+	}{
+		{
+			name: "every problem is reported",
+			args: []string{"-listen", "localhost", "-log-format", "xml", "-shutdown-drain-timeout", "20s"},
+			env:  map[string]string{"RESTSERVICE_LOG_LEVEL": "loud"},
+			errors: []string{
+				`listen: "localhost" is not a host:port address`,
+				`log.level: "loud" is not a log level`,
+				`log.format: "xml" must be text or json`,
+				"shutdown.drain_timeout: must not be longer than shutdown.grace_period",
+			},
+		},
+		{
+			name: "metrics on the API address",
+			args: []string{"-listen", ":8080", "-metrics-listen", ":8080", "-metrics-cache-ttl", "0s"},
+			errors: []string{
+				"metrics.listen: must not be the address the API is served on",
+				"metrics.cache_ttl: must be positive",
+			},
+		},
+		{
+			name:   "bad environment value",
+			env:    map[string]string{"RESTSERVICE_FEATURES_API_KEYS": "maybe"},
+			errors: []string{`RESTSERVICE_FEATURES_API_KEYS: "maybe" is not true or false`},
+		},
+		{
+			name:    "unknown key",
+			file:    "config.json",
+			content: `{"listen_address": ":80"}`,
+			errors:  []string{`unknown field "listen_address"`},
+		},
+		{
+			name:    "bad YAML",
+			file:    "config.yml",
+			content: "log:\n  level: debug\n format: json\n",
+			errors:  []string{"line 2: did not find expected key"},
+		},
+		{
+			name:    "duplicate YAML key",
+			file:    "config.yml",
+			content: "log:\n  level: debug\n  level: info\n",
+			errors:  []string{`line 3: key "level" already set in map`},
+		},
+	} {
+		vars := test.env
+		if len(test.file) > 0 {
+			path := writeConfig(t, test.file, test.content)
+			defer os.RemoveAll(filepath.Dir(path))
+			vars = map[string]string{"RESTSERVICE_CONFIG": path}
+		}
+		_, _, err := Load(test.args, env(vars))
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		for _, msg := range test.errors {
+			if !strings.Contains(err.Error(), msg) {
+				t.Errorf("%s: error %q does not mention %q", test.name, err, msg)
+			}
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	doc, err := parseYAML([]byte(`
+name: 'it''s'
+quoted: "a # not a comment"
+list:
+  - one
+  - 2
+inline: [a, "b, c"]
+nested:
+  deeper:
+    value: true
+empty:
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["name"] != "it's" || doc["quoted"] != "a # not a comment" || doc["empty"] != nil {
+		t.Errorf("unexpected scalars: %v", doc)
+	}
+	if l := doc["list"].([]interface{}); len(l) != 2 || l[0] != "one" || l[1] != 2 {
+		t.Errorf("unexpected list: %v", doc["list"])
+	}
+	if l := doc["inline"].([]interface{}); len(l) != 2 || l[1] != "b, c" {
+		t.Errorf("unexpected inline list: %v", doc["inline"])
+	}
+	deeper := doc["nested"].(map[string]interface{})["deeper"].(map[string]interface{})
+	if deeper["value"] != true {
+		t.Errorf("unexpected nested mapping: %v", doc["nested"])
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// parseYAML reads a YAML document which must be a mapping, converting its
+// nested mappings so that they can be written out again as JSON. A key given
+// twice is an error, as an unknown one is.
+func parseYAML(b []byte) (map[string]interface{}, error) {
+	var doc interface{}
+	if err := yaml.UnmarshalStrict(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return map[string]interface{}{}, nil
+	}
+	m, ok := jsonValue(doc).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the document must be a mapping of keys to values")
+	}
+	return m, nil
+}
+
+// jsonValue converts the map[interface{}]interface{} mappings which yaml
+// decodes into map[string]interface{}, which encoding/json can marshal
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = jsonValue(item)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			l[i] = jsonValue(item)
+		}
+		return l
+	}
+	return v
+}
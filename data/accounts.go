@@ -0,0 +1,134 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrAccountInUse is returned when deleting an account which has ledger entries
+var ErrAccountInUse = errors.New("account has ledger entries")
+
+// FetchAccount gets a single Account by ID
+func (c *Client) FetchAccount(id string) (*Account, error) {
+	defer c.trace("data.FetchAccount")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	var acc Account
+	if err := n.One("ID", id, &acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+// FetchAllAccounts gets all the accounts for the organisation
+func (c *Client) FetchAllAccounts() ([]*Account, error) {
+	defer c.trace("data.FetchAllAccounts")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	accs := []*Account{}
+	if err := n.All(&accs); err != nil {
+		return nil, err
+	}
+	return accs, nil
+}
+
+// CreateAccount saves a new Account in the database
+func (c *Client) CreateAccount(acc *Account) error {
+	defer c.trace("data.CreateAccount")()
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	if err := c.claim(&acc.Resource); err != nil {
+		return err
+	}
+	_, err = c.FetchAccount(acc.ID)
+	if err == nil || err.Error() != "not found" {
+		return fmt.Errorf("resource exists")
+	}
+	if acc.Attributes != nil && len(acc.Attributes.AccountType) == 0 {
+		acc.Attributes.AccountType = AccountCustomer
+	}
+	return n.Save(acc)
+}
+
+// UpdateAccount updates an existing Account in the database. Once something
+// has been posted to it, only its name may change, so that the entries stay
+// with the account they were posted to.
+func (c *Client) UpdateAccount(acc *Account) error {
+	defer c.trace("data.UpdateAccount")()
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	if err := c.claim(&acc.Resource); err != nil {
+		return err
+	}
+	if acc.Attributes != nil && len(acc.Attributes.AccountType) == 0 {
+		acc.Attributes.AccountType = AccountCustomer
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var existing Account
+	if err := tx.One("ID", acc.ID, &existing); err != nil {
+		return err
+	}
+	var entries []*LedgerEntry
+	if err := tx.Find("AccountID", acc.ID, &entries); err == nil {
+		if !sameAccount(acc.Attributes, existing.Attributes) {
+			return ErrAccountInUse
+		}
+	} else if err.Error() != "not found" {
+		return err
+	}
+	if err := tx.Update(acc); err != nil {
+		return err
+	}
+	return c.commit(tx)
+}
+
+// sameAccount reports whether two versions of an account identify the same
+// account, whatever they are named
+func sameAccount(a, b *AccountAttributes) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.AccountType == b.AccountType && a.AccountNumber == b.AccountNumber &&
+		a.BankID == b.BankID && a.Currency == b.Currency
+}
+
+// DeleteAccount deletes an existing Account from the database, as long as
+// nothing has been posted to it
+func (c *Client) DeleteAccount(id string) error {
+	defer c.trace("data.DeleteAccount")()
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var acc Account
+	if err := tx.One("ID", id, &acc); err != nil {
+		return err
+	}
+	var entries []*LedgerEntry
+	if err := tx.Find("AccountID", id, &entries); err == nil {
+		return ErrAccountInUse
+	} else if err.Error() != "not found" {
+		return err
+	}
+	if err := tx.DeleteStruct(&acc); err != nil {
+		return err
+	}
+	return c.commit(tx)
+}
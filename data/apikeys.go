@@ -0,0 +1,117 @@
+package data
+
+import (
+	"errors"
+	"time"
+)
+
+// MaxActiveAPIKeys allows a new key to be issued before the old one is revoked
+const MaxActiveAPIKeys = 2
+
+var (
+	// ErrTooManyAPIKeys is returned when issuing a key to an organisation which
+	// already has the maximum number of active keys
+	ErrTooManyAPIKeys = errors.New("organisation already has two active keys")
+	// ErrAPIKeyRevoked is returned when revoking a key twice
+	ErrAPIKeyRevoked = errors.New("key already revoked")
+)
+
+// API keys are looked up before the caller's organisation is known so they
+// are stored at the root of the database, indexed by organisation.
+
+// FetchAPIKey gets a single APIKey by ID
+func (c *Client) FetchAPIKey(id string) (*APIKey, error) {
+	defer c.trace("data.FetchAPIKey")()
+	var key APIKey
+	if err := c.db.One("ID", id, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// FetchAPIKeys gets all the keys, active or revoked, issued to an organisation
+func (c *Client) FetchAPIKeys(organisationID string) ([]*APIKey, error) {
+	defer c.trace("data.FetchAPIKeys")()
+	keys := []*APIKey{}
+	if err := c.db.Find("OrganisationID", organisationID, &keys); err != nil && err.Error() != "not found" {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// CreateAPIKey saves a newly issued key, as long as the organisation exists
+// and does not already have the maximum number of active keys
+func (c *Client) CreateAPIKey(key *APIKey) error {
+	defer c.trace("data.CreateAPIKey")()
+	tx, err := c.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var org Organisation
+	if err := tx.One("ID", key.OrganisationID, &org); err != nil {
+		return err
+	}
+	var keys []*APIKey
+	if err := tx.Find("OrganisationID", key.OrganisationID, &keys); err != nil && err.Error() != "not found" {
+		return err
+	}
+	active := 0
+	for _, k := range keys {
+		if k.Active() {
+			active++
+		}
+	}
+	if active >= MaxActiveAPIKeys {
+		return ErrTooManyAPIKeys
+	}
+	if err := tx.Save(key); err != nil {
+		return err
+	}
+	return c.commit(tx)
+}
+
+// RevokeAPIKey revokes one of an organisation's keys
+func (c *Client) RevokeAPIKey(organisationID, id string) error {
+	defer c.trace("data.RevokeAPIKey")()
+	tx, err := c.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var key APIKey
+	if err := tx.One("ID", id, &key); err != nil {
+		return err
+	}
+	if key.OrganisationID != organisationID {
+		return ErrWrongOrganisation
+	}
+	if !key.Active() {
+		return ErrAPIKeyRevoked
+	}
+	now := time.Now().UTC()
+	key.RevokedAt = &now
+	if err := tx.Save(&key); err != nil {
+		return err
+	}
+	return c.commit(tx)
+}
+
+// TouchAPIKey records when a key was last used
+func (c *Client) TouchAPIKey(id string, at time.Time) error {
+	defer c.trace("data.TouchAPIKey")()
+	tx, err := c.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var key APIKey
+	if err := tx.One("ID", id, &key); err != nil {
+		return err
+	}
+	key.LastUsedAt = &at
+	if err := tx.Save(&key); err != nil {
+		return err
+	}
+	return c.commit(tx)
+}
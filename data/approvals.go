@@ -0,0 +1,206 @@
+package data
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+var (
+	// ErrNotAwaitingApproval is returned when deciding on a payment which is not pending approval
+	ErrNotAwaitingApproval = errors.New("payment is not awaiting approval")
+	// ErrNotApproved is returned when returning or reversing a payment which was never approved
+	ErrNotApproved = errors.New("payment has not been approved")
+	// ErrNoActor is returned when deciding on a payment without saying who is deciding
+	ErrNoActor = errors.New("approver not identified")
+	// ErrSelfApproval is returned when the user who made a payment tries to approve it
+	ErrSelfApproval = errors.New("payment cannot be approved by the user who made it")
+	// ErrAlreadyApproved is returned when a user approves the same payment twice
+	ErrAlreadyApproved = errors.New("payment already approved by this user")
+)
+
+// FetchPaymentHistory gets every event recorded against a payment, oldest first
+func (c *Client) FetchPaymentHistory(paymentID string) ([]*PaymentEvent, error) {
+	defer c.trace("data.FetchPaymentHistory")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.FetchPayment(paymentID); err != nil {
+		return nil, err
+	}
+	return paymentEvents(n, paymentID)
+}
+
+// FetchPaymentApprovals gets the approvals and rejections of a payment, oldest first
+func (c *Client) FetchPaymentApprovals(paymentID string) ([]*PaymentEvent, error) {
+	defer c.trace("data.FetchPaymentApprovals")()
+	events, err := c.FetchPaymentHistory(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	approvals := []*PaymentEvent{}
+	for _, e := range events {
+		if e.Kind == EventApproved || e.Kind == EventRejected {
+			approvals = append(approvals, e)
+		}
+	}
+	return approvals, nil
+}
+
+// ApprovePayment records the client's actor approving a payment. Once it has
+// the number of approvals the organisation requires the payment is pending
+// and may be settled.
+func (c *Client) ApprovePayment(id, comment string) (*PaymentEvent, error) {
+	defer c.trace("data.ApprovePayment")()
+	return c.decide(id, EventApproved, comment)
+}
+
+// RejectPayment records the client's actor rejecting a payment, which then
+// can no longer be settled
+func (c *Client) RejectPayment(id, comment string) (*PaymentEvent, error) {
+	defer c.trace("data.RejectPayment")()
+	return c.decide(id, EventRejected, comment)
+}
+
+// decide applies an approval or rejection to a payment. The maker of a
+// payment is whoever created or last changed it, and only approvals since
+// then count.
+func (c *Client) decide(id, kind, comment string) (*PaymentEvent, error) {
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.actor) == 0 {
+		return nil, ErrNoActor
+	}
+	settings, err := c.settings()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var pmt Payment
+	if err := tx.One("ID", id, &pmt); err != nil {
+		return nil, err
+	}
+	if pmt.Attributes == nil || pmt.Attributes.Status != StatusPendingApproval {
+		return nil, ErrNotAwaitingApproval
+	}
+	events, err := paymentEvents(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	var maker string
+	approvers := map[string]bool{}
+	for _, e := range events {
+		switch e.Kind {
+		case EventCreated, EventUpdated:
+			maker = e.Actor
+			approvers = map[string]bool{}
+		case EventApproved:
+			approvers[e.Actor] = true
+		}
+	}
+	if c.actor == maker {
+		return nil, ErrSelfApproval
+	}
+	if approvers[c.actor] {
+		return nil, ErrAlreadyApproved
+	}
+
+	if kind == EventRejected {
+		pmt.Attributes.Status = StatusRejected
+	} else {
+		required, err := approvalsFor(settings, &pmt)
+		if err != nil {
+			return nil, err
+		}
+		if len(approvers)+1 >= required {
+			pmt.Attributes.Status = StatusPending
+		}
+	}
+	pmt.Version++
+	if err := tx.Update(&pmt); err != nil {
+		return nil, err
+	}
+	e, err := c.record(tx, &pmt, kind, comment)
+	if err != nil {
+		return nil, err
+	}
+	return e, c.commit(tx)
+}
+
+// requiredApprovals returns how many approvals the client's organisation
+// requires before the payment may settle
+func (c *Client) requiredApprovals(pmt *Payment) (int, error) {
+	settings, err := c.settings()
+	if err != nil {
+		return 0, err
+	}
+	return approvalsFor(settings, pmt)
+}
+
+// approvalsFor returns how many approvals a payment needs under settings,
+// none unless it is above the threshold for its currency
+func approvalsFor(settings *OrganisationAttributes, pmt *Payment) (int, error) {
+	if pmt.Attributes == nil {
+		return 0, nil
+	}
+	threshold, ok := settings.ApprovalThresholds[pmt.Attributes.Currency]
+	if !ok {
+		return 0, nil
+	}
+	max, err := ParseAmount(threshold)
+	if err != nil {
+		return 0, err
+	}
+	amt, err := ParseAmount(pmt.Attributes.Amount)
+	if err != nil {
+		return 0, err
+	}
+	if amt.Cmp(max) <= 0 {
+		return 0, nil
+	}
+	if settings.RequiredApprovals < 1 {
+		return 1, nil
+	}
+	return settings.RequiredApprovals, nil
+}
+
+// record appends an event to the history of a payment
+func (c *Client) record(tx storm.Node, pmt *Payment, kind, comment string) (*PaymentEvent, error) {
+	e := &PaymentEvent{
+		PaymentID: pmt.ID,
+		Kind:      kind,
+		Actor:     c.actor,
+		Comment:   comment,
+		At:        time.Now().UTC(),
+	}
+	if pmt.Attributes != nil {
+		e.Status = pmt.Attributes.Status
+	}
+	return e, tx.Save(e)
+}
+
+// paymentEvents gets the history of a payment in the order it was recorded,
+// leaving out that of any payment deleted before it with the same ID
+func paymentEvents(n storm.Node, paymentID string) ([]*PaymentEvent, error) {
+	events := []*PaymentEvent{}
+	if err := n.Find("PaymentID", paymentID, &events); err != nil && err.Error() != "not found" {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Kind == EventDeleted {
+			return events[i+1:], nil
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,40 @@
+package data
+
+import "github.com/asdine/storm"
+
+// IdempotentRequest records which request created a payment with an
+// Idempotency-Key, so that a retry can be told apart from a different request
+// sent with the same key
+type IdempotentRequest struct {
+	// ID is that of the payment created, which is derived from the key
+	ID string `json:"id" storm:"id"`
+	// Hash identifies the payment the request asked for
+	Hash string `json:"hash"`
+}
+
+// CreatePaymentWithKey saves a new Payment, as CreatePayment does, along with
+// the hash of the request which created it
+func (c *Client) CreatePaymentWithKey(pmt *Payment, hash string) error {
+	defer c.trace("data.CreatePaymentWithKey")()
+	return c.createPayment(pmt, func(tx storm.Node) error {
+		return tx.Save(&IdempotentRequest{ID: pmt.ID, Hash: hash})
+	})
+}
+
+// FetchRequestHash gets the hash of the request which created a payment with
+// an Idempotency-Key, which is empty when none was recorded
+func (c *Client) FetchRequestHash(paymentID string) (string, error) {
+	defer c.trace("data.FetchRequestHash")()
+	n, err := c.scope()
+	if err != nil {
+		return "", err
+	}
+	var req IdempotentRequest
+	if err := n.One("ID", paymentID, &req); err != nil {
+		if err.Error() == "not found" {
+			return "", nil
+		}
+		return "", err
+	}
+	return req.Hash, nil
+}
@@ -0,0 +1,334 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+var (
+	// ErrNotPending is returned when settling a payment which is not pending
+	ErrNotPending = errors.New("payment is not pending")
+	// ErrDebtorAccountNotFound is returned when the debtor party has no account
+	ErrDebtorAccountNotFound = errors.New("no account for debtor party")
+	// ErrPaymentSettled is returned when changing the money a payment moves
+	// after it has been settled, returned or reversed
+	ErrPaymentSettled = errors.New("the amount, currency, parties and charges of a settled payment cannot change")
+)
+
+// SettlePayment marks a pending payment as settled and posts it to the
+// ledger. The debtor account is debited with the amount and any sender
+// charges, which are credited to the beneficiary account (or the clearing
+// account when the beneficiary is external) and to the fees account.
+func (c *Client) SettlePayment(id string) (*Payment, error) {
+	defer c.trace("data.SettlePayment")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var pmt Payment
+	if err := tx.One("ID", id, &pmt); err != nil {
+		return nil, err
+	}
+	if pmt.Attributes == nil || pmt.Attributes.Status != StatusPending {
+		return nil, ErrNotPending
+	}
+	// Payments saved before every write was checked may lack an amount
+	if err := checkPayment(&pmt); err != nil {
+		return nil, err
+	}
+	attrs := pmt.Attributes
+	debtor, err := findAccount(tx, attrs.DebtorParty)
+	if err != nil {
+		return nil, err
+	}
+	if debtor == nil {
+		return nil, ErrDebtorAccountNotFound
+	}
+	beneficiary, err := findAccount(tx, attrs.BeneficiaryParty)
+	if err != nil {
+		return nil, err
+	}
+	if beneficiary == nil {
+		if beneficiary, err = systemAccount(tx, pmt.OrganisationID, AccountClearing, attrs.Currency); err != nil {
+			return nil, err
+		}
+	}
+
+	journalID, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if err := post(tx, journalID, pmt.ID, EntryPrincipal, debtor.ID, beneficiary.ID,
+		attrs.Amount, attrs.Currency, now); err != nil {
+		return nil, err
+	}
+	if attrs.ChargesInformation != nil {
+		for _, charge := range attrs.ChargesInformation.SenderCharges {
+			amt, err := ParseAmount(charge.Amount)
+			if err != nil {
+				return nil, err
+			}
+			if amt.Sign() == 0 {
+				continue
+			}
+			fees, err := systemAccount(tx, pmt.OrganisationID, AccountFees, charge.Currency)
+			if err != nil {
+				return nil, err
+			}
+			if err := post(tx, journalID, pmt.ID, EntryCharge, debtor.ID, fees.ID,
+				charge.Amount, charge.Currency, now); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	attrs.Status = StatusSettled
+	pmt.Version++
+	if err := tx.Update(&pmt); err != nil {
+		return nil, err
+	}
+	if _, err := c.record(tx, &pmt, EventSettled, ""); err != nil {
+		return nil, err
+	}
+	return &pmt, c.commit(tx)
+}
+
+// moved reports whether money has moved for a payment, which is then fixed as
+// it was posted to the ledger and as returns are checked against it
+func moved(pmt *Payment) bool {
+	if pmt.Attributes == nil {
+		return false
+	}
+	switch pmt.Attributes.Status {
+	case StatusSettled, StatusPartiallyReturned, StatusReturned, StatusReversed:
+		return true
+	}
+	return false
+}
+
+// movesOtherMoney reports whether a change to a payment changes the money it
+// moves: its amount, currency, parties, charges or exchange
+func movesOtherMoney(pmt, stored *Payment) bool {
+	if pmt.Attributes == nil || stored.Attributes == nil {
+		return pmt.Attributes != stored.Attributes
+	}
+	a, b := pmt.Attributes, stored.Attributes
+	amt, err := ParseAmount(a.Amount)
+	if err != nil {
+		return true
+	}
+	was, err := ParseAmount(b.Amount)
+	if err != nil || amt.Cmp(was) != 0 {
+		return true
+	}
+	return a.Currency != b.Currency ||
+		!reflect.DeepEqual(a.BeneficiaryParty, b.BeneficiaryParty) ||
+		!reflect.DeepEqual(a.DebtorParty, b.DebtorParty) ||
+		!reflect.DeepEqual(a.SponsorParty, b.SponsorParty) ||
+		!reflect.DeepEqual(a.ChargesInformation, b.ChargesInformation) ||
+		!reflect.DeepEqual(a.FX, b.FX)
+}
+
+// FetchAccountBalance derives the balance of an account from its ledger
+// entries within a single read transaction
+func (c *Client) FetchAccountBalance(id string) (*AccountBalance, error) {
+	defer c.trace("data.FetchAccountBalance")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := n.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	entries, err := accountEntries(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]*big.Rat)
+	places := make(map[string]int)
+	for _, e := range entries {
+		amt, err := ParseAmount(e.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := sums[e.Currency]; !ok {
+			sums[e.Currency] = new(big.Rat)
+		}
+		if e.Direction == Debit {
+			sums[e.Currency].Sub(sums[e.Currency], amt)
+		} else {
+			sums[e.Currency].Add(sums[e.Currency], amt)
+		}
+		if p := decimalPlaces(e.Amount); p > places[e.Currency] {
+			places[e.Currency] = p
+		}
+	}
+	bal := &AccountBalance{
+		AccountID: id,
+		Balances:  make(map[string]json.Number),
+		Entries:   len(entries),
+	}
+	for cur, sum := range sums {
+		bal.Balances[cur] = json.Number(sum.FloatString(places[cur]))
+	}
+	return bal, nil
+}
+
+// FetchLedgerEntries gets all ledger entries for an account in posting order
+func (c *Client) FetchLedgerEntries(id string) ([]*LedgerEntry, error) {
+	defer c.trace("data.FetchLedgerEntries")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := n.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return accountEntries(tx, id)
+}
+
+func accountEntries(tx storm.Node, id string) ([]*LedgerEntry, error) {
+	var acc Account
+	if err := tx.One("ID", id, &acc); err != nil {
+		return nil, err
+	}
+	entries := []*LedgerEntry{}
+	if err := tx.Find("AccountID", id, &entries); err != nil && err.Error() != "not found" {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+// postReturn reverses the returned amount of a settled payment in the ledger.
+// Payments which were never settled have nothing to reverse.
+func postReturn(tx storm.Node, pmt *Payment, txn *LinkedTransaction) error {
+	var entries []*LedgerEntry
+	if err := tx.Find("PaymentID", pmt.ID, &entries); err != nil {
+		if err.Error() == "not found" {
+			return nil
+		}
+		return err
+	}
+	var debited, credited string
+	for _, e := range entries {
+		if e.Kind != EntryPrincipal {
+			continue
+		}
+		if e.Direction == Debit {
+			debited = e.AccountID
+		} else {
+			credited = e.AccountID
+		}
+	}
+	if len(debited) == 0 || len(credited) == 0 {
+		return nil
+	}
+	return post(tx, txn.ID, pmt.ID, EntryReturn, credited, debited,
+		txn.Attributes.Amount, txn.Attributes.Currency, time.Now().UTC())
+}
+
+// post appends a balanced pair of entries moving amount from one account to another
+func post(tx storm.Node, journalID, paymentID, kind, from, to string, amount json.Number,
+	currency string, at time.Time) error {
+	amt, err := ParseAmount(amount)
+	if err != nil || amt.Sign() <= 0 {
+		return ErrInvalidAmount
+	}
+	for _, e := range []*LedgerEntry{
+		{AccountID: from, Direction: Debit},
+		{AccountID: to, Direction: Credit},
+	} {
+		e.JournalID = journalID
+		e.PaymentID = paymentID
+		e.Kind = kind
+		e.Amount = amount
+		e.Currency = currency
+		e.PostedAt = at
+		if err := tx.Save(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findAccount finds the organisation's customer account for a payment party
+func findAccount(tx storm.Node, party *PaymentParty) (*Account, error) {
+	if party == nil {
+		return nil, nil
+	}
+	accs, err := organisationAccounts(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range accs {
+		if acc.Attributes.AccountType == AccountCustomer &&
+			acc.Attributes.AccountNumber == party.AccountNumber &&
+			acc.Attributes.BankID == party.BankID {
+			return acc, nil
+		}
+	}
+	return nil, nil
+}
+
+// systemAccount finds, or creates, the organisation's fees or clearing account for a currency
+func systemAccount(tx storm.Node, organisationID, accountType, currency string) (*Account, error) {
+	accs, err := organisationAccounts(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range accs {
+		if acc.Attributes.AccountType == accountType && acc.Attributes.Currency == currency {
+			return acc, nil
+		}
+	}
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	acc := &Account{
+		Resource: Resource{
+			Type:           "Account",
+			ID:             id,
+			OrganisationID: organisationID,
+		},
+		Attributes: &AccountAttributes{
+			AccountName: accountType + " " + currency,
+			AccountType: accountType,
+			Currency:    currency,
+		},
+	}
+	return acc, tx.Save(acc)
+}
+
+func organisationAccounts(tx storm.Node) ([]*Account, error) {
+	var accs []*Account
+	if err := tx.All(&accs); err != nil {
+		return nil, err
+	}
+	valid := accs[:0]
+	for _, acc := range accs {
+		if acc.Attributes != nil {
+			valid = append(valid, acc)
+		}
+	}
+	return valid, nil
+}
@@ -1,15 +1,44 @@
 package data
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
+	"github.com/adampointer/restservice/tracing"
 	"github.com/asdine/storm"
 )
 
+// organisationsBucket holds a bucket of resources for each organisation
+const organisationsBucket = "organisations"
+
+var (
+	// ErrNoOrganisation is returned when using a client which has not been
+	// scoped to an organisation with ForOrganisation
+	ErrNoOrganisation = errors.New("client not scoped to an organisation")
+	// ErrWrongOrganisation is returned when a resource names an organisation
+	// other than the one the client is scoped to
+	ErrWrongOrganisation = errors.New("resource belongs to another organisation")
+	// ErrVersionMismatch is returned when a change is based on a version of a
+	// resource other than the stored one
+	ErrVersionMismatch = errors.New("resource has been changed since it was read")
+	// ErrPaymentInUse is returned when deleting a payment which has returns,
+	// reversals or ledger entries
+	ErrPaymentInUse = errors.New("payment has been settled, returned or reversed")
+	// ErrNoAttributes is returned when writing a payment without attributes
+	ErrNoAttributes = errors.New("attributes are required")
+	// ErrNoCurrency is returned when writing a payment without a currency
+	ErrNoCurrency = errors.New("currency is required")
+)
+
 // Client abstracts our database
 type Client struct {
-	dbPath string
-	db     *storm.DB
+	dbPath         string
+	db             *storm.DB
+	node           storm.Node
+	organisationID string
+	actor          string
+	ctx            context.Context
 }
 
 // NewClient returns a new client with database at path
@@ -22,6 +51,10 @@ func NewClient(path string) (*Client, error) {
 		dbPath: path,
 		db:     db,
 	}
+	if err := c.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return c, nil
 }
 
@@ -35,43 +68,425 @@ func (c *Client) Path() string {
 	return c.dbPath
 }
 
+// ForOrganisation returns a client which reads and writes only the resources
+// belonging to an organisation, each of which has its own bucket
+func (c *Client) ForOrganisation(id string) *Client {
+	scoped := *c
+	scoped.node = c.db.From(organisationsBucket, id)
+	scoped.organisationID = id
+	return &scoped
+}
+
+// OrganisationID returns the organisation the client is scoped to
+func (c *Client) OrganisationID() string {
+	return c.organisationID
+}
+
+// As returns a client which records actor as the user responsible for the
+// changes it makes in the history of each payment
+func (c *Client) As(actor string) *Client {
+	acting := *c
+	acting.actor = actor
+	return &acting
+}
+
+// Actor returns the user the client is acting for
+func (c *Client) Actor() string {
+	return c.actor
+}
+
+// WithContext returns a client which records its operations as spans of the
+// trace in ctx
+func (c *Client) WithContext(ctx context.Context) *Client {
+	traced := *c
+	traced.ctx = ctx
+	return &traced
+}
+
+// trace starts a span for an operation, returning the function which ends it
+func (c *Client) trace(name string) func() {
+	if c.ctx == nil {
+		return func() {}
+	}
+	_, span := tracing.Start(c.ctx, name)
+	return span.Finish
+}
+
+// commit commits a transaction, timing how long Bolt takes to write it out
+func (c *Client) commit(tx storm.Node) error {
+	defer c.trace("bolt.commit")()
+	return tx.Commit()
+}
+
+// scope returns the storm node for the client's organisation
+func (c *Client) scope() (storm.Node, error) {
+	if c.node == nil {
+		return nil, ErrNoOrganisation
+	}
+	return c.node, nil
+}
+
+// claim assigns a resource to the client's organisation, refusing resources
+// which name a different organisation
+func (c *Client) claim(res *Resource) error {
+	if len(res.OrganisationID) == 0 {
+		res.OrganisationID = c.organisationID
+	}
+	if res.OrganisationID != c.organisationID {
+		return ErrWrongOrganisation
+	}
+	return nil
+}
+
 // FetchPayment gets a single Payment by ID
 func (c *Client) FetchPayment(id string) (*Payment, error) {
+	defer c.trace("data.FetchPayment")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
 	var pmt Payment
-	if err := c.db.One("ID", id, &pmt); err != nil {
+	if err := n.One("ID", id, &pmt); err != nil {
 		return nil, err
 	}
 	return &pmt, nil
 }
 
-// FetchAllPayments gets a single Payment by ID
+// FetchAllPayments gets all the Payments for the organisation
 func (c *Client) FetchAllPayments() ([]*Payment, error) {
+	defer c.trace("data.FetchAllPayments")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
 	var pmts []*Payment
-	if err := c.db.All(&pmts); err != nil {
+	if err := n.All(&pmts); err != nil {
 		return nil, err
 	}
 	return pmts, nil
 }
 
-// CreatePayment saves a new Payment in the database
+// CreatePayment saves a new Payment in the database. Payments above the
+// organisation's approval threshold wait for approval before they can settle.
 func (c *Client) CreatePayment(pmt *Payment) error {
-	_, err := c.FetchPayment(pmt.ID)
+	defer c.trace("data.CreatePayment")()
+	return c.createPayment(pmt, nil)
+}
+
+// createPayment saves a new Payment, and calls also, when it is not nil,
+// within the transaction which saves it
+func (c *Client) createPayment(pmt *Payment, also func(tx storm.Node) error) error {
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	if err := c.claim(&pmt.Resource); err != nil {
+		return err
+	}
+	if err := checkPayment(pmt); err != nil {
+		return err
+	}
+	_, err = c.FetchPayment(pmt.ID)
 	if err == nil || err.Error() != "not found" {
 		return fmt.Errorf("resource exists")
 	}
-	return c.db.Save(pmt)
+	if err := c.applyOrganisation(pmt); err != nil {
+		return err
+	}
+	if err := expandParties(n, pmt, nil); err != nil {
+		return err
+	}
+	required, err := c.requiredApprovals(pmt)
+	if err != nil {
+		return err
+	}
+	if pmt.Attributes != nil {
+		pmt.Attributes.Status = StatusPending
+		if required > 0 {
+			pmt.Attributes.Status = StatusPendingApproval
+		}
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.Save(pmt); err != nil {
+		return err
+	}
+	if also != nil {
+		if err := also(tx); err != nil {
+			return err
+		}
+	}
+	if _, err := c.record(tx, pmt, EventCreated, ""); err != nil {
+		return err
+	}
+	return c.commit(tx)
 }
 
-// UpdatePayment updates an existing Payment in the database
+// UpdatePayment updates an existing Payment in the database. The status is
+// owned by the server so it is carried over from the stored payment, except
+// that a change to a payment which has not settled starts its approval over.
+// New or changed party references are copied in as on creation, others keep
+// their snapshot, and the payment is saved with the next version.
 func (c *Client) UpdatePayment(pmt *Payment) error {
-	return c.db.Update(pmt)
+	defer c.trace("data.UpdatePayment")()
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	if err := c.claim(&pmt.Resource); err != nil {
+		return err
+	}
+	if err := checkPayment(pmt); err != nil {
+		return err
+	}
+	if err := c.applyOrganisation(pmt); err != nil {
+		return err
+	}
+	required, err := c.requiredApprovals(pmt)
+	if err != nil {
+		return err
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var existing Payment
+	if err := tx.One("ID", pmt.ID, &existing); err != nil {
+		return err
+	}
+	if err := expandParties(tx, pmt, &existing); err != nil {
+		return err
+	}
+	if err := carryStatus(pmt, &existing, required); err != nil {
+		return err
+	}
+	pmt.Version = existing.Version + 1
+	if err := tx.Update(pmt); err != nil {
+		return err
+	}
+	if _, err := c.record(tx, pmt, EventUpdated, ""); err != nil {
+		return err
+	}
+	return c.commit(tx)
+}
+
+// ReplacePayment saves pmt in full in place of the stored payment with its ID,
+// or creates it when there is none, reporting whether it was created. check
+// is given the stored payment, or nil, before anything is written and may
+// refuse the change. Party references are copied in as an update copies
+// them. A replaced payment keeps its status, as an update does, and is saved
+// with the next version.
+func (c *Client) ReplacePayment(pmt *Payment, check func(stored *Payment) error) (bool, error) {
+	defer c.trace("data.ReplacePayment")()
+	n, err := c.scope()
+	if err != nil {
+		return false, err
+	}
+	if err := c.claim(&pmt.Resource); err != nil {
+		return false, err
+	}
+	if err := checkPayment(pmt); err != nil {
+		return false, err
+	}
+	// Read before the transaction, as Bolt must not open one inside another
+	settings, err := c.settings()
+	if err != nil {
+		return false, err
+	}
+	if err := applySettings(settings, pmt); err != nil {
+		return false, err
+	}
+	required, err := approvalsFor(settings, pmt)
+	if err != nil {
+		return false, err
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var existing Payment
+	err = tx.One("ID", pmt.ID, &existing)
+	if err != nil && err != storm.ErrNotFound {
+		return false, err
+	}
+	created := err == storm.ErrNotFound
+	event := EventUpdated
+	if created {
+		if err := check(nil); err != nil {
+			return false, err
+		}
+		if err := expandParties(tx, pmt, nil); err != nil {
+			return false, err
+		}
+		pmt.Version = 0
+		if pmt.Attributes != nil {
+			pmt.Attributes.Status = StatusPending
+			if required > 0 {
+				pmt.Attributes.Status = StatusPendingApproval
+			}
+		}
+		event = EventCreated
+	} else {
+		if err := check(&existing); err != nil {
+			return false, err
+		}
+		if err := expandParties(tx, pmt, &existing); err != nil {
+			return false, err
+		}
+		if err := carryStatus(pmt, &existing, required); err != nil {
+			return false, err
+		}
+		pmt.Version = existing.Version + 1
+	}
+	if err := tx.Save(pmt); err != nil {
+		return false, err
+	}
+	if _, err := c.record(tx, pmt, event, ""); err != nil {
+		return false, err
+	}
+	return created, c.commit(tx)
+}
+
+// PatchPayment changes part of an existing Payment. patch is given the stored
+// payment, read in the same transaction as the change is written, and returns
+// the changed payment. This is checked, and its party references copied in,
+// as an update would be, must keep the version of the stored payment, and is
+// saved in full with the next version.
+func (c *Client) PatchPayment(id string, patch func(*Payment) (*Payment, error)) (*Payment, error) {
+	defer c.trace("data.PatchPayment")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	// Read before the transaction, as Bolt must not open one inside another
+	settings, err := c.settings()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var existing Payment
+	if err := tx.One("ID", id, &existing); err != nil {
+		return nil, err
+	}
+	stored := existing
+	pmt, err := patch(&existing)
+	if err != nil {
+		return nil, err
+	}
+	pmt.ID = id
+	if pmt.Version != stored.Version {
+		return nil, ErrVersionMismatch
+	}
+	if err := c.claim(&pmt.Resource); err != nil {
+		return nil, err
+	}
+	if err := checkPayment(pmt); err != nil {
+		return nil, err
+	}
+	if err := applySettings(settings, pmt); err != nil {
+		return nil, err
+	}
+	if err := expandParties(tx, pmt, &stored); err != nil {
+		return nil, err
+	}
+	required, err := approvalsFor(settings, pmt)
+	if err != nil {
+		return nil, err
+	}
+	if err := carryStatus(pmt, &stored, required); err != nil {
+		return nil, err
+	}
+	pmt.Version++
+	if err := tx.Save(pmt); err != nil {
+		return nil, err
+	}
+	if _, err := c.record(tx, pmt, EventUpdated, ""); err != nil {
+		return nil, err
+	}
+	return pmt, c.commit(tx)
 }
 
-// DeletePayment deletes an existing Payment from the database
+// checkPayment refuses a payment which is missing what every payment needs:
+// attributes, a positive amount and a currency
+func checkPayment(pmt *Payment) error {
+	if pmt.Attributes == nil {
+		return ErrNoAttributes
+	}
+	if amt, err := ParseAmount(pmt.Attributes.Amount); err != nil || amt.Sign() <= 0 {
+		return ErrInvalidAmount
+	}
+	if len(pmt.Attributes.Currency) == 0 {
+		return ErrNoCurrency
+	}
+	return nil
+}
+
+// carryStatus keeps the status of the stored payment, which is owned by the
+// server, except that a change to a payment which has not settled starts its
+// approval over. Once money has moved only the payment's references and other
+// details may change.
+func carryStatus(pmt, existing *Payment, required int) error {
+	if moved(existing) && movesOtherMoney(pmt, existing) {
+		return ErrPaymentSettled
+	}
+	if pmt.Attributes == nil || existing.Attributes == nil {
+		return nil
+	}
+	pmt.Attributes.Status = existing.Attributes.Status
+	switch existing.Attributes.Status {
+	case StatusPending, StatusPendingApproval:
+		pmt.Attributes.Status = StatusPending
+		if required > 0 {
+			pmt.Attributes.Status = StatusPendingApproval
+		}
+	}
+	return nil
+}
+
+// DeletePayment deletes an existing Payment from the database. Payments which
+// have returns, reversals or ledger entries have moved money, so they are kept.
 func (c *Client) DeletePayment(id string) error {
-	pmt, err := c.FetchPayment(id)
+	defer c.trace("data.DeletePayment")()
+	n, err := c.scope()
 	if err != nil {
 		return err
 	}
-	return c.db.DeleteStruct(pmt)
+	tx, err := n.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var pmt Payment
+	if err := tx.One("ID", id, &pmt); err != nil {
+		return err
+	}
+	for _, related := range []interface{}{&[]*LinkedTransaction{}, &[]*LedgerEntry{}} {
+		if err := tx.Find("PaymentID", id, related); err == nil {
+			return ErrPaymentInUse
+		} else if err.Error() != "not found" {
+			return err
+		}
+	}
+	if err := tx.DeleteStruct(&pmt); err != nil {
+		return err
+	}
+	// The request which created it is forgotten along with it
+	if err := tx.DeleteStruct(&IdempotentRequest{ID: id}); err != nil && err.Error() != "not found" {
+		return err
+	}
+	// The history is kept as the audit trail of the payment, and the deletion
+	// closes it so that a new payment created with the same ID starts afresh
+	if _, err := c.record(tx, &pmt, EventDeleted, ""); err != nil {
+		return err
+	}
+	return c.commit(tx)
 }
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+	bolt "go.etcd.io/bbolt"
+)
+
+// migrationsBucket records when each migration was applied
+const migrationsBucket = "migrations"
+
+// migration upgrades the layout of the database. Each migration runs once, in
+// a single transaction, and is recorded by name when it commits.
+type migration struct {
+	name string
+	run  func(n storm.Node, tx *bolt.Tx) error
+}
+
+var migrations = []migration{
+	{"organisation-buckets", migrateOrganisationBuckets},
+	{"organisation-records", migrateOrganisationRecords},
+}
+
+// migrate applies any migrations which have not yet been run
+func (c *Client) migrate() error {
+	for _, m := range migrations {
+		var applied time.Time
+		err := c.db.Get(migrationsBucket, m.name, &applied)
+		if err == nil {
+			continue
+		}
+		if err != storm.ErrNotFound {
+			return err
+		}
+		err = c.db.Bolt.Update(func(tx *bolt.Tx) error {
+			n := c.db.WithTransaction(tx)
+			if err := m.run(n, tx); err != nil {
+				return err
+			}
+			return n.Set(migrationsBucket, m.name, time.Now().UTC())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateOrganisationBuckets moves resources stored before multi-tenancy into
+// their organisation's bucket. Resources without an organisation are left
+// where they are, out of reach of every tenant.
+func migrateOrganisationBuckets(tx storm.Node, _ *bolt.Tx) error {
+	var pmts []*Payment
+	if err := tx.All(&pmts); err != nil {
+		return err
+	}
+	for _, pmt := range pmts {
+		if err := moveToOrganisation(tx, pmt.OrganisationID, pmt); err != nil {
+			return err
+		}
+	}
+	var txns []*LinkedTransaction
+	if err := tx.All(&txns); err != nil {
+		return err
+	}
+	for _, txn := range txns {
+		if err := moveToOrganisation(tx, txn.OrganisationID, txn); err != nil {
+			return err
+		}
+	}
+	var ptys []*Party
+	if err := tx.All(&ptys); err != nil {
+		return err
+	}
+	for _, pty := range ptys {
+		if err := moveToOrganisation(tx, pty.OrganisationID, pty); err != nil {
+			return err
+		}
+	}
+	var accs []*Account
+	if err := tx.All(&accs); err != nil {
+		return err
+	}
+	owners := make(map[string]string)
+	for _, acc := range accs {
+		owners[acc.ID] = acc.OrganisationID
+		if err := moveToOrganisation(tx, acc.OrganisationID, acc); err != nil {
+			return err
+		}
+	}
+	// Ledger entries belong to the organisation which owns the account. They
+	// are renumbered in posting order so the bucket's counter stays in step.
+	var entries []*LedgerEntry
+	if err := tx.All(&entries); err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	for _, e := range entries {
+		organisationID := owners[e.AccountID]
+		if len(organisationID) == 0 {
+			continue
+		}
+		if err := tx.DeleteStruct(e); err != nil {
+			return err
+		}
+		e.ID = 0
+		if err := tx.From(organisationsBucket, organisationID).Save(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveToOrganisation(tx storm.Node, organisationID string, data interface{}) error {
+	if len(organisationID) == 0 {
+		return nil
+	}
+	if err := tx.From(organisationsBucket, organisationID).Save(data); err != nil {
+		return err
+	}
+	return tx.DeleteStruct(data)
+}
+
+// migrateOrganisationRecords creates an active organisation, with no
+// restrictions, for each organisation which already has resources
+func migrateOrganisationRecords(n storm.Node, tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(organisationsBucket))
+	if b == nil {
+		return nil
+	}
+	var ids []string
+	err := b.ForEach(func(k, v []byte) error {
+		// Nested buckets have no value
+		if v == nil {
+			ids = append(ids, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		var org Organisation
+		err := n.One("ID", id, &org)
+		if err == nil {
+			continue
+		}
+		if err != storm.ErrNotFound {
+			return err
+		}
+		org = Organisation{
+			Type: "Organisation",
+			ID:   id,
+			Attributes: &OrganisationAttributes{
+				Name:   id,
+				Status: OrganisationActive,
+			},
+		}
+		if err := n.Save(&org); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingMigrations returns the names of the migrations which have not been
+// applied, within a single read transaction
+func (c *Client) PendingMigrations() ([]string, error) {
+	var pending []string
+	err := c.db.Bolt.View(func(tx *bolt.Tx) error {
+		n := c.db.WithTransaction(tx)
+		for _, m := range migrations {
+			var applied time.Time
+			err := n.Get(migrationsBucket, m.name, &applied)
+			if err == storm.ErrNotFound {
+				pending = append(pending, m.name)
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return pending, err
+}
@@ -0,0 +1,202 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrUnknownOrganisation is returned when writing a payment for an organisation with no record
+	ErrUnknownOrganisation = errors.New("unknown organisation")
+	// ErrOrganisationSuspended is returned when writing a payment for a suspended organisation
+	ErrOrganisationSuspended = errors.New("organisation suspended")
+	// ErrCurrencyNotAllowed is returned when the organisation does not allow the payment currency
+	ErrCurrencyNotAllowed = errors.New("currency not allowed for organisation")
+	// ErrSchemeNotAllowed is returned when the organisation does not allow the payment scheme
+	ErrSchemeNotAllowed = errors.New("payment scheme not allowed for organisation")
+	// ErrLimitExceeded is returned when a payment is larger than the organisation's limit
+	ErrLimitExceeded = errors.New("payment exceeds organisation limit")
+	// ErrOrganisationInUse is returned when deleting an organisation which still has resources
+	ErrOrganisationInUse = errors.New("organisation has resources")
+	// ErrInvalidOrganisationStatus is returned when saving an organisation
+	// which is neither active nor suspended
+	ErrInvalidOrganisationStatus = errors.New("status must be active or suspended")
+	// ErrInvalidOrganisationAmount is returned when saving an organisation with
+	// a payment limit or approval threshold which is not a positive decimal
+	ErrInvalidOrganisationAmount = errors.New("payment limits and approval thresholds must be positive decimals")
+)
+
+// Organisations are shared by all tenants so, unlike everything else, they
+// are read and written from the root of the database whether or not the
+// client is scoped to an organisation.
+
+// FetchOrganisation gets a single Organisation by ID
+func (c *Client) FetchOrganisation(id string) (*Organisation, error) {
+	defer c.trace("data.FetchOrganisation")()
+	var org Organisation
+	if err := c.db.One("ID", id, &org); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// FetchAllOrganisations gets every Organisation
+func (c *Client) FetchAllOrganisations() ([]*Organisation, error) {
+	defer c.trace("data.FetchAllOrganisations")()
+	orgs := []*Organisation{}
+	if err := c.db.All(&orgs); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// CreateOrganisation saves a new Organisation in the database
+func (c *Client) CreateOrganisation(org *Organisation) error {
+	defer c.trace("data.CreateOrganisation")()
+	_, err := c.FetchOrganisation(org.ID)
+	if err == nil || err.Error() != "not found" {
+		return fmt.Errorf("resource exists")
+	}
+	if err := checkOrganisation(org); err != nil {
+		return err
+	}
+	if org.Attributes != nil && len(org.Attributes.Status) == 0 {
+		org.Attributes.Status = OrganisationActive
+	}
+	return c.db.Save(org)
+}
+
+// UpdateOrganisation updates an existing Organisation in the database
+func (c *Client) UpdateOrganisation(org *Organisation) error {
+	defer c.trace("data.UpdateOrganisation")()
+	if err := checkOrganisation(org); err != nil {
+		return err
+	}
+	return c.db.Update(org)
+}
+
+// checkOrganisation refuses settings which every payment of the organisation
+// would later fail on
+func checkOrganisation(org *Organisation) error {
+	attrs := org.Attributes
+	if attrs == nil {
+		return nil
+	}
+	switch attrs.Status {
+	case "", OrganisationActive, OrganisationSuspended:
+	default:
+		return ErrInvalidOrganisationStatus
+	}
+	for _, amounts := range []map[string]json.Number{attrs.PaymentLimits, attrs.ApprovalThresholds} {
+		for _, n := range amounts {
+			if amt, err := ParseAmount(n); err != nil || amt.Sign() <= 0 {
+				return ErrInvalidOrganisationAmount
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteOrganisation deletes an Organisation which has no resources left
+func (c *Client) DeleteOrganisation(id string) error {
+	defer c.trace("data.DeleteOrganisation")()
+	org, err := c.FetchOrganisation(id)
+	if err != nil {
+		return err
+	}
+	inUse := false
+	err = c.db.Bolt.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(organisationsBucket)); b != nil {
+			inUse = b.Bucket([]byte(id)) != nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrOrganisationInUse
+	}
+	return c.db.DeleteStruct(org)
+}
+
+// applyOrganisation checks a payment against the settings of the client's
+// organisation and fills in the organisation's defaults
+func (c *Client) applyOrganisation(pmt *Payment) error {
+	settings, err := c.settings()
+	if err != nil {
+		return err
+	}
+	return applySettings(settings, pmt)
+}
+
+// applySettings checks a payment against the settings of its organisation
+// and fills in their defaults
+func applySettings(settings *OrganisationAttributes, pmt *Payment) error {
+	if settings.Status == OrganisationSuspended {
+		return ErrOrganisationSuspended
+	}
+	attrs := pmt.Attributes
+	if attrs == nil {
+		return nil
+	}
+	if !allowed(settings.AllowedCurrencies, attrs.Currency) {
+		return ErrCurrencyNotAllowed
+	}
+	if !allowed(settings.AllowedSchemes, attrs.PaymentScheme) {
+		return ErrSchemeNotAllowed
+	}
+	if limit, ok := settings.PaymentLimits[attrs.Currency]; ok {
+		max, err := ParseAmount(limit)
+		if err != nil {
+			return err
+		}
+		amt, err := ParseAmount(attrs.Amount)
+		if err != nil {
+			return err
+		}
+		if amt.Cmp(max) > 0 {
+			return ErrLimitExceeded
+		}
+	}
+	if len(settings.DefaultBearerCode) > 0 {
+		if attrs.ChargesInformation == nil {
+			attrs.ChargesInformation = &PaymentCharges{}
+		}
+		if len(attrs.ChargesInformation.BearerCode) == 0 {
+			attrs.ChargesInformation.BearerCode = settings.DefaultBearerCode
+		}
+	}
+	return nil
+}
+
+// settings returns the attributes of the client's organisation
+func (c *Client) settings() (*OrganisationAttributes, error) {
+	org, err := c.FetchOrganisation(c.organisationID)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil, ErrUnknownOrganisation
+		}
+		return nil, err
+	}
+	if org.Attributes == nil {
+		return &OrganisationAttributes{}, nil
+	}
+	return org.Attributes, nil
+}
+
+// allowed reports whether value is in list, an empty list allows anything
+func allowed(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
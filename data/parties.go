@@ -0,0 +1,134 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/asdine/storm"
+)
+
+// ErrPartyNotFound is returned when a payment references a party which does
+// not exist in the payment's organisation
+var ErrPartyNotFound = errors.New("referenced party not found")
+
+// FetchParty gets a single Party by ID
+func (c *Client) FetchParty(id string) (*Party, error) {
+	defer c.trace("data.FetchParty")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	var pty Party
+	if err := n.One("ID", id, &pty); err != nil {
+		return nil, err
+	}
+	return &pty, nil
+}
+
+// FetchAllParties gets all the parties for the organisation
+func (c *Client) FetchAllParties() ([]*Party, error) {
+	defer c.trace("data.FetchAllParties")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	ptys := []*Party{}
+	if err := n.All(&ptys); err != nil {
+		return nil, err
+	}
+	return ptys, nil
+}
+
+// CreateParty saves a new Party in the database
+func (c *Client) CreateParty(pty *Party) error {
+	defer c.trace("data.CreateParty")()
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	if err := c.claim(&pty.Resource); err != nil {
+		return err
+	}
+	_, err = c.FetchParty(pty.ID)
+	if err == nil || err.Error() != "not found" {
+		return fmt.Errorf("resource exists")
+	}
+	return n.Save(pty)
+}
+
+// UpdateParty updates an existing Party in the database. Payments which
+// reference the party keep the snapshot taken when they were created.
+func (c *Client) UpdateParty(pty *Party) error {
+	defer c.trace("data.UpdateParty")()
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	if err := c.claim(&pty.Resource); err != nil {
+		return err
+	}
+	return n.Update(pty)
+}
+
+// DeleteParty deletes an existing Party from the database
+func (c *Client) DeleteParty(id string) error {
+	defer c.trace("data.DeleteParty")()
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	pty, err := c.FetchParty(id)
+	if err != nil {
+		return err
+	}
+	return n.DeleteStruct(pty)
+}
+
+// expandParties replaces any party references on a payment with a snapshot
+// of the referenced party read from n, keeping the reference alongside it. n
+// is the transaction the payment is written in, if one has been begun. A
+// reference the stored payment, if any, already had keeps the snapshot taken
+// then, so that editing the directory never changes an existing payment.
+func expandParties(n storm.Node, pmt, stored *Payment) error {
+	if pmt.Attributes == nil {
+		return nil
+	}
+	var was PaymentAttributes
+	if stored != nil && stored.Attributes != nil {
+		was = *stored.Attributes
+	}
+	refs := []struct {
+		id       string
+		party    **PaymentParty
+		storedID string
+		snapshot *PaymentParty
+	}{
+		{pmt.Attributes.BeneficiaryPartyID, &pmt.Attributes.BeneficiaryParty,
+			was.BeneficiaryPartyID, was.BeneficiaryParty},
+		{pmt.Attributes.DebtorPartyID, &pmt.Attributes.DebtorParty, was.DebtorPartyID, was.DebtorParty},
+		{pmt.Attributes.SponsorPartyID, &pmt.Attributes.SponsorParty, was.SponsorPartyID, was.SponsorParty},
+	}
+	for _, ref := range refs {
+		if len(ref.id) == 0 {
+			continue
+		}
+		if ref.id == ref.storedID && ref.snapshot != nil {
+			snapshot := *ref.snapshot
+			*ref.party = &snapshot
+			continue
+		}
+		var pty Party
+		if err := n.One("ID", ref.id, &pty); err != nil {
+			if err.Error() == "not found" {
+				return ErrPartyNotFound
+			}
+			return err
+		}
+		if pty.Attributes == nil {
+			return ErrPartyNotFound
+		}
+		snapshot := *pty.Attributes
+		*ref.party = &snapshot
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package data
+
+import "time"
+
+// Quota usage is counted per caller rather than per organisation, so it is
+// stored at the root of the database like API keys.
+
+// QuotaUsage is how many requests a rate limiting key made on a day
+type QuotaUsage struct {
+	// ID is the key and day, joined by a space
+	ID    string `json:"id" storm:"id"`
+	Key   string `json:"key"`
+	Day   string `json:"day" storm:"index"`
+	Count int64  `json:"count"`
+}
+
+// QuotaDay formats the UTC day of t as quota usage is recorded
+func QuotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// FetchQuotaUsage gets the number of requests made by key on day, which is
+// zero when none have been recorded
+func (c *Client) FetchQuotaUsage(key, day string) (int64, error) {
+	defer c.trace("data.FetchQuotaUsage")()
+	var usage QuotaUsage
+	if err := c.db.One("ID", key+" "+day, &usage); err != nil {
+		if err.Error() == "not found" {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return usage.Count, nil
+}
+
+// SaveQuotaUsage writes the counts of a day in one transaction, removing
+// those of earlier days which are no longer needed
+func (c *Client) SaveQuotaUsage(day string, counts map[string]int64) error {
+	defer c.trace("data.SaveQuotaUsage")()
+	tx, err := c.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var all []*QuotaUsage
+	if err := tx.All(&all); err != nil {
+		return err
+	}
+	for _, usage := range all {
+		if usage.Day < day {
+			if err := tx.DeleteStruct(usage); err != nil {
+				return err
+			}
+		}
+	}
+	for key, count := range counts {
+		usage := &QuotaUsage{ID: key + " " + day, Key: key, Day: day, Count: count}
+		if err := tx.Save(usage); err != nil {
+			return err
+		}
+	}
+	return c.commit(tx)
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// PaymentCount is the number of payments with a status and currency, across
+// every organisation
+type PaymentCount struct {
+	Status   string
+	Currency string
+	Count    int
+}
+
+// Stats returns the Bolt statistics of the database
+func (c *Client) Stats() bolt.Stats {
+	return c.db.Bolt.Stats()
+}
+
+// Ping checks that a read transaction can be started on the database
+func (c *Client) Ping() error {
+	return c.db.Bolt.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// Size returns the size of the database file in bytes
+func (c *Client) Size() (int64, error) {
+	info, err := os.Stat(c.dbPath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// CountPayments counts the payments of every organisation by status and
+// currency, within a single read transaction
+func (c *Client) CountPayments() ([]*PaymentCount, error) {
+	defer c.trace("data.CountPayments")()
+	counts := make(map[[2]string]*PaymentCount)
+	var order []*PaymentCount
+	err := c.db.Bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(organisationsBucket))
+		if b == nil {
+			return nil
+		}
+		n := c.db.WithTransaction(tx)
+		return b.ForEach(func(k, v []byte) error {
+			// Nested buckets have no value
+			if v != nil {
+				return nil
+			}
+			var pmts []*Payment
+			if err := n.From(organisationsBucket, string(k)).All(&pmts); err != nil {
+				return err
+			}
+			for _, pmt := range pmts {
+				if pmt.Attributes == nil {
+					continue
+				}
+				key := [2]string{pmt.Attributes.Status, pmt.Attributes.Currency}
+				if counts[key] == nil {
+					counts[key] = &PaymentCount{Status: key[0], Currency: key[1]}
+					order = append(order, counts[key])
+				}
+				counts[key].Count++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
@@ -0,0 +1,226 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	// ErrInvalidAmount is returned when an amount is not a positive decimal
+	ErrInvalidAmount = errors.New("amount must be a positive decimal")
+	// ErrCurrencyMismatch is returned when a linked transaction is not in the payment currency
+	ErrCurrencyMismatch = errors.New("currency does not match payment")
+	// ErrAmountExceeded is returned when cumulative returns would exceed the original amount
+	ErrAmountExceeded = errors.New("amount exceeds remaining payment amount")
+	// ErrPaymentClosed is returned when a payment has already been fully returned or reversed
+	ErrPaymentClosed = errors.New("payment already returned or reversed")
+	// ErrNotSettled is returned when returning or reversing a payment which has
+	// not moved any money to give back
+	ErrNotSettled = errors.New("payment has not been settled")
+)
+
+// NewID returns a random (version 4) UUID
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// NameID returns a name based UUID, in the manner of version 5, which is
+// always the same for the same name
+func NameID(name string) string {
+	sum := sha1.Sum([]byte(name))
+	b := sum[:16]
+	b[6] = (b[6] & 0x0f) | 0x50
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ValidID reports whether id is a UUID written as NewID writes them, in
+// lower case hex with hyphens. The version is not checked, so that IDs
+// made elsewhere are accepted.
+func ValidID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ParseAmount converts a decimal amount into an exact rational
+func ParseAmount(n json.Number) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(n.String())
+	if !ok {
+		return nil, ErrInvalidAmount
+	}
+	return r, nil
+}
+
+// FetchLinkedTransactions gets all returns and reversals for a payment
+func (c *Client) FetchLinkedTransactions(paymentID string) ([]*LinkedTransaction, error) {
+	defer c.trace("data.FetchLinkedTransactions")()
+	n, err := c.scope()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.FetchPayment(paymentID); err != nil {
+		return nil, err
+	}
+	txns := []*LinkedTransaction{}
+	if err := n.Find("PaymentID", paymentID, &txns); err != nil && err.Error() != "not found" {
+		return nil, err
+	}
+	return txns, nil
+}
+
+// CreateReturn records a (possibly partial) return against a payment. The
+// cumulative amount returned may never exceed the original payment amount.
+func (c *Client) CreateReturn(paymentID string, ret *LinkedTransaction) error {
+	defer c.trace("data.CreateReturn")()
+	ret.Type = TypeReturn
+	return c.createLinkedTransaction(paymentID, ret)
+}
+
+// CreateReversal reverses whatever is outstanding on a payment
+func (c *Client) CreateReversal(paymentID string, rev *LinkedTransaction) error {
+	defer c.trace("data.CreateReversal")()
+	rev.Type = TypeReversal
+	return c.createLinkedTransaction(paymentID, rev)
+}
+
+func (c *Client) createLinkedTransaction(paymentID string, txn *LinkedTransaction) error {
+	if txn.Attributes == nil {
+		txn.Attributes = &LinkedTransactionAttributes{}
+	}
+	n, err := c.scope()
+	if err != nil {
+		return err
+	}
+	tx, err := n.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pmt Payment
+	if err := tx.One("ID", paymentID, &pmt); err != nil {
+		return err
+	}
+	if pmt.Attributes == nil {
+		return ErrInvalidAmount
+	}
+	if pmt.Attributes.Status == StatusReturned || pmt.Attributes.Status == StatusReversed {
+		return ErrPaymentClosed
+	}
+	if pmt.Attributes.Status == StatusPendingApproval || pmt.Attributes.Status == StatusRejected {
+		return ErrNotApproved
+	}
+	if !moved(&pmt) {
+		return ErrNotSettled
+	}
+	original, err := ParseAmount(pmt.Attributes.Amount)
+	if err != nil {
+		return err
+	}
+
+	var existing []*LinkedTransaction
+	if err := tx.Find("PaymentID", paymentID, &existing); err != nil && err.Error() != "not found" {
+		return err
+	}
+	returned := new(big.Rat)
+	places := decimalPlaces(pmt.Attributes.Amount)
+	for _, e := range existing {
+		amt, err := ParseAmount(e.Attributes.Amount)
+		if err != nil {
+			return err
+		}
+		returned.Add(returned, amt)
+		if p := decimalPlaces(e.Attributes.Amount); p > places {
+			places = p
+		}
+	}
+	remaining := new(big.Rat).Sub(original, returned)
+
+	if len(txn.Attributes.Currency) == 0 {
+		txn.Attributes.Currency = pmt.Attributes.Currency
+	} else if txn.Attributes.Currency != pmt.Attributes.Currency {
+		return ErrCurrencyMismatch
+	}
+
+	status := StatusReversed
+	if txn.Type == TypeReversal {
+		// A reversal always covers the outstanding amount, written as precisely
+		// as the most precise of the payment and its returns so that it is exact
+		txn.Attributes.Amount = json.Number(remaining.FloatString(places))
+	} else {
+		amt, err := ParseAmount(txn.Attributes.Amount)
+		if err != nil || amt.Sign() <= 0 {
+			return ErrInvalidAmount
+		}
+		switch amt.Cmp(remaining) {
+		case 1:
+			return ErrAmountExceeded
+		case 0:
+			status = StatusReturned
+		default:
+			status = StatusPartiallyReturned
+		}
+	}
+
+	// The ID is always chosen here, so that a transaction can never be saved
+	// over another
+	if txn.ID, err = NewID(); err != nil {
+		return err
+	}
+	txn.PaymentID = paymentID
+	txn.OrganisationID = pmt.OrganisationID
+	if err := tx.Save(txn); err != nil {
+		return err
+	}
+	if err := postReturn(tx, &pmt, txn); err != nil {
+		return err
+	}
+	pmt.Attributes.Status = status
+	pmt.Version++
+	if err := tx.Update(&pmt); err != nil {
+		return err
+	}
+	event := EventReturned
+	if txn.Type == TypeReversal {
+		event = EventReversed
+	}
+	if _, err := c.record(tx, &pmt, event, txn.Attributes.Reason); err != nil {
+		return err
+	}
+	return c.commit(tx)
+}
+
+// decimalPlaces returns the number of digits after the decimal point
+func decimalPlaces(n json.Number) int {
+	s := n.String()
+	for i := range s {
+		if s[i] == '.' {
+			return len(s) - i - 1
+		}
+	}
+	return 0
+}
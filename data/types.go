@@ -1,15 +1,62 @@
 package data
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Resource contains the base attributes
 type Resource struct {
 	Type           string `json:"type"`
-	ID             string `json:"id",storm:"id"`
-	Version        int    `json:"version"`
+	ID             string `json:"id" storm:"id"`
+	Version        int    `json:"version" openapi:"minimum=0"`
 	OrganisationID string `json:"organisation_id"`
 }
 
+// Organisation statuses
+const (
+	OrganisationActive    = "active"
+	OrganisationSuspended = "suspended"
+)
+
+// Organisation is a tenant, which owns payments and the other resources
+type Organisation struct {
+	Type       string                  `json:"type"`
+	ID         string                  `json:"id" storm:"id"`
+	Version    int                     `json:"version"`
+	Attributes *OrganisationAttributes `json:"attributes"`
+}
+
+// OrganisationAttributes are the settings applied to an organisation's
+// payments. Empty allowed currencies or schemes allow any, and payment limits
+// are the largest amount of a single payment in each currency. Payments above
+// the approval threshold for their currency need the required number of
+// approvals (at least one) before they can be settled.
+type OrganisationAttributes struct {
+	Name               string                 `json:"name"`
+	Status             string                 `json:"status" openapi:"enum=|active|suspended"`
+	AllowedCurrencies  []string               `json:"allowed_currencies"`
+	AllowedSchemes     []string               `json:"allowed_schemes"`
+	DefaultBearerCode  string                 `json:"default_bearer_code"`
+	PaymentLimits      map[string]json.Number `json:"payment_limits"`
+	ApprovalThresholds map[string]json.Number `json:"approval_thresholds"`
+	RequiredApprovals  int                    `json:"required_approvals"`
+	// Tier chooses the rate limits of the organisation, or the default tier
+	// when empty
+	Tier string `json:"tier"`
+}
+
+// Payment statuses, managed by the server rather than supplied by clients
+const (
+	StatusPendingApproval   = "pending_approval"
+	StatusPending           = "pending"
+	StatusRejected          = "rejected"
+	StatusSettled           = "settled"
+	StatusPartiallyReturned = "partially_returned"
+	StatusReturned          = "returned"
+	StatusReversed          = "reversed"
+)
+
 // Payment represents a payment resource
 type Payment struct {
 	Resource   `storm:"inline"`
@@ -20,21 +67,25 @@ type Payment struct {
 type PaymentAttributes struct {
 	Amount               json.Number     `json:"amount"`
 	BeneficiaryParty     *PaymentParty   `json:"beneficiary_party"`
+	BeneficiaryPartyID   string          `json:"beneficiary_party_id,omitempty"`
 	ChargesInformation   *PaymentCharges `json:"charges_information"`
-	Currency             string          `json:"currency"`
+	Currency             string          `json:"currency" openapi:"pattern=^[A-Z]{3}$"`
 	DebtorParty          *PaymentParty   `json:"debtor_party"`
+	DebtorPartyID        string          `json:"debtor_party_id,omitempty"`
 	EtoEReference        string          `json:"end_to_end_reference"`
 	FX                   *PaymentFXData  `json:"fx"`
-	NumericReference     json.Number     `json:"numeric_reference",storm:"unique"`
-	PaymentID            json.Number     `json:"payment_id",storm:"unique"`
+	NumericReference     json.Number     `json:"numeric_reference" storm:"unique"`
+	PaymentID            json.Number     `json:"payment_id" storm:"unique"`
 	PaymentPurpose       string          `json:"payment_purpose"`
 	PaymentScheme        string          `json:"payment_scheme"`
 	PaymentType          string          `json:"payment_type"`
-	ProcessingDate       string          `json:"processing_date"`
+	ProcessingDate       string          `json:"processing_date" openapi:"format=date"`
 	Reference            string          `json:"reference"`
 	SchemePaymentSubType string          `json:"scheme_payment_sub_type"`
 	SchemePaymentType    string          `json:"scheme_payment_type"`
 	SponsorParty         *PaymentParty   `json:"sponsor_party"`
+	SponsorPartyID       string          `json:"sponsor_party_id,omitempty"`
+	Status               string          `json:"status" openapi:"readonly,enum=|pending_approval|pending|rejected|settled|partially_returned|returned|reversed"`
 }
 
 // PaymentParty represents a party involved in the transaction
@@ -49,6 +100,12 @@ type PaymentParty struct {
 	Name              string `json:"name"`
 }
 
+// Party is an entry in an organisation's directory of counterparties
+type Party struct {
+	Resource   `storm:"inline"`
+	Attributes *PaymentParty `json:"attributes"`
+}
+
 // PaymentCharges is the charges associated with the payment
 type PaymentCharges struct {
 	BearerCode              string                 `json:"bearer_code"`
@@ -60,7 +117,7 @@ type PaymentCharges struct {
 // PaymentSenderCharge is a charge on the payment sender
 type PaymentSenderCharge struct {
 	Amount   json.Number `json:"amount"`
-	Currency string      `json:"currency"`
+	Currency string      `json:"currency" openapi:"pattern=^[A-Z]{3}$"`
 }
 
 // PaymentFXData is the forex details of the payment
@@ -70,3 +127,123 @@ type PaymentFXData struct {
 	OriginalAmount    json.Number `json:"original_amount"`
 	OriginalCurrency  string      `json:"original_currency"`
 }
+
+// Linked transaction types
+const (
+	TypeReturn   = "Return"
+	TypeReversal = "Reversal"
+)
+
+// LinkedTransaction is a return or reversal which references an original payment
+type LinkedTransaction struct {
+	Resource   `storm:"inline"`
+	PaymentID  string                       `json:"payment_id" storm:"index"`
+	Attributes *LinkedTransactionAttributes `json:"attributes"`
+}
+
+// LinkedTransactionAttributes are the details of a return or reversal
+type LinkedTransactionAttributes struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+	Reason   string      `json:"reason"`
+}
+
+// Payment event kinds
+const (
+	EventCreated  = "created"
+	EventUpdated  = "updated"
+	EventApproved = "approved"
+	EventRejected = "rejected"
+	EventSettled  = "settled"
+	EventReturned = "returned"
+	EventReversed = "reversed"
+	EventDeleted  = "deleted"
+)
+
+// PaymentEvent is an entry in the history of a payment, recording who did
+// what to it and the status it was left in
+type PaymentEvent struct {
+	ID        int       `json:"id" storm:"id,increment"`
+	PaymentID string    `json:"payment_id" storm:"index"`
+	Kind      string    `json:"kind" openapi:"enum=created|updated|approved|rejected|settled|returned|reversed|deleted"`
+	Actor     string    `json:"actor"`
+	Status    string    `json:"status"`
+	Comment   string    `json:"comment,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Account types
+const (
+	AccountCustomer = "customer"
+	AccountFees     = "fees"
+	AccountClearing = "clearing"
+)
+
+// Account is an organisation's account which payments settle against
+type Account struct {
+	Resource   `storm:"inline"`
+	Attributes *AccountAttributes `json:"attributes"`
+}
+
+// AccountAttributes are the details of an account. Fees and clearing accounts
+// are created automatically per currency when payments settle.
+type AccountAttributes struct {
+	AccountName   string `json:"account_name"`
+	AccountNumber string `json:"account_number"`
+	AccountType   string `json:"account_type" openapi:"enum=|customer|fees|clearing"`
+	BankID        string `json:"bank_id"`
+	Currency      string `json:"currency"`
+}
+
+// Ledger entry directions
+const (
+	Debit  = "debit"
+	Credit = "credit"
+)
+
+// Ledger entry kinds
+const (
+	EntryPrincipal = "principal"
+	EntryCharge    = "charge"
+	EntryReturn    = "return"
+)
+
+// LedgerEntry is one side of a posting in the append-only double-entry ledger
+type LedgerEntry struct {
+	ID        int         `json:"id" storm:"id,increment"`
+	JournalID string      `json:"journal_id" storm:"index"`
+	AccountID string      `json:"account_id" storm:"index"`
+	PaymentID string      `json:"payment_id" storm:"index"`
+	Kind      string      `json:"kind" openapi:"enum=principal|charge|return"`
+	Direction string      `json:"direction" openapi:"enum=debit|credit"`
+	Amount    json.Number `json:"amount"`
+	Currency  string      `json:"currency"`
+	PostedAt  time.Time   `json:"posted_at"`
+}
+
+// AccountBalance is the position of an account per currency, credits less debits
+type AccountBalance struct {
+	AccountID string                 `json:"account_id"`
+	Balances  map[string]json.Number `json:"balances"`
+	Entries   int                    `json:"entries"`
+}
+
+// APIKey is a credential issued to an organisation. Only a salted hash of the
+// secret part of the key is stored, and even that should never be returned
+// to callers.
+type APIKey struct {
+	ID             string     `json:"id" storm:"id"`
+	OrganisationID string     `json:"organisation_id" storm:"index"`
+	Name           string     `json:"name"`
+	Roles          []string   `json:"roles"`
+	Salt           []byte     `json:"salt"`
+	Hash           []byte     `json:"hash"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+}
+
+// Active reports whether the key has not been revoked
+func (k *APIKey) Active() bool {
+	return k.RevokedAt == nil
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+	"github.com/gorilla/mux"
+)
+
+// Accounts handlers for account resources
+type Accounts struct {
+	db *data.Client
+}
+
+// NewAccounts returns new handler with database client
+func NewAccounts(db *data.Client) *Accounts {
+	return &Accounts{db: db}
+}
+
+// GetAll lists all account resources
+func (a *Accounts) GetAll(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(a.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	accs, err := db.FetchAllAccounts()
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Error getting all accounts: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeCollection(w, r, accs)
+}
+
+// GetOne shows a single account resource
+func (a *Accounts) GetOne(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(a.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	acc, err := db.FetchAccount(params["id"])
+	if err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error getting account: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	writeResource(w, r, http.StatusOK, acc)
+}
+
+// Create a new account resource
+func (a *Accounts) Create(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(a.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	var account data.Account
+	if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := decode(r, &account); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding create account request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkID(account.ID, params["id"]); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	account.ID = params["id"]
+	if len(account.ID) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := db.CreateAccount(&account); err != nil {
+		if err.Error() == "resource exists" {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if err == data.ErrWrongOrganisation {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error saving new account: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Update an existing account resource
+func (a *Accounts) Update(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(a.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	var account data.Account
+	if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := decode(r, &account); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding update account request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkID(account.ID, params["id"]); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	account.ID = params["id"]
+	if err := db.UpdateAccount(&account); err != nil {
+		if err == data.ErrAccountInUse {
+			w.WriteHeader(http.StatusConflict)
+		} else if err.Error() == ErrNotFound.Error() || err == data.ErrWrongOrganisation {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error saving account: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Delete a account resource
+func (a *Accounts) Delete(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(a.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	if err := db.DeleteAccount(params["id"]); err != nil {
+		if err == data.ErrAccountInUse {
+			w.WriteHeader(http.StatusConflict)
+		} else if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error deleting account: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Balance shows the balance of an account derived from the ledger
+func (a *Accounts) Balance(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(a.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	bal, err := db.FetchAccountBalance(params["id"])
+	if err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error getting account balance: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	writeResource(w, r, http.StatusOK, bal)
+}
+
+// Entries lists the ledger entries posted to an account
+func (a *Accounts) Entries(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(a.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	entries, err := db.FetchLedgerEntries(params["id"])
+	if err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error getting ledger entries: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	writeCollection(w, r, entries)
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/gorilla/mux"
+)
+
+var debtorAccountJSON = `{
+	"type": "Account",
+	"organisation_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
+	"attributes": {
+		"account_name": "EJ Brown Black",
+		"account_number": "GB29XABC10161234567801",
+		"bank_id": "203301",
+		"currency": "GBP"
+	}
+}`
+
+func accountsRouter(db *data.Client) *mux.Router {
+	h := NewAccounts(db)
+	t := NewTransactions(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}/settle", t.Settle).Methods("POST")
+	router.HandleFunc("/payments/{id}/returns", t.CreateReturn).Methods("POST")
+	router.HandleFunc("/payments/{id}", NewPayments(db).Replace).Methods("PUT")
+	router.HandleFunc("/accounts", h.GetAll).Methods("GET")
+	router.HandleFunc("/accounts/{id}", h.GetOne).Methods("GET")
+	router.HandleFunc("/accounts/{id}", h.Create).Methods("PUT")
+	router.HandleFunc("/accounts/{id}", h.Update).Methods("POST")
+	router.HandleFunc("/accounts/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc("/accounts/{id}/balance", h.Balance).Methods("GET")
+	router.HandleFunc("/accounts/{id}/entries", h.Entries).Methods("GET")
+	return router
+}
+
+func getBalance(t *testing.T, router *mux.Router, id string) *data.AccountBalance {
+	req, err := newTestRequest("GET", "/accounts/"+id+"/balance", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+	}
+	var bal data.AccountBalance
+	if err := decodeData(rr.Body, &bal); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	return &bal
+}
+
+func TestSettlePaymentPostsToLedger(t *testing.T) {
+	accountID := "c6e3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := accountsRouter(db)
+
+	req, err := newTestRequest("PUT", "/accounts/"+accountID, strings.NewReader(debtorAccountJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+	createTestPayment(t, db, id)
+
+	// Settle the payment, then make sure it cannot be settled twice
+	for _, expected := range []int{http.StatusOK, http.StatusConflict} {
+		req, err = newTestRequest("POST", "/payments/"+id+"/settle", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, expected)
+		}
+	}
+
+	// The debtor pays 100.21 GBP plus 5.00 GBP and 10.00 USD of sender charges
+	bal := getBalance(t, router, accountID)
+	if bal.Balances["GBP"] != "-105.21" || bal.Balances["USD"] != "-10.00" || bal.Entries != 3 {
+		t.Fatalf("handler returned unexpected debtor balance: %+v", bal)
+	}
+
+	// The charges are credited to the organisation's fees accounts
+	accs, err := db.ForOrganisation(testOrganisation).FetchAllAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fees := 0
+	for _, acc := range accs {
+		if acc.Attributes.AccountType == data.AccountFees {
+			fees++
+			bal = getBalance(t, router, acc.ID)
+			if amt := bal.Balances[acc.Attributes.Currency]; amt != "5.00" && amt != "10.00" {
+				t.Fatalf("handler returned unexpected fees balance: %+v", bal)
+			}
+		}
+	}
+	if fees != 2 {
+		t.Fatalf("settlement created %d fees accounts, we wanted 2", fees)
+	}
+
+	// Returning part of the settled payment credits the debtor again
+	req, err = newTestRequest("POST", "/payments/"+id+"/returns", strings.NewReader(`{"attributes":{"amount":"50.00"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+	bal = getBalance(t, router, accountID)
+	if bal.Balances["GBP"] != "-55.21" || bal.Entries != 4 {
+		t.Fatalf("handler returned unexpected debtor balance: %+v", bal)
+	}
+
+	// Accounts with entries cannot be deleted
+	req, err = newTestRequest("DELETE", "/accounts/"+accountID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusConflict)
+	}
+
+	// Nor can they be renumbered, though they may be renamed
+	for _, change := range []struct {
+		from, to string
+		code     int
+	}{
+		{"GB29XABC10161234567801", "GB29XABC10161234567899", http.StatusConflict},
+		{"EJ Brown Black", "EJ Brown", http.StatusOK},
+	} {
+		body := strings.Replace(debtorAccountJSON, change.from, change.to, 1)
+		req, err = newTestRequest("POST", "/accounts/"+accountID, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != change.code {
+			t.Errorf("changing %s: handler returned wrong status code: got '%v' want '%v'", change.from, status, change.code)
+		}
+	}
+
+	// The money a settled payment moves is fixed, but not its reference
+	for _, change := range []struct {
+		from, to string
+		code     int
+	}{
+		{`"amount": "100.21"`, `"amount": "200.21"`, http.StatusConflict},
+		{`"account_number": "GB29XABC10161234567801"`, `"account_number": "GB29XABC10161234567899"`,
+			http.StatusConflict},
+		{`"reference": "Payment for Em's piano lessons"`, `"reference": "Piano lessons"`, http.StatusOK},
+	} {
+		if !strings.Contains(exampleJSON, change.from) {
+			t.Fatalf("example payment has no %s", change.from)
+		}
+		body := strings.Replace(exampleJSON, change.from, change.to, 1)
+		req, err = newTestRequest("PUT", "/payments/"+id, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != change.code {
+			t.Errorf("changing %s: handler returned wrong status code: got '%v' want '%v'", change.from, status, change.code)
+		}
+	}
+	pmt, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmt.Attributes.Amount != "100.21" || pmt.Attributes.Status != data.StatusPartiallyReturned {
+		t.Errorf("unexpected payment after changes: %s %s", pmt.Attributes.Amount, pmt.Attributes.Status)
+	}
+}
+
+func TestSettlePaymentNoDebtorAccount(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+
+	req, err := newTestRequest("POST", "/payments/"+id+"/settle", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	accountsRouter(db).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusConflict)
+	}
+	pmt, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmt.Attributes.Status != data.StatusPending {
+		t.Fatalf("payment has status '%s', we expected '%s'", pmt.Attributes.Status, data.StatusPending)
+	}
+}
+
+func TestGetAccountEntriesNotFound(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+
+	req, err := newTestRequest("GET", "/accounts/foobar/entries", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	accountsRouter(db).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusNotFound)
+	}
+}
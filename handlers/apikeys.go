@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+	"github.com/gorilla/mux"
+)
+
+// APIKeys handlers for issuing and revoking an organisation's API keys, which
+// are restricted to super-admins
+type APIKeys struct {
+	db *data.Client
+}
+
+// NewAPIKeys returns new handler with database client
+func NewAPIKeys(db *data.Client) *APIKeys {
+	return &APIKeys{db: db}
+}
+
+// apiKey is what callers see of a key. The secret is only included when the
+// key is issued and the stored hash never is.
+type apiKey struct {
+	ID             string     `json:"id"`
+	OrganisationID string     `json:"organisation_id"`
+	Name           string     `json:"name"`
+	Roles          []string   `json:"roles"`
+	Key            string     `json:"key,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+}
+
+func newAPIKeyView(key *data.APIKey) *apiKey {
+	return &apiKey{
+		ID:             key.ID,
+		OrganisationID: key.OrganisationID,
+		Name:           key.Name,
+		Roles:          key.Roles,
+		CreatedAt:      key.CreatedAt,
+		LastUsedAt:     key.LastUsedAt,
+		RevokedAt:      key.RevokedAt,
+	}
+}
+
+// List shows the keys issued to an organisation
+func (k *APIKeys) List(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !isSuperAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	keys, err := k.db.WithContext(r.Context()).FetchAPIKeys(params["id"])
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Error getting API keys: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	views := []*apiKey{}
+	for _, key := range keys {
+		views = append(views, newAPIKeyView(key))
+	}
+	writeCollection(w, r, views)
+}
+
+// Issue a new key to an organisation, the response holds the only copy of it
+func (k *APIKeys) Issue(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !isSuperAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var req apiKey
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := decode(r, &req); err != nil {
+			logging.FromContext(r.Context()).Errorf("Error decoding issue API key request: %s", err)
+			writeBodyError(w, err)
+			return
+		}
+	}
+	key, secret, err := auth.NewAPIKey(params["id"], req.Name, req.Roles)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Error generating API key: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := k.db.WithContext(r.Context()).CreateAPIKey(key); err != nil {
+		if err == data.ErrTooManyAPIKeys {
+			w.WriteHeader(http.StatusConflict)
+		} else if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error saving API key: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	view := newAPIKeyView(key)
+	view.Key = secret
+	writeResource(w, r, http.StatusCreated, view)
+}
+
+// Revoke one of an organisation's keys
+func (k *APIKeys) Revoke(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !isSuperAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := k.db.WithContext(r.Context()).RevokeAPIKey(params["id"], params["key"]); err != nil {
+		if err == data.ErrAPIKeyRevoked {
+			w.WriteHeader(http.StatusConflict)
+		} else if err.Error() == ErrNotFound.Error() || err == data.ErrWrongOrganisation {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error revoking API key: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+func apiKeysRouter(db *data.Client) *mux.Router {
+	h := NewAPIKeys(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/organisations/{id}/keys", h.List).Methods("GET")
+	router.HandleFunc("/organisations/{id}/keys", h.Issue).Methods("POST")
+	router.HandleFunc("/organisations/{id}/keys/{key}", h.Revoke).Methods("DELETE")
+	return router
+}
+
+func issueTestKey(t *testing.T, router *mux.Router, expected int) *apiKey {
+	req, err := newRequestAs(superAdmin, "POST", "/organisations/"+testOrganisation+"/keys",
+		strings.NewReader(`{"name":"reporting"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != expected {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", status, expected)
+	}
+	var key apiKey
+	if expected == http.StatusCreated {
+		if err := decodeData(rr.Body, &key); err != nil {
+			t.Fatal("unable to decode response into JSON")
+		}
+	}
+	return &key
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := apiKeysRouter(db)
+
+	// A protected endpoint to try the keys against
+	payments := mux.NewRouter()
+	payments.HandleFunc("/payments", NewPayments(db).GetAll)
+	payments.Use(auth.Middleware(auth.NewAPIKeys(db)))
+	get := func(key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/payments", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		payments.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Two keys may be active at once, but not three
+	old := issueTestKey(t, router, http.StatusCreated)
+	current := issueTestKey(t, router, http.StatusCreated)
+	issueTestKey(t, router, http.StatusConflict)
+	if !strings.HasPrefix(old.Key, auth.APIKeyPrefix) || old.OrganisationID != testOrganisation {
+		t.Fatalf("handler returned unexpected key: %+v", old)
+	}
+	for _, key := range []string{old.Key, current.Key} {
+		if status := get(key).Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+		}
+	}
+
+	// Revoke the old key and check it is refused with a problem response
+	req, err := newRequestAs(superAdmin, "DELETE", "/organisations/"+testOrganisation+"/keys/"+old.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+	}
+	rr = get(old.Key)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusUnauthorized)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != problem.ContentType {
+		t.Errorf("handler returned wrong content type: got '%s' want '%s'", ct, problem.ContentType)
+	}
+	if status := get(current.Key[:len(current.Key)-1]).Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusUnauthorized)
+	}
+
+	// Listing shows when keys were used and never the secret or its hash
+	req, err = newRequestAs(superAdmin, "GET", "/organisations/"+testOrganisation+"/keys", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if body := rr.Body.String(); strings.Contains(body, "hash") || strings.Contains(body, current.Key) {
+		t.Fatalf("handler leaked key material: %s", body)
+	}
+	var keys []*apiKey
+	if err := decodeData(rr.Body, &keys); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if len(keys) != 2 {
+		t.Fatalf("handler returned %d keys, we wanted 2", len(keys))
+	}
+	for _, key := range keys {
+		if key.LastUsedAt == nil {
+			t.Errorf("key %s has no last used time", key.ID)
+		}
+	}
+}
+
+func TestIssueAPIKeyRequiresSuperAdmin(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+
+	req, err := newTestRequest("POST", "/organisations/"+testOrganisation+"/keys", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	apiKeysRouter(db).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusForbidden)
+	}
+}
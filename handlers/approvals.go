@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+	"github.com/gorilla/mux"
+)
+
+// Approval decisions
+const (
+	DecisionApprove = "approve"
+	DecisionReject  = "reject"
+)
+
+// Approval is a request to approve or reject a payment
+type Approval struct {
+	Decision string `json:"decision" openapi:"required,enum=approve|reject"`
+	Comment  string `json:"comment"`
+}
+
+// ListApprovals shows the approvals and rejections of a payment
+func (t *Transactions) ListApprovals(w http.ResponseWriter, r *http.Request) {
+	t.events(w, r, func(db *data.Client, id string) ([]*data.PaymentEvent, error) {
+		return db.FetchPaymentApprovals(id)
+	})
+}
+
+// History shows everything which has happened to a payment
+func (t *Transactions) History(w http.ResponseWriter, r *http.Request) {
+	t.events(w, r, func(db *data.Client, id string) ([]*data.PaymentEvent, error) {
+		return db.FetchPaymentHistory(id)
+	})
+}
+
+func (t *Transactions) events(w http.ResponseWriter, r *http.Request,
+	fetch func(*data.Client, string) ([]*data.PaymentEvent, error)) {
+	db, status := scope(t.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	events, err := fetch(db, params["id"])
+	if err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error getting payment history: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	writeCollection(w, r, events)
+}
+
+// Approve records the caller's decision on a payment awaiting approval. The
+// caller must not be the user who created or last changed the payment.
+func (t *Transactions) Approve(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(t.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	var approval Approval
+	if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := decode(r, &approval); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding approval request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	params := mux.Vars(r)
+	var event *data.PaymentEvent
+	var err error
+	switch approval.Decision {
+	case DecisionApprove:
+		event, err = db.ApprovePayment(params["id"], approval.Comment)
+	case DecisionReject:
+		event, err = db.RejectPayment(params["id"], approval.Comment)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		switch err {
+		case data.ErrSelfApproval, data.ErrNoActor:
+			w.WriteHeader(http.StatusForbidden)
+		case data.ErrNotAwaitingApproval, data.ErrAlreadyApproved:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			if err.Error() == ErrNotFound.Error() {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				logging.FromContext(r.Context()).Errorf("Error approving payment: %s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+		return
+	}
+	writeResource(w, r, http.StatusCreated, event)
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/data"
+	"github.com/gorilla/mux"
+)
+
+// requireApprovals makes payments over 100 GBP in testOrganisation need approvals
+func requireApprovals(t *testing.T, db *data.Client, approvals int) {
+	org := &data.Organisation{
+		ID: testOrganisation,
+		Attributes: &data.OrganisationAttributes{
+			Name:               "Test",
+			ApprovalThresholds: map[string]json.Number{"GBP": "100"},
+			RequiredApprovals:  approvals,
+		},
+	}
+	if err := db.UpdateOrganisation(org); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func approvalsRouter(db *data.Client) *mux.Router {
+	router := transactionsRouter(db)
+	h := NewTransactions(db)
+	router.HandleFunc("/payments/{id}/approvals", h.ListApprovals).Methods("GET")
+	router.HandleFunc("/payments/{id}/approvals", h.Approve).Methods("POST")
+	router.HandleFunc("/payments/{id}/history", h.History).Methods("GET")
+	return router
+}
+
+func decide(t *testing.T, router *mux.Router, subject, id, body string) *httptest.ResponseRecorder {
+	p := &auth.Principal{Subject: subject, OrganisationID: testOrganisation}
+	req, err := newRequestAs(p, "POST", "/payments/"+id+"/approvals", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestApprovePayment(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	requireApprovals(t, db, 2)
+	createTestPayment(t, db, id)
+	router := approvalsRouter(db)
+	scoped := db.ForOrganisation(testOrganisation)
+
+	pmt, err := scoped.FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmt.Attributes.Status != data.StatusPendingApproval {
+		t.Fatalf("payment has status '%s', we expected '%s'", pmt.Attributes.Status, data.StatusPendingApproval)
+	}
+
+	approve := `{"decision":"approve","comment":"Checked"}`
+	for _, step := range []struct {
+		subject string
+		code    int
+		status  string
+	}{
+		// The maker cannot approve their own payment
+		{"test", http.StatusForbidden, data.StatusPendingApproval},
+		{"alice", http.StatusCreated, data.StatusPendingApproval},
+		// Nor can one approver count twice
+		{"alice", http.StatusConflict, data.StatusPendingApproval},
+		{"bob", http.StatusCreated, data.StatusPending},
+		{"carol", http.StatusConflict, data.StatusPending},
+	} {
+		rr := decide(t, router, step.subject, id, approve)
+		if status := rr.Code; status != step.code {
+			t.Errorf("handler returned wrong status code for %s: got '%v' want '%v'", step.subject, status, step.code)
+		}
+		pmt, err := scoped.FetchPayment(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pmt.Attributes.Status != step.status {
+			t.Errorf("payment has status '%s' after %s, we expected '%s'", pmt.Attributes.Status, step.subject, step.status)
+		}
+	}
+
+	// The approvals are recorded in the payment's history
+	req, err := newTestRequest("GET", "/payments/"+id+"/history", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var history []*data.PaymentEvent
+	if err := decodeData(rr.Body, &history); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	var kinds, actors []string
+	for _, e := range history {
+		kinds = append(kinds, e.Kind)
+		actors = append(actors, e.Actor)
+	}
+	if strings.Join(kinds, ",") != "created,approved,approved" || strings.Join(actors, ",") != "test,alice,bob" {
+		t.Errorf("unexpected history: %v by %v", kinds, actors)
+	}
+	if history[1].Comment != "Checked" {
+		t.Errorf("approval has comment '%s', we expected 'Checked'", history[1].Comment)
+	}
+}
+
+func TestRejectPayment(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	requireApprovals(t, db, 1)
+	createTestPayment(t, db, id)
+	router := approvalsRouter(db)
+
+	rr := decide(t, router, "alice", id, `{"decision":"reject","comment":"Wrong beneficiary"}`)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+	var event data.PaymentEvent
+	if err := decodeData(rr.Body, &event); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if event.Kind != data.EventRejected || event.Status != data.StatusRejected {
+		t.Errorf("handler returned unexpected event: %+v", event)
+	}
+
+	// A rejected payment cannot be approved or returned
+	rr = decide(t, router, "bob", id, `{"decision":"approve"}`)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusConflict)
+	}
+	req, err := newTestRequest("POST", "/payments/"+id+"/reversals", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusConflict)
+	}
+}
+
+func TestApprovePaymentBelowThreshold(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	router := approvalsRouter(db)
+
+	// Without a threshold the payment never waits for approval
+	rr := decide(t, router, "alice", id, `{"decision":"approve"}`)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusConflict)
+	}
+	rr = decide(t, router, "alice", id, `{"decision":"maybe"}`)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/adampointer/restservice/problem"
+	"github.com/adampointer/restservice/tracing"
+)
+
+// BodyError is a request body which cannot be accepted, and the status to
+// refuse it with
+type BodyError struct {
+	Status int
+	Detail string
+}
+
+func (e *BodyError) Error() string {
+	return e.Detail
+}
+
+// LimitBody refuses request bodies larger than max bytes with 413, up front
+// when they declare their length and otherwise once max has been read
+func LimitBody(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > max {
+				problem.Write(w, http.StatusRequestEntityTooLarge, tooLarge(max))
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decode reads the JSON body of a request into v, traced as its own span.
+// The body must be declared as JSON, hold a single value and have no fields
+// which v does not. Errors are a *BodyError.
+func decode(r *http.Request, v interface{}) error {
+	_, span := tracing.Start(r.Context(), "json.decode")
+	defer span.Finish()
+	err := decodeJSON(r, v)
+	span.SetError(err)
+	return err
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	if err := jsonContentType(r); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(r.Body)
+	var body json.RawMessage
+	if err := dec.Decode(&body); err != nil {
+		return bodyError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err != nil {
+			return bodyError(err)
+		}
+		return &BodyError{Status: http.StatusBadRequest, Detail: "unexpected data after the JSON body"}
+	}
+	body, err := unwrap(body)
+	if err != nil {
+		return err
+	}
+	return decodeStrict(body, v)
+}
+
+// unwrap returns the resource of a body sent in the envelope of a response
+// document, {"data": ...}, or otherwise the body itself
+func unwrap(body []byte) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if json.Unmarshal(body, &members) != nil {
+		return body, nil
+	}
+	data, ok := members["data"]
+	if !ok {
+		return body, nil
+	}
+	for name := range members {
+		if name != "data" && name != "meta" {
+			return nil, &BodyError{Status: http.StatusBadRequest,
+				Detail: fmt.Sprintf("unknown member %q alongside data", name)}
+		}
+	}
+	return data, nil
+}
+
+// decodeStrict decodes JSON into v, refusing fields which v does not have
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return bodyError(err)
+	}
+	return nil
+}
+
+// jsonContentType requires application/json or another JSON media type, such
+// as application/vnd.api+json
+func jsonContentType(r *http.Request) error {
+	ct := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+	detail := "Content-Type must be application/json"
+	if len(ct) > 0 {
+		detail = fmt.Sprintf("Content-Type %q is not supported, use application/json", ct)
+	}
+	return &BodyError{Status: http.StatusUnsupportedMediaType, Detail: detail}
+}
+
+// bodyError explains why a body could not be decoded
+func bodyError(err error) *BodyError {
+	if tooBig, ok := err.(*http.MaxBytesError); ok {
+		return &BodyError{Status: http.StatusRequestEntityTooLarge, Detail: tooLarge(tooBig.Limit)}
+	}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return &BodyError{Status: http.StatusBadRequest,
+			Detail: fmt.Sprintf("malformed JSON at byte %d: %s", e.Offset, e)}
+	case *json.UnmarshalTypeError:
+		return &BodyError{Status: http.StatusBadRequest,
+			Detail: fmt.Sprintf("%s must be %s, not %s", e.Field, e.Type, e.Value)}
+	}
+	if err == io.EOF {
+		return &BodyError{Status: http.StatusBadRequest, Detail: "a JSON body is required"}
+	}
+	if err == io.ErrUnexpectedEOF {
+		return &BodyError{Status: http.StatusBadRequest, Detail: "the JSON body ends unexpectedly"}
+	}
+	return &BodyError{Status: http.StatusBadRequest, Detail: strings.TrimPrefix(err.Error(), "json: ")}
+}
+
+// checkID refuses a body which names a resource other than the one in the
+// path, rather than quietly using the path's
+func checkID(bodyID, pathID string) error {
+	if len(bodyID) > 0 && bodyID != pathID {
+		return &BodyError{Status: http.StatusBadRequest,
+			Detail: fmt.Sprintf("id %q in the body does not match %q in the path", bodyID, pathID)}
+	}
+	return nil
+}
+
+// writeBodyError refuses a request whose body could not be accepted
+func writeBodyError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*BodyError); ok {
+		problem.Write(w, e.Status, e.Detail)
+		return
+	}
+	problem.Write(w, http.StatusBadRequest, err.Error())
+}
+
+func tooLarge(max int64) string {
+	return fmt.Sprintf("request body is larger than %d bytes", max)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+func TestCreatePaymentRejectedBodies(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	db := getTestDB(t)
+	defer cleanUp(db)
+	h := NewPayments(db)
+	router := mux.NewRouter()
+	router.Use(LimitBody(256))
+	router.HandleFunc("/payments/{id}", h.Replace).Methods("PUT")
+
+	valid := `{"attributes": {"amount": "10.00", "currency": "GBP"}}`
+	for _, test := range []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		detail      string
+	}{
+		{"no content type", "", valid, http.StatusUnsupportedMediaType, "Content-Type must be application/json"},
+		{"form", "application/x-www-form-urlencoded", valid, http.StatusUnsupportedMediaType, "is not supported"},
+		{"too large", "application/json", `{"attributes": {"reference": "` + strings.Repeat("x", 256) + `"}}`,
+			http.StatusRequestEntityTooLarge, "larger than 256 bytes"},
+		{"unknown field", "application/json", `{"attributes": {"amount": "10.00", "amuont": "1"}}`,
+			http.StatusBadRequest, `unknown field "amuont"`},
+		{"trailing data", "application/json", valid + `{}`, http.StatusBadRequest, "unexpected data after"},
+		{"malformed", "application/json", `{"attributes": `, http.StatusBadRequest, "ends unexpectedly"},
+		{"wrong type", "application/json", `{"attributes": []}`, http.StatusBadRequest, "attributes must be"},
+		{"other id", "application/json; charset=utf-8", `{"id": "216d4da9-e59a-4cc6-8df3-3da6e7580b77"}`,
+			http.StatusBadRequest, "does not match"},
+	} {
+		req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", test.contentType)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var p problem.Problem
+		if rr.Code != test.status {
+			t.Errorf("%s: handler returned wrong status code: got '%v' want '%v'", test.name, rr.Code, test.status)
+		} else if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || !strings.Contains(p.Detail, test.detail) {
+			t.Errorf("%s: problem '%s' does not mention '%s'", test.name, p.Detail, test.detail)
+		}
+	}
+
+	// The same ID as the path is fine, and nothing was saved before
+	req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(`{"id": "`+id+`", `+valid[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusCreated)
+	}
+}
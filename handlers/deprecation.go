@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Deprecated marks the responses of a route which is being withdrawn with a
+// Deprecation header (RFC 9745) giving when it was deprecated, and a Link to
+// the documentation of what replaces it
+func Deprecated(since time.Time, successor string, next http.HandlerFunc) http.HandlerFunc {
+	deprecation := fmt.Sprintf("@%d", since.Unix())
+	link := fmt.Sprintf("<%s>; rel=\"deprecation\"", successor)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", deprecation)
+		w.Header().Add("Link", link)
+		next(w, r)
+	}
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/adampointer/restservice/problem"
+)
+
+// Sizes of the pages of a collection, chosen with page[size]
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// Document is the envelope of every response body which is not a problem,
+// after JSON:API. Data is a resource, or a page of a collection, with any
+// related resources asked for with ?include= alongside it.
+type Document struct {
+	Data     interface{}   `json:"data"`
+	Included []interface{} `json:"included,omitempty"`
+	Links    *Links        `json:"links,omitempty"`
+	Meta     *Meta         `json:"meta,omitempty"`
+}
+
+// Links to a document and, for a collection, its other pages
+type Links struct {
+	Self  string `json:"self" openapi:"required"`
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+// Meta describes the page of a collection in a document
+type Meta struct {
+	Total    int `json:"total"`
+	Page     int `json:"page"`
+	PageSize int `json:"page_size"`
+}
+
+// resource wraps a single resource in a document linking to it, which is the
+// Location of a resource just created
+func resource(w http.ResponseWriter, r *http.Request, v interface{}) *Document {
+	self := r.URL.RequestURI()
+	if location := w.Header().Get("Location"); len(location) > 0 {
+		self = location
+	}
+	return &Document{Data: v, Links: &Links{Self: self}}
+}
+
+// collection wraps the page of items, a slice, chosen by the page[number]
+// and page[size] query parameters in a document linking to the other pages
+func collection(r *http.Request, items interface{}) (*Document, error) {
+	query := r.URL.Query()
+	number, err := pageParam(query.Get("page[number]"), 1, "page[number]")
+	if err != nil {
+		return nil, err
+	}
+	size, err := pageParam(query.Get("page[size]"), DefaultPageSize, "page[size]")
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxPageSize {
+		return nil, fmt.Errorf("page[size] must be no more than %d", MaxPageSize)
+	}
+
+	all := reflect.ValueOf(items)
+	total := all.Len()
+	last := (total + size - 1) / size
+	if last == 0 {
+		last = 1
+	}
+	// Pages past the last are empty, without multiplying out a page number
+	// which may be as large as an int
+	from, to := total, total
+	if number <= last {
+		from, to = (number-1)*size, number*size
+		if to > total {
+			to = total
+		}
+	}
+	page := all.Slice(from, to)
+	if page.IsNil() {
+		// An empty collection is [] rather than null
+		page = reflect.MakeSlice(all.Type(), 0, 0)
+	}
+
+	link := func(n int) string {
+		u := *r.URL
+		q := u.Query()
+		q.Set("page[number]", strconv.Itoa(n))
+		q.Set("page[size]", strconv.Itoa(size))
+		u.RawQuery = q.Encode()
+		return u.RequestURI()
+	}
+	links := &Links{Self: r.URL.RequestURI(), First: link(1), Last: link(last)}
+	if number > 1 {
+		links.Prev = link(number - 1)
+		if number > last {
+			links.Prev = link(last)
+		}
+	}
+	if number < last {
+		links.Next = link(number + 1)
+	}
+	return &Document{
+		Data:  page.Interface(),
+		Links: links,
+		Meta:  &Meta{Total: total, Page: number, PageSize: size},
+	}, nil
+}
+
+func pageParam(value string, def int, name string) (int, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a whole number of at least 1", name)
+	}
+	return n, nil
+}
+
+// readInclude returns the related resources asked for with ?include=, which
+// must be among those allowed
+func readInclude(r *http.Request, allowed ...string) (map[string]bool, error) {
+	include := make(map[string]bool)
+	value := r.URL.Query().Get("include")
+	if len(value) == 0 {
+		return include, nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		found := false
+		for _, a := range allowed {
+			found = found || name == a
+		}
+		if !found {
+			return nil, fmt.Errorf("cannot include %q, only: %s", name, strings.Join(allowed, ", "))
+		}
+		include[name] = true
+	}
+	return include, nil
+}
+
+// writeDocument sends a document as the body of a response
+func writeDocument(w http.ResponseWriter, status int, doc *Document) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// writeResource sends a single resource
+func writeResource(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	writeDocument(w, status, resource(w, r, v))
+}
+
+// writeCollection sends the page of items, a slice, asked for by the query
+func writeCollection(w http.ResponseWriter, r *http.Request, items interface{}) {
+	doc, err := collection(r, items)
+	if err != nil {
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeDocument(w, http.StatusOK, doc)
+}
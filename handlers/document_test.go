@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPaymentsDocuments(t *testing.T) {
+	partyID := "b6e3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	ids := []string{
+		"216d4da9-e59a-4cc6-8df3-3da6e7580b77",
+		"4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43",
+		"97fe60ba-1334-439f-91db-32cc3cde036a",
+	}
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	h := NewPayments(db)
+	router := partiesRouter(db)
+	router.HandleFunc("/payments", h.GetAll).Methods("GET")
+	router.HandleFunc("/payments/{id}", h.GetOne).Methods("GET")
+	router.HandleFunc("/payments/{id}", h.Replace).Methods("PUT")
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		var req *http.Request
+		var err error
+		if len(body) > 0 {
+			req, err = newTestRequest(method, url, strings.NewReader(body))
+		} else {
+			req, err = newTestRequest(method, url, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve("PUT", "/parties/"+partyID, partyJSON); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusCreated)
+	}
+	// Payments may be sent in the envelope they are returned in
+	for _, id := range ids {
+		body := `{"data": ` + paymentWithPartyRef(t, partyID) + `, "meta": {}}`
+		if rr := serve("PUT", "/payments/"+id, body); rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusCreated)
+		}
+	}
+	if rr := serve("PUT", "/payments/"+ids[0], `{"data": {}, "links": {}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusBadRequest)
+	}
+
+	// The last page of two
+	rr := serve("GET", "/payments?page[number]=2&page[size]=2", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusOK)
+	}
+	var doc Document
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if page, ok := doc.Data.([]interface{}); !ok || len(page) != 1 || page[0].(map[string]interface{})["id"] != ids[2] {
+		t.Errorf("handler returned unexpected page %v", doc.Data)
+	}
+	if *doc.Meta != (Meta{Total: 3, Page: 2, PageSize: 2}) {
+		t.Errorf("handler returned unexpected meta %+v", doc.Meta)
+	}
+	links := Links{
+		Self:  "/payments?page[number]=2&page[size]=2",
+		First: "/payments?page%5Bnumber%5D=1&page%5Bsize%5D=2",
+		Prev:  "/payments?page%5Bnumber%5D=1&page%5Bsize%5D=2",
+		Last:  "/payments?page%5Bnumber%5D=2&page%5Bsize%5D=2",
+	}
+	if *doc.Links != links {
+		t.Errorf("handler returned links %+v, we expected %+v", doc.Links, links)
+	}
+
+	// A payment and the party it references, once
+	rr = serve("GET", "/payments/"+ids[1]+"?include=parties,returns", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusOK)
+	}
+	doc = Document{}
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if doc.Links.Self != "/payments/"+ids[1]+"?include=parties,returns" ||
+		doc.Data.(map[string]interface{})["id"] != ids[1] {
+		t.Errorf("handler returned unexpected document %+v", doc)
+	}
+	if len(doc.Included) != 1 || doc.Included[0].(map[string]interface{})["id"] != partyID {
+		t.Errorf("handler included %v, we expected party %s", doc.Included, partyID)
+	}
+	rr = serve("GET", "/payments?include=parties", "")
+	doc = Document{}
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if len(doc.Included) != 1 {
+		t.Errorf("handler included %d resources for the same party, we expected 1", len(doc.Included))
+	}
+
+	for _, url := range []string{
+		"/payments?page[size]=0",
+		"/payments?page[size]=1001",
+		"/payments?page[number]=first",
+		"/payments?include=accounts",
+		"/payments/" + ids[0] + "?include=parties,history",
+	} {
+		if rr := serve("GET", url, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: handler returned wrong status code: got '%v' want '%v'", url, rr.Code,
+				http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCollectionPastTheEnd(t *testing.T) {
+	req := httptest.NewRequest("GET", "/parties?page[number]=5", nil)
+	doc, err := collection(req, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page := doc.Data.([]string); len(page) != 0 || page == nil {
+		t.Errorf("page past the end is %#v, we expected []", page)
+	}
+	if len(doc.Links.Next) > 0 || doc.Links.Prev != "/parties?page%5Bnumber%5D=1&page%5Bsize%5D=100" {
+		t.Errorf("unexpected links past the end %+v", doc.Links)
+	}
+
+	// Far enough past the end that the offset of the page would overflow
+	req = httptest.NewRequest("GET", "/parties?page[number]=9223372036854775807&page[size]=2", nil)
+	if doc, err = collection(req, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if page := doc.Data.([]string); len(page) != 0 {
+		t.Errorf("page past the end is %#v, we expected []", page)
+	}
+}
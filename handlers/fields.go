@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// fieldTree is a sparse fieldset, the attributes of a type of resource chosen
+// with ?fields[type]=amount,beneficiary_party.name. Each chosen attribute
+// maps to those chosen from within it, or to nil when it is chosen whole.
+type fieldTree map[string]fieldTree
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// readFields returns the sparse fieldset chosen for a type of resource, whose
+// attributes are a struct of type attributes, or nil to return them all.
+// Names are checked against the JSON names of the struct's fields, and no
+// other type may have fields chosen.
+func readFields(r *http.Request, typ string, attributes reflect.Type) (fieldTree, error) {
+	param := "fields[" + typ + "]"
+	query := r.URL.Query()
+	for key := range query {
+		if strings.HasPrefix(key, "fields[") && key != param {
+			return nil, fmt.Errorf("%s cannot be chosen here, only %s", key, param)
+		}
+	}
+	values, ok := query[param]
+	if !ok {
+		return nil, nil
+	}
+	fields := make(fieldTree)
+	for _, name := range strings.Split(strings.Join(values, ","), ",") {
+		if len(name) == 0 {
+			continue
+		}
+		path := strings.Split(name, ".")
+		if !hasField(attributes, path) {
+			return nil, fmt.Errorf("%s has no field %q", typ, name)
+		}
+		fields.add(path)
+	}
+	return fields, nil
+}
+
+// hasField reports whether the JSON of a struct type has the member at path
+func hasField(t reflect.Type, path []string) bool {
+	for _, name := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || t.Implements(marshalerType) {
+			return false
+		}
+		f, ok := jsonField(t, name)
+		if !ok {
+			return false
+		}
+		t = f.Type
+	}
+	return true
+}
+
+// jsonField finds the field of a struct type encoded as name
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == name || (len(tag) == 0 && f.Name == name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func (f fieldTree) add(path []string) {
+	sub, chosen := f[path[0]]
+	if len(path) == 1 {
+		f[path[0]] = nil
+		return
+	}
+	if chosen && sub == nil {
+		// Already chosen whole
+		return
+	}
+	if sub == nil {
+		sub = make(fieldTree)
+		f[path[0]] = sub
+	}
+	sub.add(path[1:])
+}
+
+// project returns the chosen fields of a struct, or a pointer to one, as a
+// map encoded with the same names. Fields within a nil struct are left out.
+func (f fieldTree) project(v interface{}) map[string]interface{} {
+	return f.projectValue(reflect.ValueOf(v))
+}
+
+func (f fieldTree) projectValue(v reflect.Value) map[string]interface{} {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	out := make(map[string]interface{}, len(f))
+	for name, sub := range f {
+		field, _ := jsonField(v.Type(), name)
+		value := v.FieldByIndex(field.Index)
+		if sub == nil {
+			out[name] = value.Interface()
+		} else if projected := sub.projectValue(value); projected != nil {
+			out[name] = projected
+		}
+	}
+	return out
+}
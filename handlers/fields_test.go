@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPaymentFields(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	h := NewPayments(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", h.GetAll).Methods("GET")
+	router.HandleFunc("/payments/{id}", h.GetOne).Methods("GET")
+	get := func(url string) *httptest.ResponseRecorder {
+		req, err := newTestRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// data decodes the first payment of a response, keeping numbers as written
+	data := func(rr *httptest.ResponseRecorder) map[string]interface{} {
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusOK)
+		}
+		var doc struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+			t.Fatal("unable to decode response into JSON")
+		}
+		dec := json.NewDecoder(strings.NewReader(strings.TrimSuffix(strings.TrimPrefix(string(doc.Data), "["), "]")))
+		dec.UseNumber()
+		var pmt map[string]interface{}
+		if err := dec.Decode(&pmt); err != nil {
+			t.Fatal(err)
+		}
+		return pmt
+	}
+
+	want := map[string]interface{}{
+		"type":            "Payment",
+		"id":              id,
+		"version":         json.Number("0"),
+		"organisation_id": testOrganisation,
+		"attributes": map[string]interface{}{
+			"amount":            json.Number("100.21"),
+			"currency":          "GBP",
+			"status":            "pending",
+			"beneficiary_party": map[string]interface{}{"name": "Wilfred Jeremiah Owens"},
+		},
+	}
+	fields := "?fields[payments]=amount,currency,status,beneficiary_party.name,beneficiary_party.name"
+	for _, url := range []string{"/payments/" + id + fields, "/payments" + fields} {
+		if got := data(get(url)); !reflect.DeepEqual(got, want) {
+			t.Errorf("GET %s: handler returned %v, we expected %v", url, got, want)
+		}
+	}
+
+	// A party chosen whole as well as a field of it is returned whole
+	attrs := data(get("/payments/" + id + "?fields[payments]=debtor_party.name,debtor_party,fx.exchange_rate"))["attributes"]
+	want = map[string]interface{}{
+		"debtor_party": map[string]interface{}{
+			"account_name":        "EJ Brown Black",
+			"account_number":      "GB29XABC10161234567801",
+			"account_number_code": "IBAN",
+			"account_type":        json.Number("0"),
+			"address":             "10 Debtor Crescent Sourcetown NE1",
+			"bank_id":             "203301",
+			"bank_id_code":        "GBDSC",
+			"name":                "Emelia Jane Brown",
+		},
+		"fx": map[string]interface{}{"exchange_rate": json.Number("2.00000")},
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("handler returned attributes %v, we expected %v", attrs, want)
+	}
+
+	for _, url := range []string{
+		"/payments?fields[payments]=amuont",
+		"/payments?fields[payments]=amount.value",
+		"/payments?fields[payments]=beneficiary_party..name",
+		"/payments/" + id + "?fields[parties]=name",
+	} {
+		if rr := get(url); rr.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: handler returned wrong status code: got '%v' want '%v'", url, rr.Code,
+				http.StatusBadRequest)
+		}
+	}
+}
+
+func TestFieldTreeProjectMissing(t *testing.T) {
+	type party struct {
+		Name string `json:"name"`
+	}
+	type attributes struct {
+		Amount string `json:"amount"`
+		Party  *party `json:"party"`
+		Other  *party `json:"other,omitempty"`
+	}
+	fields := make(fieldTree)
+	for _, name := range []string{"amount", "party.name", "other"} {
+		path := strings.Split(name, ".")
+		if !hasField(reflect.TypeOf(attributes{}), path) {
+			t.Fatalf("%s is not a field", name)
+		}
+		fields.add(path)
+	}
+	got := fields.project(&attributes{Amount: "1.00"})
+	want := map[string]interface{}{"amount": "1.00", "other": (*party)(nil)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("projected %#v, we expected %#v", got, want)
+	}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/openapi"
+	"github.com/adampointer/restservice/patch"
+)
+
+// Endpoints describes what each named route does, for the OpenAPI document
+func Endpoints() map[string]openapi.Endpoint {
+	payment := documentOf(data.Payment{})
+	payments := append(pageParameters(), paymentParameters()...)
+	paymentID := &openapi.Parameter{Name: "id", In: "path", Required: true,
+		Description: "a lower case UUID", Schema: &openapi.Schema{Type: "string", Format: "uuid",
+			Pattern: "^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$"}}
+	txn := bodyOf(data.LinkedTransaction{})
+	return map[string]openapi.Endpoint{
+		"payments.list": {Summary: "Returns all payments", Parameters: payments,
+			Responses: ok(collectionOf(data.Payment{}))},
+		"payments.create": {Summary: "Create a new payment with an ID chosen by the server",
+			Parameters: []*openapi.Parameter{{Name: IdempotencyKeyHeader, In: "header",
+				Description: "names the create, so that retries of it create one payment",
+				Schema:      &openapi.Schema{Type: "string"}}},
+			Body: bodyOf(data.Payment{}), Responses: created(payment)},
+		"payments.get": {Summary: "Returns payment by ID", Parameters: paymentParameters(),
+			Responses: ok(payment)},
+		"payments.replace": {Summary: "Replace a payment, or create it with the ID given",
+			Parameters: []*openapi.Parameter{paymentID}, Body: bodyOf(data.Payment{}),
+			Responses: map[int]*openapi.Schema{http.StatusOK: payment, http.StatusCreated: payment}},
+		"payments.update": {Summary: "Update a payment", Deprecated: true, Body: bodyOf(data.Payment{}),
+			Responses: ok(nil)},
+		"payments.patch": {Summary: "Change part of a payment", Body: map[string]*openapi.Schema{
+			patch.MergePatchType: {Type: "object"},
+			patch.JSONPatchType:  jsonPatch,
+		}, Responses: ok(payment)},
+		"payments.delete": {Summary: "Delete a payment with no returns, reversals or ledger entries",
+			Responses: ok(nil)},
+		"payments.settle": {Summary: "Settle a pending payment, posting it to the ledger",
+			Responses: ok(payment)},
+		"payments.history": {Summary: "Returns everything which has happened to a payment, and who did it",
+			Parameters: pageParameters(), Responses: ok(collectionOf(data.PaymentEvent{}))},
+		"approvals.list": {Summary: "Returns the approvals and rejections of a payment",
+			Parameters: pageParameters(), Responses: ok(collectionOf(data.PaymentEvent{}))},
+		"approvals.create": {Summary: "Approve or reject a payment awaiting approval",
+			Body: bodyOf(Approval{}), Responses: created(documentOf(data.PaymentEvent{}))},
+		"transactions.list": {Summary: "Returns all returns and reversals for a payment",
+			Parameters: pageParameters(), Responses: ok(collectionOf(data.LinkedTransaction{}))},
+		"returns.list": {Summary: "Returns the returns for a payment",
+			Parameters: pageParameters(), Responses: ok(collectionOf(data.LinkedTransaction{}))},
+		"returns.create": {Summary: "Return some or all of a payment",
+			Body: txn, Responses: created(documentOf(data.LinkedTransaction{}))},
+		"reversals.list": {Summary: "Returns the reversals for a payment",
+			Parameters: pageParameters(), Responses: ok(collectionOf(data.LinkedTransaction{}))},
+		"reversals.create": {Summary: "Reverse the outstanding amount of a payment",
+			Body: txn, BodyOptional: true, Responses: created(documentOf(data.LinkedTransaction{}))},
+		"parties.list": {Summary: "Returns all parties", Parameters: pageParameters(),
+			Responses: ok(collectionOf(data.Party{}))},
+		"parties.get":    {Summary: "Returns party by ID", Responses: ok(documentOf(data.Party{}))},
+		"parties.create": {Summary: "Create a new party", Body: bodyOf(data.Party{}), Responses: created(nil)},
+		"parties.update": {Summary: "Update a party", Body: bodyOf(data.Party{}), Responses: ok(nil)},
+		"parties.delete": {Summary: "Delete a party", Responses: ok(nil)},
+		"accounts.list": {Summary: "Returns all accounts", Parameters: pageParameters(),
+			Responses: ok(collectionOf(data.Account{}))},
+		"accounts.get":    {Summary: "Returns account by ID", Responses: ok(documentOf(data.Account{}))},
+		"accounts.create": {Summary: "Create a new account", Body: bodyOf(data.Account{}), Responses: created(nil)},
+		"accounts.update": {Summary: "Update an account", Body: bodyOf(data.Account{}), Responses: ok(nil)},
+		"accounts.delete": {Summary: "Delete an account with no ledger entries", Responses: ok(nil)},
+		"accounts.balance": {Summary: "Returns the balance of an account per currency",
+			Responses: ok(documentOf(data.AccountBalance{}))},
+		"accounts.entries": {Summary: "Returns the ledger entries posted to an account",
+			Parameters: pageParameters(), Responses: ok(collectionOf(data.LedgerEntry{}))},
+		"organisations.list": {Summary: "Returns the caller's organisation, or all for a super-admin",
+			Parameters: pageParameters(), Responses: ok(collectionOf(data.Organisation{}))},
+		"organisations.get": {Summary: "Returns organisation by ID",
+			Responses: ok(documentOf(data.Organisation{}))},
+		"organisations.create": {Summary: "Create a new organisation",
+			Body: bodyOf(data.Organisation{}), Responses: created(nil)},
+		"organisations.update": {Summary: "Update an organisation",
+			Body: bodyOf(data.Organisation{}), Responses: ok(nil)},
+		"organisations.delete": {Summary: "Delete an organisation with no resources", Responses: ok(nil)},
+		"keys.list": {Summary: "Returns the organisation's API keys, with when each was last used",
+			Parameters: pageParameters(), Responses: ok(collectionOf(apiKey{}))},
+		"keys.issue": {Summary: "Issue a new API key", Body: bodyOf(apiKey{}), BodyOptional: true,
+			Responses: created(documentOf(apiKey{}))},
+		"keys.revoke": {Summary: "Revoke an API key", Responses: ok(nil)},
+	}
+}
+
+func ok(body *openapi.Schema) map[int]*openapi.Schema {
+	return map[int]*openapi.Schema{http.StatusOK: body}
+}
+
+func created(body *openapi.Schema) map[int]*openapi.Schema {
+	return map[int]*openapi.Schema{http.StatusCreated: body}
+}
+
+// documentOf is the schema of a document holding a resource of the type of v
+func documentOf(v interface{}) *openapi.Schema {
+	return &openapi.Schema{
+		Type:     "object",
+		Required: []string{"data", "links"},
+		Properties: map[string]*openapi.Schema{
+			"data":     openapi.SchemaOf(v),
+			"included": {Type: "array", Items: &openapi.Schema{}},
+			"links":    openapi.SchemaOf(Links{}),
+		},
+		AdditionalProperties: false,
+	}
+}
+
+// collectionOf is the schema of a document holding a page of resources of
+// the type of v
+func collectionOf(v interface{}) *openapi.Schema {
+	return &openapi.Schema{
+		Type:     "object",
+		Required: []string{"data", "links", "meta"},
+		Properties: map[string]*openapi.Schema{
+			"data":     {Type: "array", Items: openapi.SchemaOf(v)},
+			"included": {Type: "array", Items: &openapi.Schema{}},
+			"links":    openapi.SchemaOf(Links{}),
+			"meta":     openapi.SchemaOf(Meta{}),
+		},
+		AdditionalProperties: false,
+	}
+}
+
+// bodyOf is a JSON request body holding a resource of the type of v, on its
+// own or in the envelope of a document
+func bodyOf(v interface{}) map[string]*openapi.Schema {
+	return map[string]*openapi.Schema{"application/json": {AnyOf: []*openapi.Schema{
+		openapi.SchemaOf(v),
+		{
+			Type:                 "object",
+			Required:             []string{"data"},
+			Properties:           map[string]*openapi.Schema{"data": openapi.SchemaOf(v), "meta": {}},
+			AdditionalProperties: false,
+		},
+	}}}
+}
+
+func pageParameters() []*openapi.Parameter {
+	min, max := 1.0, float64(MaxPageSize)
+	return []*openapi.Parameter{
+		{Name: "page[number]", In: "query", Description: "the page to return, from 1",
+			Schema: &openapi.Schema{Type: "integer", Minimum: &min}},
+		{Name: "page[size]", In: "query", Description: "how many resources are on each page",
+			Schema: &openapi.Schema{Type: "integer", Minimum: &min, Maximum: &max}},
+	}
+}
+
+// paymentParameters choose the related resources and attributes of payments
+func paymentParameters() []*openapi.Parameter {
+	include := "(" + strings.Join(paymentIncludes, "|") + ")"
+	return []*openapi.Parameter{
+		{Name: "include", In: "query", Description: "related resources to include, comma separated",
+			Schema: &openapi.Schema{Type: "string", Pattern: "^" + include + "(," + include + ")*$"}},
+		{Name: "fields[payments]", In: "query",
+			Description: "the attributes to return, comma separated, with fields of objects named with a dot",
+			Schema:      &openapi.Schema{Type: "string"}},
+	}
+}
+
+// jsonPatch is the schema of a JSON Patch
+var jsonPatch = &openapi.Schema{
+	Type: "array",
+	Items: &openapi.Schema{
+		Type:     "object",
+		Required: []string{"op", "path"},
+		Properties: map[string]*openapi.Schema{
+			"op":    {Type: "string", Enum: []string{"add", "remove", "replace", "move", "copy", "test"}},
+			"path":  {Type: "string"},
+			"from":  {Type: "string"},
+			"value": {},
+		},
+		AdditionalProperties: false,
+	},
+}
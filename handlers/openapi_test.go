@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/openapi"
+	"github.com/adampointer/restservice/patch"
+	"github.com/gorilla/mux"
+)
+
+// TestPaymentsMatchOpenAPI runs payments through the validator, which answers
+// 500 for any response the document does not describe
+func TestPaymentsMatchOpenAPI(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+	h := NewPayments(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", h.GetAll).Methods("GET").Name("payments.list")
+	router.HandleFunc("/payments", h.Create).Methods("POST").Name("payments.create")
+	router.HandleFunc("/payments/{id}", h.GetOne).Methods("GET").Name("payments.get")
+	router.HandleFunc("/payments/{id}", h.Replace).Methods("PUT").Name("payments.replace")
+	router.HandleFunc("/payments/{id}", h.Patch).Methods("PATCH").Name("payments.patch")
+	router.HandleFunc("/payments/{id}", h.Delete).Methods("DELETE").Name("payments.delete")
+	spec, err := openapi.Generate(openapi.Info{Title: "test", Version: "1"}, router, Endpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.Use(spec.Validator)
+	serve := func(method, url, contentType, body string) *httptest.ResponseRecorder {
+		req, err := newTestRequest(method, url, nil)
+		if len(body) > 0 {
+			req, err = newTestRequest(method, url, strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("POST", "/payments", "application/json", exampleJSON)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v': %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	location := rr.Header().Get("Location")
+	id := location[strings.LastIndex(location, "/")+1:]
+	for _, tc := range []struct {
+		method, url, contentType, body string
+		status                         int
+	}{
+		{"GET", "/payments?page[size]=10&include=parties&fields[payments]=amount,debtor_party.name", "", "",
+			http.StatusOK},
+		{"GET", location + "?include=returns,reversals", "", "", http.StatusOK},
+		{"PUT", "/payments/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", "application/json", exampleJSON,
+			http.StatusCreated},
+		{"PATCH", location, patch.MergePatchType, `{"attributes": {"reference": "Invoice 42"}}`, http.StatusOK},
+		{"PATCH", location, patch.JSONPatchType, `[{"op": "replace", "path": "/attributes/currency", "value": "EUR"}]`,
+			http.StatusOK},
+		{"GET", "/payments/nope", "", "", http.StatusNotFound},
+		{"DELETE", location, "", "", http.StatusOK},
+
+		// Refused by the validator before reaching the handler
+		{"GET", "/payments?page[size]=0", "", "", http.StatusBadRequest},
+		{"GET", "/payments?include=debtor", "", "", http.StatusBadRequest},
+		{"PUT", "/payments/" + strings.ToUpper(id), "application/json", exampleJSON, http.StatusBadRequest},
+		{"POST", "/payments", "application/json", strings.Replace(exampleJSON, `"GBP"`, `"gbp"`, 1),
+			http.StatusBadRequest},
+		{"PATCH", location, patch.JSONPatchType, `[{"op": "rename", "path": "/id"}]`, http.StatusBadRequest},
+	} {
+		if rr := serve(tc.method, tc.url, tc.contentType, tc.body); rr.Code != tc.status {
+			t.Errorf("%s %s: handler returned wrong status code: got '%v' want '%v': %s", tc.method, tc.url,
+				rr.Code, tc.status, rr.Body)
+		}
+	}
+}
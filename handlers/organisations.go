@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+// Organisations handlers for organisation resources. Callers may read their
+// own organisation, only super-admins may see others or make changes.
+type Organisations struct {
+	db *data.Client
+}
+
+// NewOrganisations returns new handler with database client
+func NewOrganisations(db *data.Client) *Organisations {
+	return &Organisations{db: db}
+}
+
+// GetAll lists all organisation resources
+func (o *Organisations) GetAll(w http.ResponseWriter, r *http.Request) {
+	orgs, err := o.db.WithContext(r.Context()).FetchAllOrganisations()
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Error getting all organisations: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !isSuperAdmin(r) {
+		own := []*data.Organisation{}
+		for _, org := range orgs {
+			if org.ID == callerOrganisation(r) {
+				own = append(own, org)
+			}
+		}
+		orgs = own
+	}
+	writeCollection(w, r, orgs)
+}
+
+// GetOne shows a single organisation resource
+func (o *Organisations) GetOne(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !isSuperAdmin(r) && params["id"] != callerOrganisation(r) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	org, err := o.db.WithContext(r.Context()).FetchOrganisation(params["id"])
+	if err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error getting organisation: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	writeResource(w, r, http.StatusOK, org)
+}
+
+// Create a new organisation resource
+func (o *Organisations) Create(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !isSuperAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var org data.Organisation
+	if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := decode(r, &org); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding create organisation request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkID(org.ID, params["id"]); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	org.ID = params["id"]
+	if len(org.ID) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := o.db.WithContext(r.Context()).CreateOrganisation(&org); err != nil {
+		if err.Error() == "resource exists" {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if isInvalidOrganisation(err) {
+			problem.Write(w, http.StatusUnprocessableEntity, err.Error())
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error saving new organisation: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Update an existing organisation resource
+func (o *Organisations) Update(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !isSuperAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var org data.Organisation
+	if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := decode(r, &org); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding update organisation request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkID(org.ID, params["id"]); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	org.ID = params["id"]
+	if err := o.db.WithContext(r.Context()).UpdateOrganisation(&org); err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else if isInvalidOrganisation(err) {
+			problem.Write(w, http.StatusUnprocessableEntity, err.Error())
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error saving organisation: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Delete an organisation resource which has nothing left in it
+func (o *Organisations) Delete(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	if !isSuperAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := o.db.WithContext(r.Context()).DeleteOrganisation(params["id"]); err != nil {
+		if err == data.ErrOrganisationInUse {
+			w.WriteHeader(http.StatusConflict)
+		} else if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error deleting organisation: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// isInvalidOrganisation reports whether the organisation was refused for
+// settings its payments could not be checked against
+func isInvalidOrganisation(err error) bool {
+	return err == data.ErrInvalidOrganisationStatus || err == data.ErrInvalidOrganisationAmount
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/data"
+	"github.com/gorilla/mux"
+)
+
+var superAdmin = &auth.Principal{Subject: "support", Roles: []string{auth.RoleSuperAdmin}}
+
+func organisationsRouter(db *data.Client) *mux.Router {
+	h := NewOrganisations(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/organisations", h.GetAll).Methods("GET")
+	router.HandleFunc("/organisations/{id}", h.GetOne).Methods("GET")
+	router.HandleFunc("/organisations/{id}", h.Create).Methods("PUT")
+	router.HandleFunc("/organisations/{id}", h.Update).Methods("POST")
+	router.HandleFunc("/organisations/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc("/payments/{id}", NewPayments(db).Replace).Methods("PUT")
+	return router
+}
+
+func TestCreateOrganisationRequiresSuperAdmin(t *testing.T) {
+	id := "0a5a3e2e-1b3c-4d5e-8f90-123456789abc"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := organisationsRouter(db)
+
+	req, err := newTestRequest("PUT", "/organisations/"+id, strings.NewReader(`{"attributes":{"name":"Other"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusForbidden)
+	}
+
+	req, err = newRequestAs(superAdmin, "PUT", "/organisations/"+id, strings.NewReader(`{"attributes":{"name":"Other"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+
+	// Callers cannot see organisations other than their own
+	req, err = newTestRequest("GET", "/organisations/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusNotFound)
+	}
+}
+
+func TestCreateOrganisationInvalidSettings(t *testing.T) {
+	id := "0a5a3e2e-1b3c-4d5e-8f90-123456789abc"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := organisationsRouter(db)
+
+	for _, test := range []struct {
+		method, body string
+		expected     int
+	}{
+		{"PUT", `{"attributes":{"status":"closed"}}`, http.StatusUnprocessableEntity},
+		{"PUT", `{"attributes":{"payment_limits":{"GBP":"lots"}}}`, http.StatusBadRequest},
+		{"PUT", `{"attributes":{"approval_thresholds":{"GBP":"0"}}}`, http.StatusUnprocessableEntity},
+		{"PUT", `{"attributes":{"payment_limits":{"GBP":"100.00"}}}`, http.StatusCreated},
+		{"POST", `{"attributes":{"payment_limits":{"GBP":"-1"}}}`, http.StatusUnprocessableEntity},
+		{"POST", `{"attributes":{"status":"suspended"}}`, http.StatusOK},
+	} {
+		req, err := newRequestAs(superAdmin, test.method, "/organisations/"+id, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expected {
+			t.Errorf("%s %s: handler returned wrong status code: got '%v' want '%v'", test.method, test.body,
+				status, test.expected)
+		}
+	}
+}
+
+func TestCreatePaymentOrganisationSettings(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	tests := []struct {
+		settings string
+		expected int
+	}{
+		{`{"attributes":{"status":"suspended"}}`, http.StatusBadRequest},
+		{`{"attributes":{"status":"active","allowed_currencies":["EUR"]}}`, http.StatusBadRequest},
+		{`{"attributes":{"status":"active","allowed_schemes":["SEPA"]}}`, http.StatusBadRequest},
+		{`{"attributes":{"status":"active","payment_limits":{"GBP":"100.00"}}}`, http.StatusBadRequest},
+		{`{"attributes":{"status":"active","allowed_currencies":["GBP"],"payment_limits":{"GBP":"100.21"}}}`, http.StatusCreated},
+	}
+	for _, test := range tests {
+		db := getTestDB(t)
+		router := organisationsRouter(db)
+
+		req, err := newRequestAs(superAdmin, "POST", "/organisations/"+testOrganisation, strings.NewReader(test.settings))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+		}
+
+		req, err = newTestRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.expected {
+			t.Errorf("%s: handler returned wrong status code: got '%v' want '%v'", test.settings, status, test.expected)
+		}
+		cleanUp(db)
+	}
+}
+
+func TestCreatePaymentUnknownOrganisation(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := organisationsRouter(db)
+
+	req, err := newRequestAs(superAdmin, "DELETE", "/organisations/"+testOrganisation, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+	}
+
+	req, err = newTestRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusBadRequest)
+	}
+}
+
+func TestCreatePaymentDefaultBearerCode(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := organisationsRouter(db)
+
+	req, err := newRequestAs(superAdmin, "POST", "/organisations/"+testOrganisation,
+		strings.NewReader(`{"attributes":{"status":"active","default_bearer_code":"DEBT"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+	}
+
+	payment := strings.Replace(exampleJSON, `"bearer_code": "SHAR",`, "", 1)
+	req, err = newTestRequest("PUT", "/payments/"+id, strings.NewReader(payment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+	pmt, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := pmt.Attributes.ChargesInformation.BearerCode; code != "DEBT" {
+		t.Fatalf("payment has bearer code '%s', we expected 'DEBT'", code)
+	}
+
+	// The organisation now has a payment so cannot be deleted
+	req, err = newRequestAs(superAdmin, "DELETE", "/organisations/"+testOrganisation, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusConflict)
+	}
+}
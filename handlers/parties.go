@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+	"github.com/gorilla/mux"
+)
+
+// Parties handlers for the counterparty directory
+type Parties struct {
+	db *data.Client
+}
+
+// NewParties returns new handler with database client
+func NewParties(db *data.Client) *Parties {
+	return &Parties{db: db}
+}
+
+// GetAll lists all party resources
+func (p *Parties) GetAll(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	ptys, err := db.FetchAllParties()
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Error getting all parties: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeCollection(w, r, ptys)
+}
+
+// GetOne shows a single party resource
+func (p *Parties) GetOne(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	pty, err := db.FetchParty(params["id"])
+	if err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error getting party: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	writeResource(w, r, http.StatusOK, pty)
+}
+
+// Create a new party resource
+func (p *Parties) Create(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	var party data.Party
+	if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := decode(r, &party); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding create party request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkID(party.ID, params["id"]); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	party.ID = params["id"]
+	if len(party.ID) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := db.CreateParty(&party); err != nil {
+		if err.Error() == "resource exists" {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if err == data.ErrWrongOrganisation {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error saving new party: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Update an existing party resource
+func (p *Parties) Update(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	var party data.Party
+	if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := decode(r, &party); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding update party request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkID(party.ID, params["id"]); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	party.ID = params["id"]
+	if err := db.UpdateParty(&party); err != nil {
+		if err.Error() == ErrNotFound.Error() || err == data.ErrWrongOrganisation {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error saving party: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Delete a party resource
+func (p *Parties) Delete(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	if err := db.DeleteParty(params["id"]); err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error deleting party: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
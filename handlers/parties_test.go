@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/patch"
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+var partyJSON = `{
+	"type": "Party",
+	"organisation_id": "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
+	"attributes": {
+		"account_name": "Directory Owens",
+		"account_number": "31926819",
+		"account_number_code": "BBAN",
+		"bank_id": "403000",
+		"bank_id_code": "GBDSC",
+		"name": "Wilfred Jeremiah Owens"
+	}
+}`
+
+func partiesRouter(db *data.Client) *mux.Router {
+	h := NewParties(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/parties", h.GetAll).Methods("GET")
+	router.HandleFunc("/parties/{id}", h.GetOne).Methods("GET")
+	router.HandleFunc("/parties/{id}", h.Create).Methods("PUT")
+	router.HandleFunc("/parties/{id}", h.Update).Methods("POST")
+	router.HandleFunc("/parties/{id}", h.Delete).Methods("DELETE")
+	return router
+}
+
+// paymentWithPartyRef swaps the embedded beneficiary in the example payment for a reference
+func paymentWithPartyRef(t *testing.T, partyID string) string {
+	var payment data.Payment
+	if err := json.Unmarshal([]byte(exampleJSON), &payment); err != nil {
+		t.Fatal(err)
+	}
+	payment.Attributes.BeneficiaryParty = nil
+	payment.Attributes.BeneficiaryPartyID = partyID
+	b, err := json.Marshal(payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCreatePartyThenGetAllParties(t *testing.T) {
+	id := "b6e3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := partiesRouter(db)
+
+	req, err := newTestRequest("PUT", "/parties/"+id, strings.NewReader(partyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+
+	// Assert the party is only listed for its own organisation
+	for org, expected := range map[string]int{testOrganisation: 1, "0a5a3e2e-1b3c-4d5e-8f90-123456789abc": 0} {
+		req, err = newRequestAs(&auth.Principal{OrganisationID: org}, "GET", "/parties", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+		}
+		var parties []*data.Party
+		if err := decodeData(rr.Body, &parties); err != nil {
+			t.Fatal("unable to decode response into JSON")
+		}
+		if len(parties) != expected {
+			t.Fatalf("handler returned %d parties for '%s', we wanted %d", len(parties), org, expected)
+		}
+	}
+}
+
+func TestCreatePaymentWithPartyReference(t *testing.T) {
+	partyID := "b6e3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+
+	req, err := newTestRequest("PUT", "/parties/"+partyID, strings.NewReader(partyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	partiesRouter(db).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+
+	req, err = newTestRequest("PUT", "/payments/"+id, strings.NewReader(paymentWithPartyRef(t, partyID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).Replace)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+
+	// Assert the party was expanded into the payment and the link kept
+	payment, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Attributes.BeneficiaryParty == nil || payment.Attributes.BeneficiaryParty.AccountName != "Directory Owens" {
+		t.Fatalf("payment beneficiary was not expanded from the party: %+v", payment.Attributes.BeneficiaryParty)
+	}
+	if payment.Attributes.BeneficiaryPartyID != partyID {
+		t.Fatalf("payment has beneficiary party id '%s', we expected '%s'", payment.Attributes.BeneficiaryPartyID, partyID)
+	}
+}
+
+func TestCreatePaymentWithUnknownParty(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+
+	req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(paymentWithPartyRef(t, "foobar")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).Replace)
+	router.ServeHTTP(rr, req)
+
+	var p problem.Problem
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusBadRequest)
+	} else if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || p.Detail != data.ErrPartyNotFound.Error() {
+		t.Errorf("problem '%s' does not explain the refusal", p.Detail)
+	}
+}
+
+func TestUpdatePaymentWithPartyReference(t *testing.T) {
+	partyID := "b6e3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+
+	req, err := newTestRequest("PUT", "/parties/"+partyID, strings.NewReader(partyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	partiesRouter(db).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).Update)
+	for _, test := range []struct {
+		partyID string
+		status  int
+	}{
+		{"foobar", http.StatusBadRequest},
+		{partyID, http.StatusOK},
+	} {
+		req, err = newTestRequest("POST", "/payments/"+id, strings.NewReader(paymentWithPartyRef(t, test.partyID)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, test.status)
+		}
+	}
+
+	// Assert the party was expanded into the payment, as on creation
+	payment, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Attributes.BeneficiaryParty == nil || payment.Attributes.BeneficiaryParty.AccountName != "Directory Owens" {
+		t.Fatalf("payment beneficiary was not expanded from the party: %+v", payment.Attributes.BeneficiaryParty)
+	}
+	if payment.Version != 1 {
+		t.Errorf("payment has version %d, we expected 1", payment.Version)
+	}
+}
+
+func TestPatchPaymentWithPartyReference(t *testing.T) {
+	partyID := "b6e3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+
+	req, err := newTestRequest("PUT", "/parties/"+partyID, strings.NewReader(partyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	partiesRouter(db).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).Patch).Methods("PATCH")
+	for _, test := range []struct {
+		partyID string
+		status  int
+	}{
+		{"foobar", http.StatusBadRequest},
+		{partyID, http.StatusOK},
+	} {
+		rr = patchPayment(router, id, patch.MergePatchType, "",
+			`{"attributes": {"debtor_party_id": "`+test.partyID+`"}}`)
+		if status := rr.Code; status != test.status {
+			t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, test.status)
+		}
+	}
+
+	// Assert the party was expanded into the payment, as on creation
+	payment, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Attributes.DebtorParty == nil || payment.Attributes.DebtorParty.AccountName != "Directory Owens" {
+		t.Fatalf("payment debtor was not expanded from the party: %+v", payment.Attributes.DebtorParty)
+	}
+}
+
+func TestPatchSettledPaymentAfterPartyEdit(t *testing.T) {
+	partyID := "b6e3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	parties := partiesRouter(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).Replace).Methods("PUT")
+	router.HandleFunc("/payments/{id}", NewPayments(db).Patch).Methods("PATCH")
+	router.HandleFunc("/payments/{id}/settle", NewTransactions(db).Settle).Methods("POST")
+
+	for _, test := range []struct {
+		router *mux.Router
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{parties, "PUT", "/parties/" + partyID, partyJSON, http.StatusCreated},
+		{accountsRouter(db), "PUT", "/accounts/c6e3a8d8-ca7b-4290-a52c-dd5b6165ec43", debtorAccountJSON,
+			http.StatusCreated},
+		{router, "PUT", "/payments/" + id, paymentWithPartyRef(t, partyID), http.StatusCreated},
+		{router, "POST", "/payments/" + id + "/settle", "", http.StatusOK},
+		// The directory entry changes after the payment has moved money
+		{parties, "POST", "/parties/" + partyID,
+			strings.Replace(strings.Replace(partyJSON, "Directory Owens", "Renamed Owens", 1),
+				"31926819", "11112222", 1), http.StatusOK},
+	} {
+		req, err := newTestRequest(test.method, test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		test.router.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Fatalf("%s %s: handler returned wrong status code: got '%v' want '%v'", test.method, test.path,
+				status, test.status)
+		}
+	}
+
+	// Changing only the reference keeps the party the payment was made to
+	rr := patchPayment(router, id, patch.MergePatchType, "", `{"attributes": {"reference": "Invoice 42"}}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+	}
+	payment, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pty := payment.Attributes.BeneficiaryParty; pty == nil || pty.AccountName != "Directory Owens" ||
+		pty.AccountNumber != "31926819" {
+		t.Errorf("payment beneficiary changed with the directory: %+v", pty)
+	}
+	if payment.Attributes.Reference != "Invoice 42" {
+		t.Errorf("payment has reference '%s', we expected 'Invoice 42'", payment.Attributes.Reference)
+	}
+}
+
+func TestDeletePartyNotFound(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+
+	req, err := newTestRequest("DELETE", "/parties/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	partiesRouter(db).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/patch"
+	"github.com/adampointer/restservice/problem"
+)
+
+// AcceptPatch lists the patch formats accepted by PATCH requests
+var AcceptPatch = strings.Join([]string{patch.MergePatchType, patch.JSONPatchType}, ", ")
+
+// patchFunc applies a patch document to a JSON document
+type patchFunc func(doc, patch []byte) ([]byte, error)
+
+// readPatch reads the patch document of a request and chooses how to apply
+// it from its Content-Type
+func readPatch(r *http.Request) (patchFunc, []byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var apply patchFunc
+	switch mediaType {
+	case patch.MergePatchType:
+		apply = patch.Merge
+	case patch.JSONPatchType:
+		apply = patch.Apply
+	default:
+		return nil, nil, &BodyError{Status: http.StatusUnsupportedMediaType,
+			Detail: fmt.Sprintf("Content-Type must be one of: %s", AcceptPatch)}
+	}
+	if r.Body == nil {
+		return nil, nil, &BodyError{Status: http.StatusBadRequest, Detail: "a patch document is required"}
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, bodyError(err)
+	}
+	if mediaType == patch.MergePatchType {
+		// A merge patch may be sent in the envelope of the resource it changes
+		if body, err = unwrap(body); err != nil {
+			return nil, nil, err
+		}
+	}
+	return apply, body, nil
+}
+
+// patchResource applies a patch to the JSON of a stored resource, decoding
+// the result as strictly as a request body into v
+func patchResource(apply patchFunc, body []byte, stored, v interface{}) error {
+	doc, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	patched, err := apply(doc, body)
+	if err != nil {
+		return err
+	}
+	return decodeStrict(patched, v)
+}
+
+// etag is the entity tag of a version of a resource
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// ifMatch reports whether an If-Match header allows changing a version of a
+// resource. Weak tags are compared as strong ones, as versions are exact.
+func ifMatch(header string, version int) bool {
+	if len(header) == 0 {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// writePatchError refuses a patch which could not be applied, returning false
+// without writing anything when err is not about the patch
+func writePatchError(w http.ResponseWriter, err error) bool {
+	switch e := err.(type) {
+	case *BodyError:
+		if e.Status == http.StatusUnsupportedMediaType {
+			w.Header().Set("Accept-Patch", AcceptPatch)
+		}
+		writeBodyError(w, e)
+	case *patch.Error:
+		status := http.StatusBadRequest
+		if e.Conflict {
+			status = http.StatusConflict
+		}
+		problem.Write(w, status, e.Detail)
+	default:
+		if err != data.ErrVersionMismatch {
+			return false
+		}
+		problem.Write(w, http.StatusPreconditionFailed, err.Error())
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/patch"
+	"github.com/gorilla/mux"
+)
+
+func patchPayment(router *mux.Router, id, contentType, ifMatch, body string) *httptest.ResponseRecorder {
+	req, _ := newTestRequest("PATCH", "/payments/"+id, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if len(ifMatch) > 0 {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestPatchPayment(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).Patch).Methods("PATCH")
+
+	// Only the reference changes, the parties are kept
+	rr := patchPayment(router, id, patch.MergePatchType, `"0"`, `{"attributes": {"reference": "Invoice 42"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v': %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var pmt data.Payment
+	if err := decodeData(rr.Body, &pmt); err != nil {
+		t.Fatal(err)
+	}
+	if pmt.Attributes.Reference != "Invoice 42" || pmt.Attributes.BeneficiaryParty == nil ||
+		pmt.Attributes.Amount != "100.21" || pmt.Version != 1 || rr.Header().Get("ETag") != `"1"` {
+		t.Errorf("unexpected patched payment %+v, ETag %s", pmt.Attributes, rr.Header().Get("ETag"))
+	}
+
+	rr = patchPayment(router, id, patch.JSONPatchType, "", `[
+		{"op": "test", "path": "/version", "value": 1},
+		{"op": "replace", "path": "/attributes/amount", "value": "99.00"},
+		{"op": "remove", "path": "/attributes/debtor_party"}
+	]`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v': %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	stored, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Attributes.Amount != "99.00" || stored.Attributes.DebtorParty != nil ||
+		stored.Attributes.Reference != "Invoice 42" || stored.Version != 2 ||
+		stored.Attributes.Status != data.StatusPending {
+		t.Errorf("unexpected stored payment %+v", stored)
+	}
+
+	for _, test := range []struct {
+		name, contentType, ifMatch, body string
+		status                           int
+	}{
+		{"stale If-Match", patch.MergePatchType, `"1"`, `{"attributes": {"reference": "x"}}`,
+			http.StatusPreconditionFailed},
+		{"stale version", patch.MergePatchType, "", `{"version": 1, "attributes": {"reference": "x"}}`,
+			http.StatusPreconditionFailed},
+		{"failed test", patch.JSONPatchType, "", `[{"op": "test", "path": "/attributes/amount", "value": "1"}]`,
+			http.StatusConflict},
+		{"missing path", patch.JSONPatchType, "", `[{"op": "remove", "path": "/attributes/nothing"}]`,
+			http.StatusConflict},
+		{"malformed patch", patch.JSONPatchType, "", `{"op": "remove"}`, http.StatusBadRequest},
+		{"unknown field", patch.MergePatchType, "", `{"attributes": {"amuont": "1"}}`, http.StatusBadRequest},
+		{"other id", patch.MergePatchType, "", `{"id": "216d4da9-e59a-4cc6-8df3-3da6e7580b77"}`,
+			http.StatusBadRequest},
+		{"plain JSON", "application/json", "", `{}`, http.StatusUnsupportedMediaType},
+		{"no attributes", patch.MergePatchType, "", `{"attributes": null}`, http.StatusUnprocessableEntity},
+		{"attributes removed", patch.JSONPatchType, "", `[{"op": "remove", "path": "/attributes"}]`,
+			http.StatusUnprocessableEntity},
+		{"no amount", patch.MergePatchType, "", `{"attributes": {"amount": null}}`, http.StatusUnprocessableEntity},
+		{"no currency", patch.MergePatchType, "", `{"attributes": {"currency": ""}}`, http.StatusUnprocessableEntity},
+		{"status", patch.MergePatchType, "", `{"attributes": {"status": "settled"}}`, http.StatusUnprocessableEntity},
+	} {
+		rr := patchPayment(router, id, test.contentType, test.ifMatch, test.body)
+		if rr.Code != test.status {
+			t.Errorf("%s: handler returned wrong status code: got '%v' want '%v'", test.name, rr.Code, test.status)
+		}
+	}
+	if rr := patchPayment(router, id, "text/plain", "", `{}`); rr.Header().Get("Accept-Patch") != AcceptPatch {
+		t.Errorf("no Accept-Patch header with an unsupported media type: %v", rr.Header())
+	}
+	if rr := patchPayment(router, "216d4da9-e59a-4cc6-8df3-3da6e7580b77", patch.MergePatchType, "", `{}`); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", rr.Code, http.StatusNotFound)
+	}
+
+	// None of the refused patches were saved
+	if stored, err = db.ForOrganisation(testOrganisation).FetchPayment(id); err != nil || stored.Version != 2 {
+		t.Errorf("payment changed by a refused patch: %+v %v", stored, err)
+	}
+}
@@ -1,13 +1,18 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"path"
+	"reflect"
 
 	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+	"github.com/adampointer/restservice/problem"
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
 )
 
 // Payments handlers for payment resorces
@@ -25,80 +30,294 @@ func NewPayments(db *data.Client) *Payments {
 
 // GetAll lists all payment resources
 func (p *Payments) GetAll(w http.ResponseWriter, r *http.Request) {
-	pmts, err := p.db.FetchAllPayments()
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	include, err := readInclude(r, paymentIncludes...)
+	if err != nil {
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := readFields(r, "payments", paymentAttributesType)
 	if err != nil {
-		log.Errorf("Error getting all payments: %s", err)
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pmts, err := db.FetchAllPayments()
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Error getting all payments: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(pmts)
+	doc, err := collection(r, pmts)
+	if err != nil {
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page := doc.Data.([]*data.Payment)
+	if doc.Included, err = included(db, include, page...); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error getting included resources: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if fields != nil {
+		sparse := make([]*sparsePayment, len(page))
+		for i, pmt := range page {
+			sparse[i] = fields.payment(pmt)
+		}
+		doc.Data = sparse
+	}
+	writeDocument(w, http.StatusOK, doc)
 }
 
 // GetOne shows a single payment resource
 func (p *Payments) GetOne(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	include, err := readInclude(r, paymentIncludes...)
+	if err != nil {
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := readFields(r, "payments", paymentAttributesType)
+	if err != nil {
+		problem.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	params := mux.Vars(r)
-	pmt, err := p.db.FetchPayment(params["id"])
+	pmt, err := db.FetchPayment(params["id"])
 	if err != nil {
 		if err.Error() == ErrNotFound.Error() {
 			w.WriteHeader(http.StatusNotFound)
 		} else {
-			log.Errorf("Error getting payments: %s", err)
+			logging.FromContext(r.Context()).Errorf("Error getting payments: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		return
 	}
-	json.NewEncoder(w).Encode(pmt)
+	doc := resource(w, r, pmt)
+	if doc.Included, err = included(db, include, pmt); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error getting included resources: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if fields != nil {
+		doc.Data = fields.payment(pmt)
+	}
+	w.Header().Set("ETag", etag(pmt.Version))
+	writeDocument(w, http.StatusOK, doc)
 }
 
-// Create a new payment resource
+// IdempotencyKeyHeader names a create so that it is only done once however
+// often it is retried
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Create a new payment resource with an ID chosen by the server, answering
+// with its location and the payment as created. With an Idempotency-Key the ID
+// is derived from the key, and a retry is answered with the payment the first
+// request created.
 func (p *Payments) Create(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
 	var payment data.Payment
 	if r.Body == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-		log.Errorf("Error decoding create payment request: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+	if err := decode(r, &payment); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding create payment request: %s", err)
+		writeBodyError(w, err)
 		return
 	}
-	payment.ID = params["id"]
-	if len(payment.ID) == 0 {
+	if len(payment.ID) > 0 {
+		problem.Write(w, http.StatusBadRequest, "the id of a new payment is chosen by the server, "+
+			"PUT the payment to its own URL to choose it")
+		return
+	}
+	key := r.Header.Get(IdempotencyKeyHeader)
+	id, err := data.NewID()
+	hash := requestHash(&payment)
+	if len(key) > 0 {
+		id = data.NameID(db.OrganisationID() + "/" + key)
+		if replayCreate(w, r, db, id, hash) {
+			return
+		}
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Error choosing payment ID: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payment.ID = id
+	if len(key) > 0 {
+		err = db.CreatePaymentWithKey(&payment, hash)
+	} else {
+		err = db.CreatePayment(&payment)
+	}
+	if err != nil {
+		if len(key) > 0 && replayCreate(w, r, db, id, hash) {
+			// Created by a retry running alongside this one
+			return
+		}
+		if err == data.ErrPartyNotFound || isPolicyError(err) {
+			problem.Write(w, http.StatusBadRequest, err.Error())
+		} else if isInvalidPayment(err) {
+			problem.Write(w, http.StatusUnprocessableEntity, err.Error())
+		} else if err == data.ErrWrongOrganisation {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error saving new payment: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Location", path.Join(r.URL.Path, id))
+	writePayment(w, r, http.StatusCreated, &payment)
+}
+
+// replayCreate answers a retried create with the payment already created,
+// reporting whether there was one. A different request sent with the same
+// key is refused rather than answered with a payment it did not ask for.
+func replayCreate(w http.ResponseWriter, r *http.Request, db *data.Client, id, hash string) bool {
+	pmt, err := db.FetchPayment(id)
+	if err != nil {
+		return false
+	}
+	stored, err := db.FetchRequestHash(id)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Error getting idempotent request: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	// Payments created before requests were recorded have no hash
+	if len(stored) > 0 && stored != hash {
+		problem.Write(w, http.StatusUnprocessableEntity, "the "+IdempotencyKeyHeader+
+			" has already been used to create a different payment")
+		return true
+	}
+	w.Header().Set("Location", path.Join(r.URL.Path, id))
+	writePayment(w, r, http.StatusCreated, pmt)
+	return true
+}
+
+// requestHash identifies the payment a create asks for, however its JSON was
+// laid out
+func requestHash(pmt *data.Payment) string {
+	// A payment decoded from JSON can always be encoded again
+	b, _ := json.Marshal(pmt)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Replace a payment resource in full, or create it with the ID in the path,
+// which must be a UUID. An If-Match header, or a version in the payment, must
+// match the stored version.
+func (p *Payments) Replace(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	if !data.ValidID(params["id"]) {
+		problem.Write(w, http.StatusBadRequest, "the id of a payment must be a lower case UUID")
+		return
+	}
+	var payment data.Payment
+	if r.Body == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if err := p.db.CreatePayment(&payment); err != nil {
-		if err.Error() == "resource exists" {
-			w.WriteHeader(http.StatusBadRequest)
+	if err := decode(r, &payment); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding replace payment request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkID(payment.ID, params["id"]); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	payment.ID = params["id"]
+	created, err := db.ReplacePayment(&payment, func(stored *data.Payment) error {
+		if stored == nil {
+			if match := r.Header.Get("If-Match"); len(match) > 0 {
+				return data.ErrVersionMismatch
+			}
+			return nil
+		}
+		if !ifMatch(r.Header.Get("If-Match"), stored.Version) ||
+			(payment.Version != 0 && payment.Version != stored.Version) {
+			return data.ErrVersionMismatch
+		}
+		return nil
+	})
+	if err != nil {
+		if err == data.ErrVersionMismatch {
+			problem.Write(w, http.StatusPreconditionFailed, err.Error())
+		} else if err == data.ErrPaymentSettled {
+			problem.Write(w, http.StatusConflict, err.Error())
+		} else if err == data.ErrPartyNotFound || isPolicyError(err) {
+			problem.Write(w, http.StatusBadRequest, err.Error())
+		} else if isInvalidPayment(err) {
+			problem.Write(w, http.StatusUnprocessableEntity, err.Error())
+		} else if err == data.ErrWrongOrganisation {
+			w.WriteHeader(http.StatusNotFound)
 		} else {
-			log.Errorf("Error saving new payment: %s", err)
+			logging.FromContext(r.Context()).Errorf("Error saving payment: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	if created {
+		w.Header().Set("Location", r.URL.Path)
+		writePayment(w, r, http.StatusCreated, &payment)
+		return
+	}
+	writePayment(w, r, http.StatusOK, &payment)
 }
 
 // Update an existing payment resource
 func (p *Payments) Update(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
 	params := mux.Vars(r)
 	var payment data.Payment
 	if r.Body == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-		log.Errorf("Error decoding update payment request: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+	if err := decode(r, &payment); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding update payment request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkID(payment.ID, params["id"]); err != nil {
+		writeBodyError(w, err)
 		return
 	}
 	payment.ID = params["id"]
-	if err := p.db.UpdatePayment(&payment); err != nil {
-		if err.Error() == ErrNotFound.Error() {
+	if err := db.UpdatePayment(&payment); err != nil {
+		if err.Error() == ErrNotFound.Error() || err == data.ErrWrongOrganisation {
 			w.WriteHeader(http.StatusNotFound)
+		} else if err == data.ErrPaymentSettled {
+			problem.Write(w, http.StatusConflict, err.Error())
+		} else if err == data.ErrPartyNotFound || isPolicyError(err) {
+			problem.Write(w, http.StatusBadRequest, err.Error())
+		} else if isInvalidPayment(err) {
+			problem.Write(w, http.StatusUnprocessableEntity, err.Error())
 		} else {
-			log.Errorf("Error saving new payment: %s", err)
+			logging.FromContext(r.Context()).Errorf("Error saving new payment: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		return
@@ -106,17 +325,174 @@ func (p *Payments) Update(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// Patch changes part of a payment resource with a JSON Merge Patch or a JSON
+// Patch, applied to the stored payment in the same transaction as the change
+// is saved. An If-Match header, or a version in the patched payment, must
+// match the stored version.
+func (p *Payments) Patch(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	apply, body, err := readPatch(r)
+	if err != nil {
+		writePatchError(w, err)
+		return
+	}
+	pmt, err := db.PatchPayment(params["id"], func(stored *data.Payment) (*data.Payment, error) {
+		if !ifMatch(r.Header.Get("If-Match"), stored.Version) {
+			return nil, data.ErrVersionMismatch
+		}
+		var patched data.Payment
+		if err := patchResource(apply, body, stored, &patched); err != nil {
+			return nil, err
+		}
+		if err := checkID(patched.ID, params["id"]); err != nil {
+			return nil, err
+		}
+		if err := checkPatched(&patched, stored); err != nil {
+			return nil, err
+		}
+		return &patched, nil
+	})
+	if err != nil {
+		if writePatchError(w, err) {
+			return
+		}
+		if err.Error() == ErrNotFound.Error() || err == data.ErrWrongOrganisation {
+			w.WriteHeader(http.StatusNotFound)
+		} else if err == data.ErrPaymentSettled {
+			problem.Write(w, http.StatusConflict, err.Error())
+		} else if err == data.ErrPartyNotFound || isPolicyError(err) {
+			problem.Write(w, http.StatusBadRequest, err.Error())
+		} else if isInvalidPayment(err) {
+			problem.Write(w, http.StatusUnprocessableEntity, err.Error())
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error patching payment: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	writePayment(w, r, http.StatusOK, pmt)
+}
+
+// checkPatched refuses a patched payment whose status, which the server owns,
+// has been changed. What every payment needs is checked as the payment is
+// saved.
+func checkPatched(patched, stored *data.Payment) error {
+	if patched.Attributes != nil && stored.Attributes != nil &&
+		patched.Attributes.Status != stored.Attributes.Status {
+		return &BodyError{Status: http.StatusUnprocessableEntity, Detail: "attributes.status is managed by the server"}
+	}
+	return nil
+}
+
 // Delete a payment resource
 func (p *Payments) Delete(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(p.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
 	params := mux.Vars(r)
-	if err := p.db.DeletePayment(params["id"]); err != nil {
-		if err.Error() == ErrNotFound.Error() {
+	if err := db.DeletePayment(params["id"]); err != nil {
+		if err == data.ErrPaymentInUse {
+			problem.Write(w, http.StatusConflict, err.Error())
+		} else if err.Error() == ErrNotFound.Error() {
 			w.WriteHeader(http.StatusNotFound)
 		} else {
-			log.Errorf("Error deleting payment: %s", err)
+			logging.FromContext(r.Context()).Errorf("Error deleting payment: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// writePayment sends a payment with its version as the entity tag
+func writePayment(w http.ResponseWriter, r *http.Request, status int, pmt *data.Payment) {
+	w.Header().Set("ETag", etag(pmt.Version))
+	writeResource(w, r, status, pmt)
+}
+
+// paymentAttributesType is the type of the attributes which may be chosen
+// with fields[payments]
+var paymentAttributesType = reflect.TypeOf(data.PaymentAttributes{})
+
+// sparsePayment is a payment with only the attributes chosen by a sparse
+// fieldset
+type sparsePayment struct {
+	data.Resource
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func (f fieldTree) payment(pmt *data.Payment) *sparsePayment {
+	return &sparsePayment{Resource: pmt.Resource, Attributes: f.project(pmt.Attributes)}
+}
+
+// paymentIncludes are the related resources which may be included with
+// payments: the directory parties they reference and their returns and
+// reversals
+var paymentIncludes = []string{"parties", "returns", "reversals"}
+
+// included returns the related resources of payments asked for, each once.
+// Parties which have been deleted from the directory since are left out.
+func included(db *data.Client, include map[string]bool, pmts ...*data.Payment) ([]interface{}, error) {
+	var related []interface{}
+	seen := make(map[string]bool)
+	for _, pmt := range pmts {
+		if include["parties"] && pmt.Attributes != nil {
+			for _, id := range []string{pmt.Attributes.BeneficiaryPartyID, pmt.Attributes.DebtorPartyID,
+				pmt.Attributes.SponsorPartyID} {
+				if len(id) == 0 || seen["party "+id] {
+					continue
+				}
+				seen["party "+id] = true
+				pty, err := db.FetchParty(id)
+				if err != nil {
+					if err.Error() == ErrNotFound.Error() {
+						continue
+					}
+					return nil, err
+				}
+				related = append(related, pty)
+			}
+		}
+		if !include["returns"] && !include["reversals"] {
+			continue
+		}
+		txns, err := db.FetchLinkedTransactions(pmt.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, txn := range txns {
+			if (txn.Type == data.TypeReturn && include["returns"]) ||
+				(txn.Type == data.TypeReversal && include["reversals"]) {
+				related = append(related, txn)
+			}
+		}
+	}
+	return related, nil
+}
+
+// isInvalidPayment reports whether the payment was refused for missing what
+// every payment needs
+func isInvalidPayment(err error) bool {
+	switch err {
+	case data.ErrNoAttributes, data.ErrInvalidAmount, data.ErrNoCurrency:
+		return true
+	}
+	return false
+}
+
+// isPolicyError reports whether the payment was refused by its organisation's settings
+func isPolicyError(err error) bool {
+	switch err {
+	case data.ErrUnknownOrganisation, data.ErrOrganisationSuspended, data.ErrCurrencyNotAllowed,
+		data.ErrSchemeNotAllowed, data.ErrLimitExceeded:
+		return true
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -9,8 +10,10 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/problem"
 	"github.com/gorilla/mux"
 )
 
@@ -23,6 +26,13 @@ func getTestDB(t *testing.T) *data.Client {
 	if err != nil {
 		t.Fatalf("unable to create test db: %s", err)
 	}
+	org := &data.Organisation{
+		ID:         testOrganisation,
+		Attributes: &data.OrganisationAttributes{Name: "Test"},
+	}
+	if err := dbClient.CreateOrganisation(org); err != nil {
+		t.Fatalf("unable to create test organisation: %s", err)
+	}
 	return dbClient
 }
 
@@ -32,12 +42,17 @@ func cleanUp(db *data.Client) {
 	os.Remove(db.Path())
 }
 
+// decodeData decodes the data of a response document into v
+func decodeData(body io.Reader, v interface{}) error {
+	return json.NewDecoder(body).Decode(&Document{Data: v})
+}
+
 func TestGetAllPaymentsEmpty(t *testing.T) {
 	db := getTestDB(t)
 	defer cleanUp(db)
 	h := NewPayments(db)
 
-	req, err := http.NewRequest("GET", "/payments", nil)
+	req, err := newTestRequest("GET", "/payments", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -45,13 +60,13 @@ func TestGetAllPaymentsEmpty(t *testing.T) {
 	handler := http.HandlerFunc(h.GetAll)
 	handler.ServeHTTP(rr, req)
 
-	// Assert that a GET to /payments when there are no payments returns a 200 and []
+	// Assert that a GET to /payments when there are no payments returns a 200 and no data
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
 	}
-	expected := "[]"
-	actual := strings.TrimRight(rr.Body.String(), "\r\n")
-	if actual != expected {
+	expected := `{"data":[],`
+	actual := rr.Body.String()
+	if !strings.HasPrefix(actual, expected) {
 		t.Errorf("handler returned unexpected body: got '%s' want '%s'", actual, expected)
 	}
 }
@@ -61,7 +76,7 @@ func TestGetPaymentNotFound(t *testing.T) {
 	defer cleanUp(db)
 	h := NewPayments(db)
 
-	req, err := http.NewRequest("GET", "/payments/foobar", nil)
+	req, err := newTestRequest("GET", "/payments/foobar", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -84,13 +99,13 @@ func TestCreatePaymentThenGetAllPayments(t *testing.T) {
 	h := NewPayments(db)
 
 	// First, assert a unique resource is created
-	req, err := http.NewRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
-	router.HandleFunc("/payments/{id}", h.Create)
+	router.HandleFunc("/payments/{id}", h.Replace)
 	router.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
@@ -98,7 +113,7 @@ func TestCreatePaymentThenGetAllPayments(t *testing.T) {
 	}
 
 	// Second, assert that calling GetAll returns the new resource in an array of one element
-	req, err = http.NewRequest("GET", "/payments", nil)
+	req, err = newTestRequest("GET", "/payments", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -110,7 +125,7 @@ func TestCreatePaymentThenGetAllPayments(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
 	}
 	var payments []*data.Payment
-	if err := json.NewDecoder(rr.Body).Decode(&payments); err != nil {
+	if err := decodeData(rr.Body, &payments); err != nil {
 		t.Fatal("unable to decode response into JSON")
 	}
 	if len(payments) != 1 {
@@ -134,13 +149,13 @@ func TestCreatePaymentThenGetPayment(t *testing.T) {
 	h := NewPayments(db)
 
 	// First, assert a unique resource is created
-	req, err := http.NewRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
-	router.HandleFunc("/payments/{id}", h.Create)
+	router.HandleFunc("/payments/{id}", h.Replace)
 	router.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
@@ -148,7 +163,7 @@ func TestCreatePaymentThenGetPayment(t *testing.T) {
 	}
 
 	// Second, assert that calling Get returns the new resource
-	req, err = http.NewRequest("GET", "/payments/"+id, nil)
+	req, err = newTestRequest("GET", "/payments/"+id, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,7 +176,7 @@ func TestCreatePaymentThenGetPayment(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
 	}
 	var payment data.Payment
-	if err := json.NewDecoder(rr.Body).Decode(&payment); err != nil {
+	if err := decodeData(rr.Body, &payment); err != nil {
 		t.Fatal("unable to decode response into JSON")
 	}
 	if payment.ID != id {
@@ -173,39 +188,208 @@ func TestCreatePaymentThenGetPayment(t *testing.T) {
 	}
 }
 
-func TestCreatePaymentDuplicateID(t *testing.T) {
+func TestReplacePayment(t *testing.T) {
 	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
 
 	db := getTestDB(t)
 	defer cleanUp(db)
 	h := NewPayments(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", h.Replace)
+	put := func(id, ifMatch, body string) *httptest.ResponseRecorder {
+		req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ifMatch) > 0 {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// First, assert a unique resource is created where it was put
+	rr := put(id, "", exampleJSON)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+	if location := rr.Header().Get("Location"); location != "/payments/"+id {
+		t.Errorf("handler returned location '%s', we expected '/payments/%s'", location, id)
+	}
 
-	// First, assert a unique resource is created
-	req, err := http.NewRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	// Next repeat, which replaces the payment with the next version
+	rr = put(id, `"0"`, exampleJSON2)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+	}
+	var payment data.Payment
+	if err := decodeData(rr.Body, &payment); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if payment.Version != 1 || rr.Header().Get("ETag") != `"1"` ||
+		payment.Attributes.BeneficiaryParty.AccountName != "Foo Bar" {
+		t.Errorf("handler returned unexpected payment version %d, ETag %s, beneficiary '%s'", payment.Version,
+			rr.Header().Get("ETag"), payment.Attributes.BeneficiaryParty.AccountName)
+	}
+
+	for _, test := range []struct {
+		name, id, ifMatch, body string
+		status                  int
+	}{
+		{"stale If-Match", id, `"0"`, exampleJSON, http.StatusPreconditionFailed},
+		{"stale version", id, "", `{"version": 3, "attributes": {"amount": "1.00", "currency": "GBP"}}`,
+			http.StatusPreconditionFailed},
+		{"no amount", id, "", `{"attributes": {"currency": "GBP"}}`, http.StatusUnprocessableEntity},
+		{"negative amount", id, "", `{"attributes": {"amount": "-1.00", "currency": "GBP"}}`,
+			http.StatusUnprocessableEntity},
+		{"no currency", id, "", `{"attributes": {"amount": "1.00"}}`, http.StatusUnprocessableEntity},
+		{"If-Match on creation", "216d4da9-e59a-4cc6-8df3-3da6e7580b77", `"0"`, exampleJSON,
+			http.StatusPreconditionFailed},
+		{"not a UUID", "foobar", "", exampleJSON, http.StatusBadRequest},
+		{"upper case UUID", "4EE3A8D8-CA7B-4290-A52C-DD5B6165EC43", "", exampleJSON, http.StatusBadRequest},
+	} {
+		if rr := put(test.id, test.ifMatch, test.body); rr.Code != test.status {
+			t.Errorf("%s: handler returned wrong status code: got '%v' want '%v'", test.name, rr.Code, test.status)
+		}
+	}
+}
+
+func TestCreatePaymentServerID(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+	h := NewPayments(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", h.Create).Methods("POST")
+	router.HandleFunc("/payments/{id}", h.GetOne).Methods("GET")
+
+	// Only the server may choose the ID
+	req, err := newTestRequest("POST", "/payments", strings.NewReader(`{"id": "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"}`))
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	router := mux.NewRouter()
-	router.HandleFunc("/payments/{id}", h.Create)
 	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusBadRequest)
+	}
+
+	// Every payment needs a positive amount
+	req, err = newTestRequest("POST", "/payments", strings.NewReader(`{"attributes": {"amount": "0", "currency": "GBP"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusUnprocessableEntity)
+	}
 
+	req, err = newTestRequest("POST", "/payments", strings.NewReader(exampleJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusCreated {
-		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+	var payment data.Payment
+	if err := decodeData(rr.Body, &payment); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if !data.ValidID(payment.ID) || payment.Attributes.Status != data.StatusPending ||
+		payment.Attributes.BeneficiaryParty.AccountName != "W Owens" {
+		t.Errorf("handler returned unexpected payment %+v", payment)
 	}
 
-	// Next repeat and check it was a 400
-	req, err = http.NewRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	// The payment is where we were told it is
+	location := rr.Header().Get("Location")
+	if location != "/payments/"+payment.ID {
+		t.Fatalf("handler returned location '%s' for payment '%s'", location, payment.ID)
+	}
+	req, err = newTestRequest("GET", location, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	router = mux.NewRouter()
-	router.HandleFunc("/payments/{id}", h.Create)
 	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+	}
+}
 
-	if status := rr.Code; status != http.StatusBadRequest {
-		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusBadRequest)
+func TestCreatePaymentIdempotencyKey(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", NewPayments(db).Create).Methods("POST")
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req, err := newTestRequest("POST", "/payments", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(IdempotencyKeyHeader, key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	create := func(key string) (string, *data.Payment) {
+		rr := send(key, exampleJSON)
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+		}
+		var payment data.Payment
+		if err := decodeData(rr.Body, &payment); err != nil {
+			t.Fatal("unable to decode response into JSON")
+		}
+		return rr.Header().Get("Location"), &payment
+	}
+
+	// A retry is answered with the payment the first request created
+	location, first := create("order-42")
+	retried, second := create("order-42")
+	if retried != location || second.ID != first.ID || second.Version != first.Version {
+		t.Errorf("retry created %s version %d, we expected %s version %d", second.ID, second.Version,
+			first.ID, first.Version)
+	}
+	if _, other := create("order-43"); other.ID == first.ID {
+		t.Errorf("another key created the same payment %s", other.ID)
+	}
+
+	// A different payment sent with a key already used is refused
+	changed := strings.Replace(exampleJSON, `"100.21"`, `"200.42"`, 1)
+	if changed == exampleJSON {
+		t.Fatal("unable to change the amount of the example payment")
+	}
+	if rr := send("order-42", changed); rr.Code != http.StatusUnprocessableEntity ||
+		rr.Header().Get("Content-Type") != problem.ContentType {
+		t.Errorf("handler returned '%v' %s, we expected '%v' problem details", rr.Code,
+			rr.Header().Get("Content-Type"), http.StatusUnprocessableEntity)
+	}
+	pmts, err := db.ForOrganisation(testOrganisation).FetchAllPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pmts) != 2 {
+		t.Errorf("expected 2 payments, got %d", len(pmts))
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	since := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	handler := Deprecated(since, "https://example.com/docs", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	req, err := newTestRequest("POST", "/payments/foobar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTeapot || rr.Header().Get("Deprecation") != "@1792368000" ||
+		rr.Header().Get("Link") != `<https://example.com/docs>; rel="deprecation"` {
+		t.Errorf("unexpected deprecated response %d %v", rr.Code, rr.Header())
 	}
 }
 
@@ -215,12 +399,12 @@ func TestCreatePaymentNoID(t *testing.T) {
 	h := NewPayments(db)
 
 	// See what happens if don't include an ID - actually this should not be possible in the real world
-	req, err := http.NewRequest("PUT", "/payments/+", strings.NewReader(exampleJSON))
+	req, err := newTestRequest("PUT", "/payments/+", strings.NewReader(exampleJSON))
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(h.Create)
+	handler := http.HandlerFunc(h.Replace)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusBadRequest {
@@ -234,12 +418,12 @@ func TestCreatePaymentEmptyBody(t *testing.T) {
 	h := NewPayments(db)
 
 	// See what happens if we PUT without a body
-	req, err := http.NewRequest("PUT", "/payments/+", nil)
+	req, err := newTestRequest("PUT", "/payments/+", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(h.Create)
+	handler := http.HandlerFunc(h.Replace)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusBadRequest {
@@ -256,13 +440,13 @@ func TestUpdatePaymentHappyPath(t *testing.T) {
 	h := NewPayments(db)
 
 	// First, assert a unique resource is created
-	req, err := http.NewRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
-	router.HandleFunc("/payments/{id}", h.Create)
+	router.HandleFunc("/payments/{id}", h.Replace)
 	router.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
@@ -270,7 +454,7 @@ func TestUpdatePaymentHappyPath(t *testing.T) {
 	}
 
 	// Next update and check we get 200
-	req, err = http.NewRequest("POST", "/payments/"+id, strings.NewReader(exampleJSON2))
+	req, err = newTestRequest("POST", "/payments/"+id, strings.NewReader(exampleJSON2))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -284,7 +468,7 @@ func TestUpdatePaymentHappyPath(t *testing.T) {
 	}
 
 	// Check our change has been made
-	req, err = http.NewRequest("GET", "/payments/"+id, nil)
+	req, err = newTestRequest("GET", "/payments/"+id, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -297,7 +481,7 @@ func TestUpdatePaymentHappyPath(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
 	}
 	var payment data.Payment
-	if err := json.NewDecoder(rr.Body).Decode(&payment); err != nil {
+	if err := decodeData(rr.Body, &payment); err != nil {
 		t.Fatal("unable to decode response into JSON")
 	}
 	if payment.ID != id {
@@ -314,7 +498,7 @@ func TestUpdatePaymentBadRequest(t *testing.T) {
 	defer cleanUp(db)
 	h := NewPayments(db)
 
-	req, err := http.NewRequest("POST", "/payments/foobar", strings.NewReader(exampleJSON2))
+	req, err := newTestRequest("POST", "/payments/foobar", strings.NewReader(exampleJSON2))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -337,13 +521,13 @@ func TestDeletePaymentHappyPath(t *testing.T) {
 	h := NewPayments(db)
 
 	// First, assert a unique resource is created
-	req, err := http.NewRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
-	router.HandleFunc("/payments/{id}", h.Create)
+	router.HandleFunc("/payments/{id}", h.Replace)
 	router.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
@@ -351,7 +535,7 @@ func TestDeletePaymentHappyPath(t *testing.T) {
 	}
 
 	// Next delete and check we get 200
-	req, err = http.NewRequest("DELETE", "/payments/"+id, nil)
+	req, err = newTestRequest("DELETE", "/payments/"+id, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -365,7 +549,7 @@ func TestDeletePaymentHappyPath(t *testing.T) {
 	}
 
 	// Check our payment is gone
-	req, err = http.NewRequest("GET", "/payments/"+id, nil)
+	req, err = newTestRequest("GET", "/payments/"+id, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -377,6 +561,16 @@ func TestDeletePaymentHappyPath(t *testing.T) {
 	if status := rr.Code; status != http.StatusNotFound {
 		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusNotFound)
 	}
+
+	// A payment created again with the ID has none of the history of the old one
+	createTestPayment(t, db, id)
+	history, err := db.ForOrganisation(testOrganisation).FetchPaymentHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Kind != data.EventCreated {
+		t.Errorf("expected only the new payment's creation in its history, got %d events", len(history))
+	}
 }
 
 func TestDeletePaymentNotFound(t *testing.T) {
@@ -384,7 +578,7 @@ func TestDeletePaymentNotFound(t *testing.T) {
 	defer cleanUp(db)
 	h := NewPayments(db)
 
-	req, err := http.NewRequest("DELETE", "/payments/foobar", nil)
+	req, err := newTestRequest("DELETE", "/payments/foobar", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
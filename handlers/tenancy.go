@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+)
+
+// HeaderOrganisation names the organisation a super-admin is acting for
+const HeaderOrganisation = "X-Organisation-ID"
+
+// scope returns a database client restricted to the organisation of the
+// caller. Resources of other organisations are simply not visible to it, so
+// cross-tenant requests end in a 404. Super-admins choose the organisation
+// with the X-Organisation-ID header. Changes are recorded as made by the
+// caller. A nil client is returned along with the
+// status to respond with when the request cannot be scoped.
+func scope(db *data.Client, r *http.Request) (*data.Client, int) {
+	p, ok := auth.FromContext(r.Context())
+	if !ok {
+		return nil, http.StatusUnauthorized
+	}
+	organisationID := p.OrganisationID
+	if p.IsSuperAdmin() {
+		if h := r.Header.Get(HeaderOrganisation); len(h) > 0 {
+			organisationID = h
+		}
+	}
+	if len(organisationID) == 0 {
+		return nil, http.StatusBadRequest
+	}
+	logging.AddField(r.Context(), "organisation", organisationID)
+	return db.ForOrganisation(organisationID).As(p.Subject).WithContext(r.Context()), 0
+}
+
+// isSuperAdmin reports whether the caller is support staff
+func isSuperAdmin(r *http.Request) bool {
+	p, ok := auth.FromContext(r.Context())
+	return ok && p.IsSuperAdmin()
+}
+
+// callerOrganisation returns the caller's own organisation
+func callerOrganisation(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok {
+		return p.OrganisationID
+	}
+	return ""
+}
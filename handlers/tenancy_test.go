@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/gorilla/mux"
+)
+
+// testOrganisation is the organisation of the payments in test_data.go
+const testOrganisation = "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"
+
+// newTestRequest returns a request made by a caller from testOrganisation
+func newTestRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return newRequestAs(&auth.Principal{Subject: "test", OrganisationID: testOrganisation}, method, url, body)
+}
+
+func newRequestAs(p *auth.Principal, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p == nil {
+		return req, nil
+	}
+	return req.WithContext(auth.NewContext(req.Context(), p)), nil
+}
+
+func TestGetPaymentOtherOrganisation(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	h := NewPayments(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", h.GetAll)
+	router.HandleFunc("/payments/{id}", h.GetOne)
+
+	other := &auth.Principal{Subject: "other", OrganisationID: "0a5a3e2e-1b3c-4d5e-8f90-123456789abc"}
+
+	// Assert that another organisation cannot see the payment
+	req, err := newRequestAs(other, "GET", "/payments/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusNotFound)
+	}
+
+	// Nor is it listed for them
+	req, err = newRequestAs(other, "GET", "/payments", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	expected := `{"data":[],`
+	actual := rr.Body.String()
+	if !strings.HasPrefix(actual, expected) {
+		t.Errorf("handler returned unexpected body: got '%s' want '%s'", actual, expected)
+	}
+}
+
+func TestCreatePaymentOtherOrganisation(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).Replace)
+
+	// The payment names testOrganisation, which is not the caller's
+	other := &auth.Principal{Subject: "other", OrganisationID: "0a5a3e2e-1b3c-4d5e-8f90-123456789abc"}
+	req, err := newRequestAs(other, "PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusNotFound)
+	}
+}
+
+func TestGetPaymentSuperAdmin(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).GetOne)
+
+	admin := &auth.Principal{Subject: "support", Roles: []string{auth.RoleSuperAdmin}}
+
+	// Super-admins must say which organisation they are acting for
+	for header, expected := range map[string]int{"": http.StatusBadRequest, testOrganisation: http.StatusOK} {
+		req, err := newRequestAs(admin, "GET", "/payments/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(HeaderOrganisation, header)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, expected)
+		}
+	}
+}
+
+func TestGetPaymentUnauthenticated(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+
+	req, err := newRequestAs(nil, "GET", "/payments", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(NewPayments(db).GetAll).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusUnauthorized)
+	}
+}
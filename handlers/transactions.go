@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+// Transactions handlers for approving and settling a payment, the returns and
+// reversals linked to it, and its history
+type Transactions struct {
+	db *data.Client
+}
+
+// NewTransactions returns new handler with database client
+func NewTransactions(db *data.Client) *Transactions {
+	return &Transactions{db: db}
+}
+
+// List shows all returns and reversals for a payment
+func (t *Transactions) List(w http.ResponseWriter, r *http.Request) {
+	t.list(w, r, "")
+}
+
+// ListReturns shows the returns for a payment
+func (t *Transactions) ListReturns(w http.ResponseWriter, r *http.Request) {
+	t.list(w, r, data.TypeReturn)
+}
+
+// ListReversals shows the reversals for a payment
+func (t *Transactions) ListReversals(w http.ResponseWriter, r *http.Request) {
+	t.list(w, r, data.TypeReversal)
+}
+
+func (t *Transactions) list(w http.ResponseWriter, r *http.Request, kind string) {
+	db, status := scope(t.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	txns, err := db.FetchLinkedTransactions(params["id"])
+	if err != nil {
+		if err.Error() == ErrNotFound.Error() {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			logging.FromContext(r.Context()).Errorf("Error getting linked transactions: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	filtered := []*data.LinkedTransaction{}
+	for _, txn := range txns {
+		if len(kind) == 0 || txn.Type == kind {
+			filtered = append(filtered, txn)
+		}
+	}
+	writeCollection(w, r, filtered)
+}
+
+// Settle a pending payment, posting it to the ledger
+func (t *Transactions) Settle(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(t.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	params := mux.Vars(r)
+	pmt, err := db.SettlePayment(params["id"])
+	if err != nil {
+		switch err {
+		case data.ErrNotPending, data.ErrDebtorAccountNotFound:
+			w.WriteHeader(http.StatusConflict)
+		case data.ErrInvalidAmount, data.ErrNoCurrency:
+			problem.Write(w, http.StatusUnprocessableEntity, err.Error())
+		default:
+			if err.Error() == ErrNotFound.Error() {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				logging.FromContext(r.Context()).Errorf("Error settling payment: %s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+		return
+	}
+	writeResource(w, r, http.StatusOK, pmt)
+}
+
+// CreateReturn returns some or all of a payment
+func (t *Transactions) CreateReturn(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(t.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	var ret data.LinkedTransaction
+	if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := decode(r, &ret); err != nil {
+		logging.FromContext(r.Context()).Errorf("Error decoding create return request: %s", err)
+		writeBodyError(w, err)
+		return
+	}
+	t.create(w, r, &ret, db.CreateReturn)
+}
+
+// CreateReversal reverses the outstanding amount of a payment, a body is optional
+func (t *Transactions) CreateReversal(w http.ResponseWriter, r *http.Request) {
+	db, status := scope(t.db, r)
+	if db == nil {
+		w.WriteHeader(status)
+		return
+	}
+	var rev data.LinkedTransaction
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := decode(r, &rev); err != nil {
+			logging.FromContext(r.Context()).Errorf("Error decoding create reversal request: %s", err)
+			writeBodyError(w, err)
+			return
+		}
+	}
+	t.create(w, r, &rev, db.CreateReversal)
+}
+
+func (t *Transactions) create(w http.ResponseWriter, r *http.Request, txn *data.LinkedTransaction,
+	save func(string, *data.LinkedTransaction) error) {
+	if len(txn.ID) > 0 {
+		problem.Write(w, http.StatusBadRequest, "the id of a return or reversal is chosen by the server")
+		return
+	}
+	params := mux.Vars(r)
+	if err := save(params["id"], txn); err != nil {
+		switch err {
+		case data.ErrInvalidAmount, data.ErrCurrencyMismatch, data.ErrAmountExceeded:
+			w.WriteHeader(http.StatusBadRequest)
+		case data.ErrPaymentClosed, data.ErrNotApproved, data.ErrNotSettled:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			if err.Error() == ErrNotFound.Error() {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				logging.FromContext(r.Context()).Errorf("Error saving linked transaction: %s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+		return
+	}
+	writeResource(w, r, http.StatusCreated, txn)
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/gorilla/mux"
+)
+
+func createTestPayment(t *testing.T, db *data.Client, id string) {
+	req, err := newTestRequest("PUT", "/payments/"+id, strings.NewReader(exampleJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", NewPayments(db).Replace)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("unable to create test payment: got '%v' want '%v'", status, http.StatusCreated)
+	}
+}
+
+// settleTestPayment settles a test payment from the debtor's account, so that
+// it can be returned or reversed
+func settleTestPayment(t *testing.T, db *data.Client, id string) {
+	router := accountsRouter(db)
+	for _, step := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/accounts/c6e3a8d8-ca7b-4290-a52c-dd5b6165ec43", debtorAccountJSON, http.StatusCreated},
+		{"POST", "/payments/" + id + "/settle", "", http.StatusOK},
+	} {
+		req, err := newTestRequest(step.method, step.path, strings.NewReader(step.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != step.status {
+			t.Fatalf("unable to settle test payment: got '%v' want '%v'", status, step.status)
+		}
+	}
+}
+
+func transactionsRouter(db *data.Client) *mux.Router {
+	h := NewTransactions(db)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}/transactions", h.List).Methods("GET")
+	router.HandleFunc("/payments/{id}/returns", h.ListReturns).Methods("GET")
+	router.HandleFunc("/payments/{id}/returns", h.CreateReturn).Methods("POST")
+	router.HandleFunc("/payments/{id}/reversals", h.ListReversals).Methods("GET")
+	router.HandleFunc("/payments/{id}/reversals", h.CreateReversal).Methods("POST")
+	return router
+}
+
+func TestCreateReturnThenReversal(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	router := transactionsRouter(db)
+
+	// Nothing can be given back until the payment has settled
+	for _, path := range []string{"/returns", "/reversals"} {
+		req, err := newTestRequest("POST", "/payments/"+id+path, strings.NewReader(`{"attributes":{"amount":"50.00"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusConflict {
+			t.Errorf("%s: handler returned wrong status code: got '%v' want '%v'", path, status, http.StatusConflict)
+		}
+	}
+	settleTestPayment(t, db, id)
+
+	// First, a partial return of the 100.21 payment
+	req, err := newTestRequest("POST", "/payments/"+id+"/returns",
+		strings.NewReader(`{"attributes":{"amount":"50.00","reason":"Duplicate"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+	var ret data.LinkedTransaction
+	if err := decodeData(rr.Body, &ret); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if ret.PaymentID != id || ret.Type != data.TypeReturn || ret.Attributes.Currency != "GBP" {
+		t.Fatalf("handler returned unexpected return: %+v", ret)
+	}
+	pmt, err := db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmt.Attributes.Status != data.StatusPartiallyReturned {
+		t.Fatalf("payment has status '%s', we expected '%s'", pmt.Attributes.Status, data.StatusPartiallyReturned)
+	}
+
+	// Next, a reversal should cover the outstanding 50.21
+	req, err = newTestRequest("POST", "/payments/"+id+"/reversals", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+	var rev data.LinkedTransaction
+	if err := decodeData(rr.Body, &rev); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if rev.Attributes.Amount != "50.21" {
+		t.Fatalf("reversal has amount '%s', we expected '50.21'", rev.Attributes.Amount)
+	}
+	pmt, err = db.ForOrganisation(testOrganisation).FetchPayment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmt.Attributes.Status != data.StatusReversed {
+		t.Fatalf("payment has status '%s', we expected '%s'", pmt.Attributes.Status, data.StatusReversed)
+	}
+
+	// Finally, both should be listed against the payment
+	req, err = newTestRequest("GET", "/payments/"+id+"/transactions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusOK)
+	}
+	var txns []*data.LinkedTransaction
+	if err := decodeData(rr.Body, &txns); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if len(txns) != 2 {
+		t.Fatalf("handler returned %d transactions, we wanted 2", len(txns))
+	}
+}
+
+func TestCreateReturnExceedsAmount(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	settleTestPayment(t, db, id)
+	router := transactionsRouter(db)
+
+	for i, expected := range []int{http.StatusCreated, http.StatusBadRequest} {
+		req, err := newTestRequest("POST", "/payments/"+id+"/returns",
+			strings.NewReader(`{"attributes":{"amount":"60.00"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// Assert that the second return takes the total past 100.21 and is rejected
+		if status := rr.Code; status != expected {
+			t.Errorf("return %d: handler returned wrong status code: got '%v' want '%v'", i, status, expected)
+		}
+	}
+}
+
+func TestCreateReversalAfterPreciseReturn(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	settleTestPayment(t, db, id)
+	router := transactionsRouter(db)
+
+	req, err := newTestRequest("POST", "/payments/"+id+"/returns",
+		strings.NewReader(`{"attributes":{"amount":"0.005"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+
+	// The reversal keeps the third decimal place of the return, rather than
+	// rounding to the two of the 100.21 payment
+	req, err = newTestRequest("POST", "/payments/"+id+"/reversals", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var rev data.LinkedTransaction
+	if err := decodeData(rr.Body, &rev); err != nil {
+		t.Fatal("unable to decode response into JSON")
+	}
+	if rev.Attributes.Amount != "100.205" {
+		t.Fatalf("reversal has amount '%s', we expected '100.205'", rev.Attributes.Amount)
+	}
+}
+
+func TestCreateReturnPaymentNotFound(t *testing.T) {
+	db := getTestDB(t)
+	defer cleanUp(db)
+	router := transactionsRouter(db)
+
+	req, err := newTestRequest("POST", "/payments/foobar/returns", strings.NewReader(`{"attributes":{"amount":"1.00"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusNotFound)
+	}
+}
+
+func TestCreateReturnWithID(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	settleTestPayment(t, db, id)
+	router := transactionsRouter(db)
+
+	// The ID of a return already recorded must not let another replace it
+	var first data.LinkedTransaction
+	for i, body := range []string{
+		`{"attributes":{"amount":"100.00"}}`,
+		`{"id":"%s","attributes":{"amount":"0.21"}}`,
+	} {
+		if i > 0 {
+			body = strings.Replace(body, "%s", first.ID, 1)
+		}
+		req, err := newTestRequest("POST", "/payments/"+id+"/returns", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		expected := []int{http.StatusCreated, http.StatusBadRequest}[i]
+		if status := rr.Code; status != expected {
+			t.Errorf("return %d: handler returned wrong status code: got '%v' want '%v'", i, status, expected)
+		}
+		if i == 0 {
+			if err := decodeData(rr.Body, &first); err != nil {
+				t.Fatal("unable to decode response into JSON")
+			}
+		}
+	}
+	txns, err := db.ForOrganisation(testOrganisation).FetchLinkedTransactions(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 1 || txns[0].Attributes.Amount != "100.00" {
+		t.Errorf("expected only the first return, got %d transactions", len(txns))
+	}
+}
+
+func TestDeletePaymentWithReturn(t *testing.T) {
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	db := getTestDB(t)
+	defer cleanUp(db)
+	createTestPayment(t, db, id)
+	settleTestPayment(t, db, id)
+	router := transactionsRouter(db)
+	router.HandleFunc("/payments/{id}", NewPayments(db).Delete).Methods("DELETE")
+
+	req, err := newTestRequest("POST", "/payments/"+id+"/returns", strings.NewReader(`{"attributes":{"amount":"10.00"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusCreated)
+	}
+
+	// Assert that a payment which has been returned is kept, with its return
+	req, err = newTestRequest("DELETE", "/payments/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got '%v' want '%v'", status, http.StatusConflict)
+	}
+	txns, err := db.ForOrganisation(testOrganisation).FetchLinkedTransactions(id)
+	if err != nil || len(txns) != 1 {
+		t.Errorf("expected the payment and its return to be kept, got %d transactions %v", len(txns), err)
+	}
+}
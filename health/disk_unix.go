@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package health
+
+import "syscall"
+
+// freeBytes returns the space available to unprivileged users on the file
+// system holding dir
+func freeBytes(dir string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return uint64(fs.Bavail) * uint64(fs.Bsize), nil
+}
@@ -0,0 +1,131 @@
+// Package health serves liveness and readiness checks for orchestrators
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/adampointer/restservice/data"
+)
+
+// Check statuses
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Check is the outcome of one readiness check
+type Check struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is the body of a health response
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]*Check `json:"checks,omitempty"`
+}
+
+// Checker decides whether the service is alive and ready for requests
+type Checker struct {
+	db           *data.Client
+	minFreeBytes uint64
+	draining     int32
+}
+
+// NewChecker returns a checker of db, which is not ready when the disk
+// holding it has less than minFreeBytes free
+func NewChecker(db *data.Client, minFreeBytes uint64) *Checker {
+	return &Checker{db: db, minFreeBytes: minFreeBytes}
+}
+
+// Drain marks the service as shutting down, so that it is no longer ready
+func (c *Checker) Drain() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+// Draining tells whether shutdown has started
+func (c *Checker) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// Ready runs every readiness check
+func (c *Checker) Ready() *Report {
+	report := &Report{Status: StatusOK, Checks: map[string]*Check{
+		"database":   c.database(),
+		"migrations": c.migrations(),
+		"disk":       c.disk(),
+		"draining":   c.drain(),
+	}}
+	for _, check := range report.Checks {
+		if check.Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	return report
+}
+
+// Live responds 200 for as long as the process can serve requests
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	write(w, &Report{Status: StatusOK})
+}
+
+// Readiness responds 200 when the service is ready for requests, and 503 with
+// the failing checks otherwise
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	write(w, c.Ready())
+}
+
+func (c *Checker) database() *Check {
+	if err := c.db.Ping(); err != nil {
+		return unavailable("unable to start a read transaction: %s", err)
+	}
+	return &Check{Status: StatusOK}
+}
+
+func (c *Checker) migrations() *Check {
+	pending, err := c.db.PendingMigrations()
+	if err != nil {
+		return unavailable("unable to read migrations: %s", err)
+	}
+	if len(pending) > 0 {
+		return unavailable("pending migrations: %s", strings.Join(pending, ", "))
+	}
+	return &Check{Status: StatusOK}
+}
+
+func (c *Checker) disk() *Check {
+	free, err := freeBytes(filepath.Dir(c.db.Path()))
+	if err != nil {
+		return unavailable("unable to read free space: %s", err)
+	}
+	if free < c.minFreeBytes {
+		return unavailable("%d bytes free, below the minimum of %d", free, c.minFreeBytes)
+	}
+	return &Check{Status: StatusOK, Detail: fmt.Sprintf("%d bytes free", free)}
+}
+
+func (c *Checker) drain() *Check {
+	if c.Draining() {
+		return unavailable("shutting down")
+	}
+	return &Check{Status: StatusOK}
+}
+
+func unavailable(format string, args ...interface{}) *Check {
+	return &Check{Status: StatusUnavailable, Detail: fmt.Sprintf(format, args...)}
+}
+
+func write(w http.ResponseWriter, report *Report) {
+	w.Header().Set("Content-Type", "application/json")
+	// Health is never cached, so that a change is seen by the next probe
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
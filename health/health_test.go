@@ -0,0 +1,79 @@
+package health
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adampointer/restservice/data"
+)
+
+func getTestDB(t *testing.T) *data.Client {
+	dir, err := ioutil.TempDir("", "health_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := data.NewClient(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func probe(t *testing.T, handler http.HandlerFunc) (int, *Report) {
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/", nil))
+	var report Report
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, &report
+}
+
+func TestReadiness(t *testing.T) {
+	db := getTestDB(t)
+	defer os.RemoveAll(filepath.Dir(db.Path()))
+	defer db.Close()
+	checker := NewChecker(db, 1)
+
+	status, report := probe(t, checker.Readiness)
+	if status != http.StatusOK || report.Status != StatusOK {
+		t.Errorf("not ready with a fresh database: %d %+v", status, report)
+	}
+	for _, name := range []string{"database", "migrations", "disk", "draining"} {
+		if check := report.Checks[name]; check == nil || check.Status != StatusOK {
+			t.Errorf("check %s is %+v, we expected it to pass", name, check)
+		}
+	}
+
+	checker.Drain()
+	status, report = probe(t, checker.Readiness)
+	if status != http.StatusServiceUnavailable || report.Checks["draining"].Status != StatusUnavailable {
+		t.Errorf("still ready while draining: %d %+v", status, report.Checks["draining"])
+	}
+	// Still alive, so not restarted while requests drain
+	if status, report = probe(t, checker.Live); status != http.StatusOK || report.Status != StatusOK {
+		t.Errorf("not alive while draining: %d %+v", status, report)
+	}
+}
+
+func TestReadinessChecks(t *testing.T) {
+	db := getTestDB(t)
+	defer os.RemoveAll(filepath.Dir(db.Path()))
+
+	// No disk has this much free space
+	status, report := probe(t, NewChecker(db, 1<<62).Readiness)
+	if status != http.StatusServiceUnavailable || report.Checks["disk"].Status != StatusUnavailable {
+		t.Errorf("ready without enough disk space: %d %+v", status, report.Checks["disk"])
+	}
+
+	db.Close()
+	status, report = probe(t, NewChecker(db, 1).Readiness)
+	if status != http.StatusServiceUnavailable || report.Checks["database"].Status != StatusUnavailable {
+		t.Errorf("ready with the database closed: %d %+v", status, report.Checks["database"])
+	}
+}
@@ -0,0 +1,32 @@
+// Package httpstatus records what was written to a response, for the
+// middleware which logs, measures and traces requests
+package httpstatus
+
+import "net/http"
+
+// Writer remembers the status and size of a response
+type Writer struct {
+	http.ResponseWriter
+	// Status is 200 until another is written
+	Status int
+	// Bytes is the size of the body written so far
+	Bytes int
+}
+
+// NewWriter wraps w
+func NewWriter(w http.ResponseWriter) *Writer {
+	return &Writer{ResponseWriter: w, Status: http.StatusOK}
+}
+
+// WriteHeader records and writes the status
+func (w *Writer) WriteHeader(status int) {
+	w.Status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts and writes part of the body
+func (w *Writer) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += n
+	return n, err
+}
@@ -0,0 +1,20 @@
+package httpstatus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	w := NewWriter(httptest.NewRecorder())
+	if w.Status != http.StatusOK || w.Bytes != 0 {
+		t.Errorf("expected 200 and no bytes before anything is written, got %d and %d", w.Status, w.Bytes)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("hello"))
+	w.Write([]byte(" world"))
+	if w.Status != http.StatusCreated || w.Bytes != 11 {
+		t.Errorf("expected 201 and 11 bytes, got %d and %d", w.Status, w.Bytes)
+	}
+}
@@ -0,0 +1,166 @@
+// Package lifecycle runs the HTTP server and background workers, and shuts
+// them down in order: in-flight requests drain, workers finish, and only then
+// are resources such as the database closed
+package lifecycle
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit statuses returned by Run
+const (
+	// ExitOK means the process was asked to stop and shut down cleanly
+	ExitOK = 0
+	// ExitServeError means the server stopped by itself, such as when its
+	// address is in use
+	ExitServeError = 1
+	// ExitTimeout means requests or workers were still running when the
+	// shutdown deadline passed, so resources were left open
+	ExitTimeout = 3
+)
+
+// Manager coordinates the startup and shutdown of the service
+type Manager struct {
+	drainTimeout time.Duration
+	gracePeriod  time.Duration
+
+	servers  []*http.Server
+	errs     chan error
+	stop     chan struct{}
+	requests sync.WaitGroup
+	workers  sync.WaitGroup
+	draining []func()
+	closers  []closer
+}
+
+type closer struct {
+	name string
+	fn   func() error
+}
+
+// New returns a manager giving in-flight requests drainTimeout to finish, and
+// the whole shutdown gracePeriod
+func New(drainTimeout, gracePeriod time.Duration) *Manager {
+	return &Manager{
+		drainTimeout: drainTimeout,
+		gracePeriod:  gracePeriod,
+		// Buffered so that servers stopping at once never block
+		errs: make(chan error, 8),
+		stop: make(chan struct{}),
+	}
+}
+
+// Serve runs serve, usually srv.ListenAndServe, in the background. The server
+// is shut down by Run, and an error other than http.ErrServerClosed starts
+// the shutdown.
+func (m *Manager) Serve(srv *http.Server, serve func() error) {
+	m.servers = append(m.servers, srv)
+	// Handlers are tracked because closing connections does not stop them
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.requests.Add(1)
+		defer m.requests.Done()
+		next.ServeHTTP(w, r)
+	})
+	go func() {
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			select {
+			case m.errs <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// Go runs a background worker, which must return once stop is closed
+func (m *Manager) Go(name string, worker func(stop <-chan struct{})) {
+	m.workers.Add(1)
+	go func() {
+		defer m.workers.Done()
+		worker(m.stop)
+		log.Debugf("%s stopped", name)
+	}()
+}
+
+// OnDrain registers fn to be called as soon as shutdown starts, before
+// in-flight requests drain
+func (m *Manager) OnDrain(fn func()) {
+	m.draining = append(m.draining, fn)
+}
+
+// OnClose registers fn to release a resource once requests have drained and
+// every worker has stopped. Resources are closed in the reverse order of
+// registration, so those opened first are closed last.
+func (m *Manager) OnClose(name string, fn func() error) {
+	m.closers = append(m.closers, closer{name: name, fn: fn})
+}
+
+// Run waits for a signal or a server to fail, shuts everything down and
+// returns the status the process should exit with
+func (m *Manager) Run(signals <-chan os.Signal) int {
+	status := ExitOK
+	select {
+	case sig := <-signals:
+		log.Infof("received %s, shutting down", sig)
+	case err := <-m.errs:
+		log.Errorf("serve error: %s", err)
+		status = ExitServeError
+	}
+	if !m.Shutdown() && status == ExitOK {
+		status = ExitTimeout
+	}
+	log.Info("terminating")
+	return status
+}
+
+// Shutdown stops the servers and workers and closes resources, telling
+// whether it finished within the grace period
+func (m *Manager) Shutdown() bool {
+	deadline := time.Now().Add(m.gracePeriod)
+	close(m.stop)
+	for _, fn := range m.draining {
+		fn()
+	}
+
+	log.Infof("draining requests for up to %s", m.drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), m.drainTimeout)
+	defer cancel()
+	clean := true
+	for _, srv := range m.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("requests still in flight, closing their connections: %s", err)
+			srv.Close()
+			clean = false
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.requests.Wait()
+		m.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		// Closing the database under a handler or worker risks its writes,
+		// so it is left for the operating system to release
+		log.Errorf("requests or workers still running after %s, not closing resources", m.gracePeriod)
+		return false
+	}
+
+	for i := len(m.closers) - 1; i >= 0; i-- {
+		c := m.closers[i]
+		if err := c.fn(); err != nil {
+			log.Errorf("error closing %s: %s", c.name, err)
+			clean = false
+		}
+	}
+	return clean
+}
@@ -0,0 +1,118 @@
+package lifecycle
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listen starts srv on a free local port and returns its URL
+func listen(t *testing.T, m *Manager, srv *http.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Serve(srv, func() error { return srv.Serve(l) })
+	return "http://" + l.Addr().String()
+}
+
+func TestShutdownOrder(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	m := New(time.Second, 2*time.Second)
+	started := make(chan struct{})
+	url := listen(t, m, &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		record("request")
+	})})
+	m.Go("worker", func(stop <-chan struct{}) {
+		<-stop
+		time.Sleep(50 * time.Millisecond)
+		record("worker")
+	})
+	m.OnDrain(func() { record("drain") })
+	m.OnClose("database", func() error {
+		record("database")
+		return nil
+	})
+	m.OnClose("tracer", func() error {
+		record("tracer")
+		return nil
+	})
+
+	responded := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		responded <- err
+	}()
+	<-started
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	if status := m.Run(signals); status != ExitOK {
+		t.Errorf("exit status %d, we expected %d", status, ExitOK)
+	}
+	if err := <-responded; err != nil {
+		t.Errorf("in-flight request failed: %s", err)
+	}
+
+	// The request and worker may finish in either order, but both before
+	// anything is closed
+	if len(events) != 5 || events[0] != "drain" || events[3] != "tracer" || events[4] != "database" {
+		t.Errorf("unexpected shutdown order: %v", events)
+	}
+}
+
+func TestServeError(t *testing.T) {
+	m := New(time.Second, time.Second)
+	closed := false
+	m.Serve(&http.Server{Handler: http.NotFoundHandler()}, func() error {
+		return errors.New("address already in use")
+	})
+	m.OnClose("database", func() error {
+		closed = true
+		return nil
+	})
+	if status := m.Run(make(chan os.Signal)); status != ExitServeError {
+		t.Errorf("exit status %d, we expected %d", status, ExitServeError)
+	}
+	if !closed {
+		t.Error("database not closed after the server failed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	m := New(50*time.Millisecond, 100*time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	m.Go("stuck", func(stop <-chan struct{}) {
+		<-release
+	})
+	closed := false
+	m.OnClose("database", func() error {
+		closed = true
+		return nil
+	})
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGINT
+	if status := m.Run(signals); status != ExitTimeout {
+		t.Errorf("exit status %d, we expected %d", status, ExitTimeout)
+	}
+	if closed {
+		t.Error("database closed while a worker was still running")
+	}
+}
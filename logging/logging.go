@@ -0,0 +1,139 @@
+// Package logging gives each request an ID and a logger which carries it,
+// and writes an access log line for every request
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/adampointer/restservice/internal/httpstatus"
+	"github.com/adampointer/restservice/tracing"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// HeaderRequestID carries the ID of a request, from the caller if they chose
+// one and back to them in the response
+const HeaderRequestID = "X-Request-ID"
+
+// validRequestID limits the IDs accepted from callers to something safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestLog is shared by every context derived from the request's, so that
+// fields added by inner middleware and handlers reach the access log
+type requestLog struct {
+	mu     sync.Mutex
+	entry  *log.Entry
+	fields log.Fields
+}
+
+type contextKey int
+
+const logKey contextKey = 0
+
+// FromContext returns the logger of the request a context belongs to, or the
+// standard logger outside of a request
+func FromContext(ctx context.Context) *log.Entry {
+	if rl, ok := ctx.Value(logKey).(*requestLog); ok {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return rl.entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// RequestID returns the ID of the request a context belongs to
+func RequestID(ctx context.Context) string {
+	if rl, ok := ctx.Value(logKey).(*requestLog); ok {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		id, _ := rl.fields["request_id"].(string)
+		return id
+	}
+	return ""
+}
+
+// AddField adds a field to the request's logger and its access log line
+func AddField(ctx context.Context, key string, value interface{}) {
+	if rl, ok := ctx.Value(logKey).(*requestLog); ok {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		rl.entry = rl.entry.WithField(key, value)
+		rl.fields[key] = value
+	}
+}
+
+// Logger assigns request IDs and writes access logs
+type Logger struct {
+	access *log.Logger
+}
+
+// New returns a logger writing access logs as JSON to w, or none when w is nil
+func New(w io.Writer) *Logger {
+	l := &Logger{}
+	if w != nil {
+		l.access = &log.Logger{
+			Out:       w,
+			Formatter: &log.JSONFormatter{},
+			Hooks:     make(log.LevelHooks),
+			Level:     log.InfoLevel,
+		}
+	}
+	return l
+}
+
+// Middleware gives each request an ID, which is returned in the response,
+// and a logger in its context carrying the ID and any trace ID. A line is
+// written to the access log once the request has been served.
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+
+		fields := log.Fields{"request_id": id}
+		if span := tracing.FromContext(r.Context()); span != nil {
+			fields["trace_id"] = hex.EncodeToString(span.TraceID[:])
+		}
+		rl := &requestLog{entry: log.WithFields(fields), fields: fields}
+		sw := httpstatus.NewWriter(w)
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), logKey, rl)))
+
+		if l.access == nil {
+			return
+		}
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		l.access.WithFields(rl.fields).WithFields(log.Fields{
+			"method":     r.Method,
+			"route":      route,
+			"status":     sw.Status,
+			"bytes":      sw.Bytes,
+			"latency_ms": float64(time.Since(start).Nanoseconds()) / 1e6,
+			"remote":     r.RemoteAddr,
+		}).Info("request")
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("Error generating request ID: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMiddleware(t *testing.T) {
+	var access, app bytes.Buffer
+	log.SetOutput(&app)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(&log.TextFormatter{})
+	}()
+
+	router := mux.NewRouter()
+	router.Use(New(&access).Middleware)
+	router.HandleFunc("/payments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		AddField(r.Context(), "organisation", "acme")
+		FromContext(r.Context()).Error("Error saving new payment")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("bad"))
+	})
+
+	req := httptest.NewRequest("PUT", "/payments/1", nil)
+	req.Header.Set(HeaderRequestID, "caller-chosen.1")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if id := rr.Header().Get(HeaderRequestID); id != "caller-chosen.1" {
+		t.Errorf("response has request ID '%s', we expected the caller's", id)
+	}
+	var appLine, accessLine map[string]interface{}
+	if err := json.Unmarshal(app.Bytes(), &appLine); err != nil {
+		t.Fatalf("unable to decode log line '%s': %s", app.String(), err)
+	}
+	if appLine["request_id"] != "caller-chosen.1" || appLine["organisation"] != "acme" {
+		t.Errorf("handler log line lacks request context: %v", appLine)
+	}
+	if err := json.Unmarshal(access.Bytes(), &accessLine); err != nil {
+		t.Fatalf("unable to decode access log line '%s': %s", access.String(), err)
+	}
+	for k, v := range map[string]interface{}{
+		"request_id":   "caller-chosen.1",
+		"method":       "PUT",
+		"route":        "/payments/{id}",
+		"status":       float64(http.StatusBadRequest),
+		"bytes":        float64(3),
+		"organisation": "acme",
+	} {
+		if accessLine[k] != v {
+			t.Errorf("access log has %s '%v', we expected '%v'", k, accessLine[k], v)
+		}
+	}
+	if _, ok := accessLine["latency_ms"].(float64); !ok {
+		t.Errorf("access log has no latency: %v", accessLine)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	var seen string
+	handler := New(nil).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+	for _, id := range []string{"", "has spaces", "bad\nid"} {
+		req := httptest.NewRequest("GET", "/payments", nil)
+		req.Header.Set(HeaderRequestID, id)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		got := rr.Header().Get(HeaderRequestID)
+		if len(got) != 32 || got != seen {
+			t.Errorf("request ID '%s' replaced with '%s', seen by the handler as '%s'", id, got, seen)
+		}
+	}
+}
@@ -1,76 +1,307 @@
 package main
 
 import (
-	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/config"
 	"github.com/adampointer/restservice/data"
 	"github.com/adampointer/restservice/handlers"
+	"github.com/adampointer/restservice/health"
+	"github.com/adampointer/restservice/lifecycle"
+	"github.com/adampointer/restservice/logging"
+	"github.com/adampointer/restservice/metrics"
+	"github.com/adampointer/restservice/openapi"
+	"github.com/adampointer/restservice/ratelimit"
+	"github.com/adampointer/restservice/tracing"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
 
-func routes(h handlers.Handler) *mux.Router {
+// Updating a payment with POST to its URL is deprecated in favour of PUT and
+// PATCH, and is only routed while features.legacy_routes is on
+var (
+	legacyDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacyDocs       = "https://github.com/adampointer/restservice#api"
+)
+
+func routes(h *handlers.Payments, t *handlers.Transactions, p handlers.Handler, a *handlers.Accounts,
+	o handlers.Handler, k *handlers.APIKeys, legacy bool) *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/payments", h.GetAll).Methods("GET")
-	router.HandleFunc("/payments/{id}", h.GetOne).Methods("GET")
-	router.HandleFunc("/payments/{id}", h.Create).Methods("PUT")
-	router.HandleFunc("/payments/{id}", h.Update).Methods("POST")
-	router.HandleFunc("/payments/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc("/payments", h.GetAll).Methods("GET").Name("payments.list")
+	router.HandleFunc("/payments", h.Create).Methods("POST").Name("payments.create")
+	router.HandleFunc("/payments/{id}", h.GetOne).Methods("GET").Name("payments.get")
+	router.HandleFunc("/payments/{id}", h.Replace).Methods("PUT").Name("payments.replace")
+	if legacy {
+		router.HandleFunc("/payments/{id}", handlers.Deprecated(legacyDeprecated, legacyDocs, h.Update)).
+			Methods("POST").Name("payments.update")
+	}
+	router.HandleFunc("/payments/{id}", h.Patch).Methods("PATCH").Name("payments.patch")
+	router.HandleFunc("/payments/{id}", h.Delete).Methods("DELETE").Name("payments.delete")
+	router.HandleFunc("/payments/{id}/approvals", t.ListApprovals).Methods("GET").Name("approvals.list")
+	router.HandleFunc("/payments/{id}/approvals", t.Approve).Methods("POST").Name("approvals.create")
+	router.HandleFunc("/payments/{id}/history", t.History).Methods("GET").Name("payments.history")
+	router.HandleFunc("/payments/{id}/settle", t.Settle).Methods("POST").Name("payments.settle")
+	router.HandleFunc("/payments/{id}/transactions", t.List).Methods("GET").Name("transactions.list")
+	router.HandleFunc("/payments/{id}/returns", t.ListReturns).Methods("GET").Name("returns.list")
+	router.HandleFunc("/payments/{id}/returns", t.CreateReturn).Methods("POST").Name("returns.create")
+	router.HandleFunc("/payments/{id}/reversals", t.ListReversals).Methods("GET").Name("reversals.list")
+	router.HandleFunc("/payments/{id}/reversals", t.CreateReversal).Methods("POST").Name("reversals.create")
+	router.HandleFunc("/parties", p.GetAll).Methods("GET").Name("parties.list")
+	router.HandleFunc("/parties/{id}", p.GetOne).Methods("GET").Name("parties.get")
+	router.HandleFunc("/parties/{id}", p.Create).Methods("PUT").Name("parties.create")
+	router.HandleFunc("/parties/{id}", p.Update).Methods("POST").Name("parties.update")
+	router.HandleFunc("/parties/{id}", p.Delete).Methods("DELETE").Name("parties.delete")
+	router.HandleFunc("/accounts", a.GetAll).Methods("GET").Name("accounts.list")
+	router.HandleFunc("/accounts/{id}", a.GetOne).Methods("GET").Name("accounts.get")
+	router.HandleFunc("/accounts/{id}", a.Create).Methods("PUT").Name("accounts.create")
+	router.HandleFunc("/accounts/{id}", a.Update).Methods("POST").Name("accounts.update")
+	router.HandleFunc("/accounts/{id}", a.Delete).Methods("DELETE").Name("accounts.delete")
+	router.HandleFunc("/accounts/{id}/balance", a.Balance).Methods("GET").Name("accounts.balance")
+	router.HandleFunc("/accounts/{id}/entries", a.Entries).Methods("GET").Name("accounts.entries")
+	router.HandleFunc("/organisations", o.GetAll).Methods("GET").Name("organisations.list")
+	router.HandleFunc("/organisations/{id}", o.GetOne).Methods("GET").Name("organisations.get")
+	router.HandleFunc("/organisations/{id}", o.Create).Methods("PUT").Name("organisations.create")
+	router.HandleFunc("/organisations/{id}", o.Update).Methods("POST").Name("organisations.update")
+	router.HandleFunc("/organisations/{id}", o.Delete).Methods("DELETE").Name("organisations.delete")
+	router.HandleFunc("/organisations/{id}/keys", k.List).Methods("GET").Name("keys.list")
+	router.HandleFunc("/organisations/{id}/keys", k.Issue).Methods("POST").Name("keys.issue")
+	router.HandleFunc("/organisations/{id}/keys/{key}", k.Revoke).Methods("DELETE").Name("keys.revoke")
 	return router
 }
 
-func listenTCP(stop chan bool, errs chan error) {
-	// The db path and listen address should really be from flags/config
-	dbClient, err := data.NewClient("data.db")
+// apiInfo heads the OpenAPI document
+var apiInfo = openapi.Info{
+	Title:       "restservice",
+	Description: "Payments, and the parties, accounts and organisations they belong to",
+	Version:     "1.0.0",
+}
+
+// apiSpec describes the routes, including the legacy ones when legacy is set,
+// as an OpenAPI document. Only the routes are needed, so there is no database.
+func apiSpec(legacy bool) (*openapi.Document, error) {
+	router := routes(handlers.NewPayments(nil), handlers.NewTransactions(nil), handlers.NewParties(nil),
+		handlers.NewAccounts(nil), handlers.NewOrganisations(nil), handlers.NewAPIKeys(nil), legacy)
+	return openapi.Generate(apiInfo, router, handlers.Endpoints())
+}
+
+// newServer opens the database and builds the server, registering its
+// background workers and resources with lc so that they are shut down in order
+func newServer(cfg *config.Config, lc *lifecycle.Manager) *http.Server {
+	dbClient, err := data.NewClient(cfg.Database)
 	if err != nil {
 		log.Fatalf("unable to initialise database: %s", err)
 	}
-	defer dbClient.Close()
+	lc.OnClose("database", func() error {
+		dbClient.Close()
+		return nil
+	})
+	// Static credentials are for bootstrapping and support staff
+	static, err := auth.LoadStatic(cfg.Auth.CredentialsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("unable to load static credentials: %s", err)
+		}
+		log.Warn("no static credentials loaded")
+		static = auth.NewStatic(nil)
+	}
+	authenticators := []auth.Authenticator{static}
+	if cfg.Features.APIKeys {
+		authenticators = append(authenticators, auth.NewAPIKeys(dbClient))
+	}
+	// Bearer tokens issued by the platform, verified against its key set
+	jwtAuth, jwtConfig, err := auth.LoadJWT(cfg.Auth.JWTFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("unable to load JWT configuration: %s", err)
+		}
+		log.Warn("JWT authentication disabled")
+	} else {
+		authenticators = append(authenticators, jwtAuth)
+		if jwtConfig.RefreshSeconds > 0 {
+			lc.Go("key set refresh", func(stop <-chan struct{}) {
+				jwtAuth.Keys().RefreshEvery(time.Duration(jwtConfig.RefreshSeconds)*time.Second, stop)
+			})
+		}
+	}
+	// HTTPS directly, rather than behind a proxy, when there is a TLS config
+	certs, tlsConfig, err := auth.LoadTLS(cfg.Auth.TLSFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("unable to load TLS configuration: %s", err)
+		}
+		log.Warn("TLS disabled, serving plain HTTP")
+	} else {
+		if cfg.Features.ClientCertificates {
+			authenticators = append(authenticators, auth.NewClientCertificates(tlsConfig.ClientCertificates))
+		}
+		if tlsConfig.ReloadSeconds > 0 {
+			lc.Go("certificate reload", func(stop <-chan struct{}) {
+				certs.ReloadEvery(time.Duration(tlsConfig.ReloadSeconds)*time.Second, stop)
+			})
+		}
+	}
 	paymentsHandler := handlers.NewPayments(dbClient)
+	transactionsHandler := handlers.NewTransactions(dbClient)
+	partiesHandler := handlers.NewParties(dbClient)
+	accountsHandler := handlers.NewAccounts(dbClient)
+	organisationsHandler := handlers.NewOrganisations(dbClient)
+	apiKeysHandler := handlers.NewAPIKeys(dbClient)
+	router := routes(paymentsHandler, transactionsHandler, partiesHandler, accountsHandler, organisationsHandler,
+		apiKeysHandler, cfg.Features.LegacyRoutes)
+	policy, err := auth.LoadPolicy(cfg.Auth.PolicyFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("unable to load authorisation policy: %s", err)
+		}
+		log.Info("using default authorisation policy")
+		policy = auth.DefaultPolicy()
+	}
+	if err := policy.Validate(router); err != nil {
+		log.Fatalf("invalid authorisation policy: %s", err)
+	}
+	spec, err := openapi.Generate(apiInfo, router, handlers.Endpoints())
+	if err != nil {
+		log.Fatalf("unable to describe the API: %s", err)
+	}
+	// Metrics and tracing are outermost so that requests refused by auth are
+	// recorded too
+	stats := metrics.New(cfg.Metrics.CacheTTL.Duration)
+	router.Use(stats.Middleware)
+	if tracer := newTracer(cfg.Tracing); tracer != nil {
+		// Closed before the database, so spans of the last requests are sent
+		lc.OnClose("tracer", func() error {
+			tracer.Shutdown()
+			return nil
+		})
+		router.Use(tracer.Middleware)
+	}
+	var accessLog io.Writer
+	if cfg.Log.Access {
+		accessLog = os.Stdout
+	}
+	router.Use(logging.New(accessLog).Middleware, auth.Middleware(authenticators...),
+		handlers.LimitBody(int64(cfg.Requests.MaxBodyBytes)))
+	if cfg.Features.RateLimit {
+		// Before authorisation, so that refused requests count too
+		limiter := ratelimit.New(cfg.RateLimit, dbClient)
+		lc.Go("quota flush", func(stop <-chan struct{}) {
+			limiter.FlushEvery(ratelimit.FlushInterval, stop)
+		})
+		router.Use(limiter.Middleware)
+	}
+	router.Use(policy.Middleware)
+	if cfg.Features.OpenAPIValidation {
+		// Innermost, so that only requests which would reach a handler are
+		// checked
+		log.Warn("checking requests and responses against the OpenAPI document")
+		router.Use(spec.Validator)
+	}
+	checker := health.NewChecker(dbClient, uint64(cfg.Health.MinFreeMB)<<20)
+	// Stop new requests being routed here while existing ones drain
+	lc.OnDrain(checker.Drain)
+	root := http.NewServeMux()
+	root.Handle("/", router)
+	// Probed by the orchestrator without credentials
+	root.HandleFunc("/healthz", checker.Live)
+	root.HandleFunc("/readyz", checker.Readiness)
+	// Fetched by clients and tooling before they have credentials
+	root.Handle("/openapi.json", spec)
+	if cfg.Features.Metrics {
+		// Scraped without credentials, so served on an address of their own
+		// which need not be reachable by callers of the API
+		scrape := http.NewServeMux()
+		scrape.Handle("/metrics", stats.Handler(dbClient))
+		metricsSrv := &http.Server{Addr: cfg.Metrics.Listen, Handler: scrape}
+		log.Infof("serving metrics on %s", cfg.Metrics.Listen)
+		lc.Serve(metricsSrv, metricsSrv.ListenAndServe)
+	}
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: routes(paymentsHandler),
+		Addr:    cfg.Listen,
+		Handler: root,
 	}
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			// Send serve errors to our errors channel
-			errs <- err
+	if certs != nil {
+		srv.TLSConfig = certs.ServerConfig()
+	}
+	return srv
+}
+
+// newTracer returns a tracer for the configured exporter, or nil when spans
+// are not exported
+func newTracer(cfg config.TracingConfig) *tracing.Tracer {
+	var exporter tracing.Exporter
+	switch cfg.Exporter {
+	case config.ExporterStdout:
+		exporter = tracing.NewWriterExporter(os.Stdout)
+	case config.ExporterFile:
+		f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("unable to open trace file: %s", err)
 		}
-	}()
-	<-stop
-	log.Debug("starting shutdown of serve goroutine")
-	ctx, cancel := context.WithTimeout(context.Background(), (500 * time.Millisecond))
-	defer cancel()
-	// Allow existing connections 500ms to drain, if there are any
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Errorf("error shutting down http server: %s", err)
+		exporter = tracing.NewWriterExporter(f)
+	case config.ExporterOTLP:
+		exporter = tracing.NewOTLPExporter(cfg.Endpoint, cfg.ServiceName)
+	default:
+		return nil
 	}
+	log.Infof("exporting traces to %s", cfg.Exporter)
+	return tracing.NewTracer(exporter, cfg.Interval.Duration)
 }
 
 func main() {
-	// Trap kill signals
-	terminate := make(chan os.Signal, 1)
-	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
+	cfg, args, err := config.Load(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	switch strings.Join(args, " ") {
+	case "":
+	case "config show":
+		b, _ := json.MarshalIndent(cfg, "", "  ")
+		fmt.Println(string(b))
+		return
+	case "openapi":
+		spec, err := apiSpec(cfg.Features.LegacyRoutes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		b, _ := json.MarshalIndent(spec, "", "  ")
+		fmt.Println(string(b))
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, usage: restservice [flags] [config show | openapi]\n",
+			strings.Join(args, " "))
+		os.Exit(2)
+	}
+	cfg.ConfigureLogging()
 
-	// Listen in a new goroutine
-	log.Info("starting HTTP server on :8080")
-	stop := make(chan bool)
-	errs := make(chan error)
-	go listenTCP(stop, errs)
-	select {
-	case err := <-errs:
-		log.Errorf("serve error: %s", err)
-	case <-terminate:
-		log.Info("starting 1 second timeout for graceful shutdowns")
-		close(stop)
-		time.Sleep(time.Second)
-		break
-	}
-	log.Info("terminating")
+	lc := lifecycle.New(cfg.Shutdown.DrainTimeout.Duration, cfg.Shutdown.GracePeriod.Duration)
+	srv := newServer(cfg, lc)
+	log.Infof("starting HTTP server on %s", cfg.Listen)
+	lc.Serve(srv, func() error {
+		if srv.TLSConfig != nil {
+			// The certificates come from the TLS config rather than files
+			return srv.ListenAndServeTLS("", "")
+		}
+		return srv.ListenAndServe()
+	})
+
+	// SIGKILL cannot be caught, so only these start a graceful shutdown
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGINT)
+	os.Exit(lc.Run(terminate))
 }
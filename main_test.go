@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPIDocument fails when the committed document no longer describes
+// the routes and types, until it is regenerated with
+// `restservice openapi > openapi.json`
+func TestOpenAPIDocument(t *testing.T) {
+	spec, err := apiSpec(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := ioutil.ReadFile("openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(string(b)+"\n", "\n")
+	want := strings.Split(string(committed), "\n")
+	for i := 0; i < len(got) || i < len(want); i++ {
+		var g, w string
+		if i < len(got) {
+			g = got[i]
+		}
+		if i < len(want) {
+			w = want[i]
+		}
+		if g != w {
+			t.Fatalf("openapi.json is out of date at line %d: generated %q, committed %q; "+
+				"regenerate it with `restservice openapi > openapi.json`", i+1, g, w)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Package metrics exposes the behaviour of the service in the Prometheus text
+// format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/internal/httpstatus"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// ContentType is the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Buckets are the upper bounds, in seconds, of the request latency histogram
+var Buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	route  string
+	method string
+	status string
+}
+
+type requestStats struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Metrics records the requests served by a router
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]*requestStats
+	started  time.Time
+
+	// Counting decodes every payment, so the counts are kept for countTTL
+	// and only one scrape at a time counts them again
+	countMu   sync.Mutex
+	countTTL  time.Duration
+	counts    []*data.PaymentCount
+	countedAt time.Time
+	now       func() time.Time
+}
+
+// New returns an empty set of metrics, which counts the payments again once
+// the counts are older than countTTL
+func New(countTTL time.Duration) *Metrics {
+	return &Metrics{
+		requests: make(map[requestKey]*requestStats),
+		started:  time.Now(),
+		countTTL: countTTL,
+		now:      time.Now,
+	}
+}
+
+// Middleware counts and times each request by the name of its route, or the
+// path template of routes without a name
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := httpstatus.NewWriter(w)
+		next.ServeHTTP(sw, r)
+		m.Observe(RouteName(r), r.Method, sw.Status, time.Since(start))
+	})
+}
+
+// Observe records one request
+func (m *Metrics) Observe(route, method string, status int, latency time.Duration) {
+	key := requestKey{route: route, method: method, status: strconv.Itoa(status)}
+	elapsed := latency.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, ok := m.requests[key]
+	if !ok {
+		stats = &requestStats{buckets: make([]uint64, len(Buckets))}
+		m.requests[key] = stats
+	}
+	for i, le := range Buckets {
+		if elapsed <= le {
+			stats.buckets[i]++
+		}
+	}
+	stats.count++
+	stats.sum += elapsed
+}
+
+// RouteName returns the name of the route a request matched, its path
+// template when it has no name, or "unmatched"
+func RouteName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unmatched"
+	}
+	if name := route.GetName(); len(name) > 0 {
+		return name
+	}
+	if tmpl, err := route.GetPathTemplate(); err == nil {
+		return tmpl
+	}
+	return "unmatched"
+}
+
+// Handler serves the request metrics along with those of the database and
+// the Go runtime
+func (m *Metrics) Handler(db *data.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		out := bufio.NewWriter(w)
+		m.writeRequests(out)
+		if err := m.writeDatabase(out, db); err != nil {
+			log.Errorf("Error collecting database metrics: %s", err)
+		}
+		m.writeRuntime(out)
+		out.Flush()
+	})
+}
+
+func (m *Metrics) writeRequests(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+
+	header(w, "http_requests_total", "counter", "Requests served by route, method and status.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "http_requests_total%s %d\n", k.labels(), m.requests[k].count)
+	}
+	header(w, "http_request_duration_seconds", "histogram", "Request latency by route, method and status.")
+	for _, k := range keys {
+		stats := m.requests[k]
+		for i, le := range Buckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket%s %d\n",
+				k.labels("le", formatFloat(le)), stats.buckets[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket%s %d\n", k.labels("le", "+Inf"), stats.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum%s %s\n", k.labels(), formatFloat(stats.sum))
+		fmt.Fprintf(w, "http_request_duration_seconds_count%s %d\n", k.labels(), stats.count)
+	}
+}
+
+func (k requestKey) labels(extra ...string) string {
+	return labels(append([]string{"route", k.route, "method", k.method, "status", k.status}, extra...)...)
+}
+
+func (m *Metrics) writeDatabase(w io.Writer, db *data.Client) error {
+	stats := db.Stats()
+	sample(w, "bolt_tx_total", "counter", "Read transactions started.", int64(stats.TxN))
+	sample(w, "bolt_open_tx", "gauge", "Read transactions currently open.", int64(stats.OpenTxN))
+	sample(w, "bolt_free_pages", "gauge", "Pages on the freelist.", int64(stats.FreePageN))
+	sample(w, "bolt_pending_pages", "gauge", "Pages pending release to the freelist.", int64(stats.PendingPageN))
+	sample(w, "bolt_free_alloc_bytes", "gauge", "Bytes allocated in free pages.", int64(stats.FreeAlloc))
+	sample(w, "bolt_freelist_inuse_bytes", "gauge", "Bytes used by the freelist.", int64(stats.FreelistInuse))
+	sample(w, "bolt_page_allocations_total", "counter", "Pages allocated by write transactions.",
+		int64(stats.TxStats.PageCount))
+	sample(w, "bolt_page_alloc_bytes_total", "counter", "Bytes allocated to pages by write transactions.",
+		int64(stats.TxStats.PageAlloc))
+	sample(w, "bolt_node_splits_total", "counter", "Node splits by write transactions.", int64(stats.TxStats.Split))
+	sample(w, "bolt_writes_total", "counter", "Writes to disk by write transactions.", int64(stats.TxStats.Write))
+	seconds(w, "bolt_write_seconds_total", "counter", "Time spent writing to disk.", stats.TxStats.WriteTime)
+
+	size, err := db.Size()
+	if err != nil {
+		return err
+	}
+	sample(w, "database_size_bytes", "gauge", "Size of the database file.", size)
+
+	counts, err := m.paymentCounts(db)
+	if err != nil {
+		return err
+	}
+	header(w, "payments", "gauge", "Payments by status and currency.")
+	for _, c := range counts {
+		fmt.Fprintf(w, "payments%s %d\n", labels("status", c.Status, "currency", c.Currency), c.Count)
+	}
+	return nil
+}
+
+// paymentCounts returns the cached payment counts, counting them again when
+// they are older than the TTL
+func (m *Metrics) paymentCounts(db *data.Client) ([]*data.PaymentCount, error) {
+	m.countMu.Lock()
+	defer m.countMu.Unlock()
+	if m.counts != nil && m.now().Sub(m.countedAt) < m.countTTL {
+		return m.counts, nil
+	}
+	counts, err := db.CountPayments()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Status != counts[j].Status {
+			return counts[i].Status < counts[j].Status
+		}
+		return counts[i].Currency < counts[j].Currency
+	})
+	if counts == nil {
+		// Cached even when there are no payments
+		counts = []*data.PaymentCount{}
+	}
+	m.counts, m.countedAt = counts, m.now()
+	return counts, nil
+}
+
+func (m *Metrics) writeRuntime(w io.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	header(w, "go_info", "gauge", "Version of Go.")
+	fmt.Fprintf(w, "go_info%s 1\n", labels("version", runtime.Version()))
+	sample(w, "go_goroutines", "gauge", "Goroutines that currently exist.", int64(runtime.NumGoroutine()))
+	sample(w, "go_memstats_alloc_bytes", "gauge", "Bytes allocated and still in use.", int64(mem.Alloc))
+	sample(w, "go_memstats_heap_inuse_bytes", "gauge", "Heap bytes in use.", int64(mem.HeapInuse))
+	sample(w, "go_memstats_heap_objects", "gauge", "Allocated heap objects.", int64(mem.HeapObjects))
+	sample(w, "go_memstats_sys_bytes", "gauge", "Bytes obtained from the system.", int64(mem.Sys))
+	sample(w, "go_memstats_mallocs_total", "counter", "Heap objects allocated.", int64(mem.Mallocs))
+	sample(w, "go_gc_cycles_total", "counter", "Completed GC cycles.", int64(mem.NumGC))
+	seconds(w, "go_gc_pause_seconds_total", "counter", "Time spent in GC stop-the-world pauses.",
+		time.Duration(mem.PauseTotalNs))
+	seconds(w, "process_uptime_seconds", "gauge", "Time since the service started.", time.Since(m.started))
+}
+
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a metric with a single unlabelled sample
+func sample(w io.Writer, name, kind, help string, value int64) {
+	header(w, name, kind, help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// seconds writes a metric with a single unlabelled duration sample
+func seconds(w io.Writer, name, kind, help string, value time.Duration) {
+	header(w, name, kind, help)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value.Seconds()))
+}
+
+// labels formats name and value pairs as {name="value",...}
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], escaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// escaper escapes label values as the text format requires
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/gorilla/mux"
+)
+
+const testOrganisation = "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"
+
+func getTestDB(t *testing.T) *data.Client {
+	dir, err := ioutil.TempDir("", "metrics_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := data.NewClient(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := &data.Organisation{ID: testOrganisation, Attributes: &data.OrganisationAttributes{Name: "Test"}}
+	if err := db.CreateOrganisation(org); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMetrics(t *testing.T) {
+	db := getTestDB(t)
+	defer os.RemoveAll(filepath.Dir(db.Path()))
+	defer db.Close()
+	for i, id := range []string{"4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", "216d4da9-e59a-4cc6-8df3-3da6e7580b77"} {
+		// Payment IDs and numeric references are unique
+		ref := json.Number(strconv.Itoa(i + 1))
+		pmt := &data.Payment{
+			Resource:   data.Resource{ID: id},
+			Attributes: &data.PaymentAttributes{Amount: "10.00", Currency: "GBP", PaymentID: ref, NumericReference: ref},
+		}
+		if err := db.ForOrganisation(testOrganisation).CreatePayment(pmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := New(time.Minute)
+	router := mux.NewRouter()
+	router.Use(m.Middleware)
+	router.HandleFunc("/payments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).Name("payments.get")
+	router.HandleFunc("/parties", func(w http.ResponseWriter, r *http.Request) {})
+	for _, path := range []string{"/payments/1", "/payments/2", "/parties"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	m.Observe("payments.get", "GET", http.StatusNotFound, 2*time.Second)
+
+	rr := httptest.NewRecorder()
+	m.Handler(db).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rr.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("content type is '%s', we expected '%s'", ct, ContentType)
+	}
+	body := rr.Body.String()
+	for _, line := range []string{
+		`http_requests_total{route="payments.get",method="GET",status="404"} 3`,
+		`http_requests_total{route="/parties",method="GET",status="200"} 1`,
+		`http_request_duration_seconds_bucket{route="payments.get",method="GET",status="404",le="1"} 2`,
+		`http_request_duration_seconds_bucket{route="payments.get",method="GET",status="404",le="+Inf"} 3`,
+		`http_request_duration_seconds_count{route="payments.get",method="GET",status="404"} 3`,
+		`payments{status="pending",currency="GBP"} 2`,
+		"# TYPE bolt_page_allocations_total counter",
+		"# TYPE database_size_bytes gauge",
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics do not include '%s'", line)
+		}
+	}
+
+	// A payment created since is counted only once the counts expire
+	pmt := &data.Payment{
+		Resource:   data.Resource{ID: "9b0b0b6e-6a3c-4d1e-9a43-2f5f2c6b1d2a"},
+		Attributes: &data.PaymentAttributes{Amount: "10.00", Currency: "GBP", PaymentID: "3", NumericReference: "3"},
+	}
+	if err := db.ForOrganisation(testOrganisation).CreatePayment(pmt); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for _, tc := range []struct {
+		now  time.Time
+		line string
+	}{
+		{start, `payments{status="pending",currency="GBP"} 2`},
+		{start.Add(time.Minute), `payments{status="pending",currency="GBP"} 3`},
+	} {
+		m.now = func() time.Time { return tc.now }
+		rr := httptest.NewRecorder()
+		m.Handler(db).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(rr.Body.String(), tc.line+"\n") {
+			t.Errorf("metrics at %s do not include '%s'", tc.now.Sub(start), tc.line)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+// Endpoint describes the operation of a named route
+type Endpoint struct {
+	Summary    string
+	Deprecated bool
+	// Parameters are added to those in the path, replacing any of the same
+	// name and location
+	Parameters []*Parameter
+	// Body maps the media types of the request body to their schemas, and is
+	// empty when the operation takes none
+	Body map[string]*Schema
+	// BodyOptional is set when the body may be left out
+	BodyOptional bool
+	// Responses maps the statuses of successful responses to the schemas of
+	// their JSON bodies, or nil for those without one
+	Responses map[int]*Schema
+}
+
+// Generate describes the routes of router, each of which must be named and
+// have an endpoint, with the schemas of Go types filled in from their
+// definitions. Any other status is answered with problem details.
+//
+// Struct fields are described by their JSON encoding and an openapi tag of
+// comma separated options: required, readonly, format=date, minimum=0,
+// enum=a|b and pattern=^[A-Z]{3}$, which must come last when it has commas.
+func Generate(info Info, router *mux.Router, endpoints map[string]Endpoint) (*Document, error) {
+	g := &generator{
+		doc: &Document{
+			OpenAPI:    Version,
+			Info:       info,
+			Paths:      make(map[string]*PathItem),
+			Components: Components{Schemas: make(map[string]*Schema)},
+		},
+		names: make(map[reflect.Type]string),
+	}
+	var missing []string
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		name := route.GetName()
+		endpoint, ok := endpoints[name]
+		if !ok {
+			if len(name) == 0 {
+				name = tpl
+			}
+			missing = append(missing, name)
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return fmt.Errorf("route %s has no methods", name)
+		}
+		p, params := pathParameters(tpl)
+		item, ok := g.doc.Paths[p]
+		if !ok {
+			item = &PathItem{}
+			g.doc.Paths[p] = item
+		}
+		for _, method := range methods {
+			(*item)[strings.ToLower(method)] = g.operation(name, endpoint, params)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("no endpoint described for routes: %s", strings.Join(missing, ", "))
+	}
+	return g.doc, nil
+}
+
+// pathParameters returns an OpenAPI path for a route template, without any
+// patterns of its variables, and the parameters for the variables
+func pathParameters(tpl string) (string, []*Parameter) {
+	var params []*Parameter
+	parts := strings.Split(tpl, "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			continue
+		}
+		name := strings.SplitN(part[1:len(part)-1], ":", 2)[0]
+		parts[i] = "{" + name + "}"
+		params = append(params, &Parameter{Name: name, In: "path", Required: true,
+			Schema: &Schema{Type: "string"}})
+	}
+	return strings.Join(parts, "/"), params
+}
+
+type generator struct {
+	doc   *Document
+	names map[reflect.Type]string
+}
+
+func (g *generator) operation(name string, e Endpoint, params []*Parameter) *Operation {
+	op := &Operation{
+		OperationID: name,
+		Summary:     e.Summary,
+		Deprecated:  e.Deprecated,
+		Responses:   make(map[string]*Response),
+	}
+	for _, p := range params {
+		replaced := false
+		for _, q := range e.Parameters {
+			replaced = replaced || (p.Name == q.Name && p.In == q.In)
+		}
+		if !replaced {
+			op.Parameters = append(op.Parameters, p)
+		}
+	}
+	for _, p := range e.Parameters {
+		param := *p
+		param.Schema = g.resolve(p.Schema)
+		op.Parameters = append(op.Parameters, &param)
+	}
+	if len(e.Body) > 0 {
+		op.RequestBody = &RequestBody{Required: !e.BodyOptional, Content: make(map[string]*MediaType)}
+		for mediaType, s := range e.Body {
+			op.RequestBody.Content[mediaType] = &MediaType{Schema: g.resolve(s)}
+		}
+	}
+	for status, s := range e.Responses {
+		resp := &Response{Description: http.StatusText(status)}
+		if s != nil {
+			resp.Content = map[string]*MediaType{"application/json": {Schema: g.resolve(s)}}
+		}
+		op.Responses[strconv.Itoa(status)] = resp
+	}
+	op.Responses["default"] = &Response{
+		Description: "Problem",
+		Content: map[string]*MediaType{
+			problem.ContentType: {Schema: g.schema(reflect.TypeOf(problem.Problem{}))},
+		},
+	}
+	return op
+}
+
+// resolve copies a schema, filling in the schemas of Go types within it
+func (g *generator) resolve(s *Schema) *Schema {
+	if s == nil {
+		return nil
+	}
+	if s.of != nil {
+		return g.schema(s.of)
+	}
+	c := *s
+	if len(s.Properties) > 0 {
+		c.Properties = make(map[string]*Schema, len(s.Properties))
+		for name, p := range s.Properties {
+			c.Properties[name] = g.resolve(p)
+		}
+	}
+	if additional, ok := s.AdditionalProperties.(*Schema); ok {
+		c.AdditionalProperties = g.resolve(additional)
+	}
+	c.Items = g.resolve(s.Items)
+	c.AnyOf = nil
+	for _, a := range s.AnyOf {
+		c.AnyOf = append(c.AnyOf, g.resolve(a))
+	}
+	return &c
+}
+
+var (
+	numberType    = reflect.TypeOf(json.Number(""))
+	timeType      = reflect.TypeOf(time.Time{})
+	bytesType     = reflect.TypeOf([]byte(nil))
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// decimal is what json.Number accepts, written either as a number or a string
+var decimal = `^-?[0-9]+(\.[0-9]+)?$`
+
+// schema returns the schema of the JSON encoding of a Go type. Named structs
+// are referred to in the components, and pointers, slices and maps, which may
+// be encoded as null, are nullable.
+func (g *generator) schema(t reflect.Type) *Schema {
+	switch t {
+	case numberType:
+		return &Schema{AnyOf: []*Schema{{Type: "number"}, {Type: "string", Pattern: decimal}}}
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case bytesType:
+		return &Schema{Type: "string", Format: "byte", Nullable: true}
+	}
+	if t.Kind() != reflect.Ptr && t.Implements(marshalerType) {
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if len(s.Ref) > 0 {
+			// Nothing else may be alongside a reference
+			return &Schema{Nullable: true, AnyOf: []*Schema{s}}
+		}
+		s.Nullable = true
+		return s
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schema(t.Elem()), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem()), Nullable: true}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return g.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + g.component(t)}
+	}
+	// Interfaces may hold anything
+	return &Schema{}
+}
+
+// component adds the schema of a named struct to the components, once,
+// returning its name there
+func (g *generator) component(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	for other := range g.names {
+		if g.names[other] == name {
+			pkg := path.Base(t.PkgPath())
+			name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+			break
+		}
+	}
+	g.names[t] = name
+	// Added before its fields, which may refer back to it
+	g.doc.Components.Schemas[name] = &Schema{}
+	*g.doc.Components.Schemas[name] = *g.object(t)
+	return name
+}
+
+// object describes a struct as encoding/json encodes it, with the fields of
+// embedded structs among its own
+func (g *generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if f.Anonymous && len(tag[0]) == 0 && f.Type.Kind() == reflect.Struct {
+			embedded := g.object(f.Type)
+			for name, p := range embedded.Properties {
+				s.Properties[name] = p
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		if len(f.PkgPath) > 0 || tag[0] == "-" {
+			continue
+		}
+		name := tag[0]
+		if len(name) == 0 {
+			name = f.Name
+		}
+		p := g.schema(f.Type)
+		if required := applyTag(p, f.Tag.Get("openapi")); required {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = p
+	}
+	sort.Strings(s.Required)
+	return s
+}
+
+// applyTag applies the options of an openapi struct tag to the schema of a
+// field, reporting whether the field is required
+func applyTag(s *Schema, tag string) bool {
+	required := false
+	for len(tag) > 0 {
+		option := tag
+		if strings.HasPrefix(tag, "pattern=") {
+			tag = ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			option, tag = tag[:i], tag[i+1:]
+		} else {
+			tag = ""
+		}
+		kv := strings.SplitN(option, "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch kv[0] {
+		case "required":
+			required = true
+		case "readonly":
+			s.ReadOnly = true
+		case "format":
+			s.Format = value
+		case "pattern":
+			s.Pattern = value
+		case "enum":
+			s.Enum = strings.Split(value, "|")
+		case "minimum":
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				s.Minimum = &n
+			}
+		case "maximum":
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				s.Maximum = &n
+			}
+		}
+	}
+	return required
+}
@@ -0,0 +1,198 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+type widget struct {
+	Base
+	Name   string   `json:"name" openapi:"required"`
+	Colour string   `json:"colour,omitempty" openapi:"enum=red|blue"`
+	Code   string   `json:"code" openapi:"pattern=^[A-Z]{2,3}$"`
+	Size   int      `json:"size" openapi:"minimum=1,maximum=10"`
+	Parts  []*Part  `json:"parts"`
+	Tags   []string `json:"-"`
+	secret string
+}
+
+type Base struct {
+	ID string `json:"id" openapi:"readonly,format=uuid"`
+}
+
+type Part struct {
+	Weight json.Number `json:"weight"`
+	Spare  *Part       `json:"spare"`
+}
+
+func testDocument(t *testing.T, handler http.HandlerFunc) (*Document, *mux.Router) {
+	router := mux.NewRouter()
+	router.HandleFunc("/widgets", handler).Methods("GET").Name("widgets.list")
+	router.HandleFunc("/widgets/{id:[0-9a-f-]+}", handler).Methods("PUT", "POST").Name("widgets.put")
+	doc, err := Generate(Info{Title: "test", Version: "1"}, router, map[string]Endpoint{
+		"widgets.list": {
+			Parameters: []*Parameter{{Name: "limit", In: "query", Schema: &Schema{Type: "integer"}}},
+			Responses:  map[int]*Schema{http.StatusOK: {Type: "array", Items: SchemaOf(widget{})}},
+		},
+		"widgets.put": {
+			Body:      map[string]*Schema{"application/json": SchemaOf(widget{})},
+			Responses: map[int]*Schema{http.StatusCreated: nil},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc, router
+}
+
+func TestGenerate(t *testing.T) {
+	doc, _ := testDocument(t, nil)
+
+	put, ok := (*doc.Paths["/widgets/{id}"])["put"]
+	if !ok || (*doc.Paths["/widgets/{id}"])["post"] == nil {
+		t.Fatalf("expected put and post of /widgets/{id}, got %v", doc.Paths)
+	}
+	if len(put.Parameters) != 1 || put.Parameters[0].Name != "id" || !put.Parameters[0].Required {
+		t.Errorf("expected the id path parameter, got %+v", put.Parameters)
+	}
+	if put.RequestBody == nil || !put.RequestBody.Required {
+		t.Errorf("expected a required request body, got %+v", put.RequestBody)
+	}
+	if resp := put.Responses["201"]; resp == nil || len(resp.Content) > 0 {
+		t.Errorf("expected 201 without a body, got %+v", resp)
+	}
+	if resp := put.Responses["default"]; resp == nil || resp.Content[problem.ContentType] == nil {
+		t.Errorf("expected problem details by default, got %+v", resp)
+	}
+
+	w := doc.Components.Schemas["Widget"]
+	if w == nil {
+		t.Fatalf("expected a Widget component, got %v", doc.Components.Schemas)
+	}
+	for _, name := range []string{"id", "name", "colour", "code", "size", "parts"} {
+		if w.Properties[name] == nil {
+			t.Errorf("expected property %s", name)
+		}
+	}
+	if len(w.Properties) != 6 {
+		t.Errorf("expected 6 properties, got %d", len(w.Properties))
+	}
+	if len(w.Required) != 1 || w.Required[0] != "name" {
+		t.Errorf("expected name to be required, got %v", w.Required)
+	}
+	if id := w.Properties["id"]; !id.ReadOnly || id.Format != "uuid" {
+		t.Errorf("expected a read only UUID id, got %+v", id)
+	}
+	if code := w.Properties["code"]; code.Pattern != "^[A-Z]{2,3}$" {
+		t.Errorf("expected the whole pattern of code, got %q", code.Pattern)
+	}
+	if size := w.Properties["size"]; *size.Minimum != 1 || *size.Maximum != 10 {
+		t.Errorf("expected size from 1 to 10, got %+v", size)
+	}
+	spare := doc.Components.Schemas["Part"].Properties["spare"]
+	if !spare.Nullable || len(spare.AnyOf) != 1 || spare.AnyOf[0].Ref != "#/components/schemas/Part" {
+		t.Errorf("expected a nullable reference to Part, got %+v", spare)
+	}
+}
+
+func TestGenerateMissingEndpoint(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/widgets", nil).Methods("GET").Name("widgets.list")
+	router.HandleFunc("/gadgets", nil).Methods("GET")
+	_, err := Generate(Info{}, router, nil)
+	if err == nil || !strings.Contains(err.Error(), "/gadgets, widgets.list") {
+		t.Errorf("expected both routes to be reported, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	doc, _ := testDocument(t, nil)
+	s := &Schema{Ref: "#/components/schemas/Widget"}
+	for _, tc := range []struct {
+		body, err string
+	}{
+		{`{"name":"a","size":1,"parts":[{"weight":"1.5","spare":{"weight":2,"spare":null}}]}`, ""},
+		{`{"name":"a","parts":null}`, ""},
+		{`{"size":1}`, "name is required"},
+		{`{"name":"a","colour":"green"}`, `/colour: "green" is not one of red, blue`},
+		{`{"name":"a","code":"ABCD"}`, "/code: \"ABCD\" does not match"},
+		{`{"name":"a","size":11}`, "/size: 11 is more than 10"},
+		{`{"name":"a","size":1.5}`, "/size: 1.5 is not a whole number"},
+		{`{"name":"a","id":"nope"}`, `/id: "nope" is not a UUID`},
+		{`{"name":"a","tags":[]}`, `unknown member "tags"`},
+		{`{"name":"a","parts":[{"weight":"heavy"}]}`, "/parts/0/weight: matches none"},
+		{`{"name":null}`, "/name: must not be null"},
+	} {
+		v, err := parse([]byte(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = doc.Validate(s, v)
+		if len(tc.err) == 0 && err != nil {
+			t.Errorf("%s: unexpected error %s", tc.body, err)
+		} else if len(tc.err) > 0 && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.body, tc.err, err)
+		}
+	}
+}
+
+func TestValidator(t *testing.T) {
+	response := `[{"name":"a"}]`
+	doc, router := testDocument(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(response))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	router.Use(doc.Validator)
+	serve := func(method, url, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, tc := range []struct {
+		method, url, contentType, body string
+		status                         int
+	}{
+		{"GET", "/widgets?limit=5", "", "", http.StatusOK},
+		{"GET", "/widgets?limit=five", "", "", http.StatusBadRequest},
+		{"GET", "/widgets?offset=5", "", "", http.StatusBadRequest},
+		{"GET", "/widgets", "application/json", `{}`, http.StatusBadRequest},
+		{"PUT", "/widgets/1", "application/json", `{"name":"a"}`, http.StatusCreated},
+		{"POST", "/widgets/1", "application/json; charset=utf-8", `{"name":"a"}`, http.StatusCreated},
+		{"PUT", "/widgets/1", "application/json", `{"colour":"red"}`, http.StatusBadRequest},
+		{"PUT", "/widgets/1", "application/json", `{"name":`, http.StatusBadRequest},
+		{"PUT", "/widgets/1", "", "", http.StatusBadRequest},
+		{"PUT", "/widgets/1", "text/plain", `{"name":"a"}`, http.StatusUnsupportedMediaType},
+	} {
+		rr := serve(tc.method, tc.url, tc.contentType, tc.body)
+		if rr.Code != tc.status {
+			t.Errorf("%s %s %s: got status %d, want %d: %s", tc.method, tc.url, tc.body, rr.Code, tc.status,
+				rr.Body.String())
+		}
+		if rr.Code >= http.StatusBadRequest && rr.Header().Get("Content-Type") != problem.ContentType {
+			t.Errorf("%s %s %s: expected problem details, got %q", tc.method, tc.url, tc.body,
+				rr.Header().Get("Content-Type"))
+		}
+	}
+
+	// Responses which stray from the document are replaced
+	response = `[{"name":"a","size":0.5}]`
+	if rr := serve("GET", "/widgets", "", ""); rr.Code != http.StatusInternalServerError ||
+		!strings.Contains(rr.Body.String(), "/0/size") {
+		t.Errorf("expected 500 for a response which does not match, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,407 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adampointer/restservice/logging"
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+)
+
+// ValidationError is a value which does not match its schema
+type ValidationError struct {
+	// Pointer is the JSON Pointer of the value within the document checked
+	Pointer string
+	Detail  string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Pointer) == 0 {
+		return e.Detail
+	}
+	return e.Pointer + ": " + e.Detail
+}
+
+func mismatch(at, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Pointer: at, Detail: fmt.Sprintf(format, args...)}
+}
+
+var (
+	patterns sync.Map
+	uuid     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// Validate checks a JSON value against a schema of the document. Numbers must
+// have been decoded as json.Number.
+func (d *Document) Validate(s *Schema, v interface{}) error {
+	return d.validate(s, v, "")
+}
+
+func (d *Document) validate(s *Schema, v interface{}, at string) error {
+	if len(s.Ref) > 0 {
+		ref, ok := d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+		if !ok {
+			return mismatch(at, "unknown schema %s", s.Ref)
+		}
+		return d.validate(ref, v, at)
+	}
+	if v == nil {
+		if s.Nullable || (len(s.Type) == 0 && len(s.AnyOf) == 0) {
+			return nil
+		}
+		return mismatch(at, "must not be null")
+	}
+	if len(s.AnyOf) > 0 {
+		var errs []string
+		for _, a := range s.AnyOf {
+			err := d.validate(a, v, at)
+			if err == nil {
+				errs = nil
+				break
+			}
+			errs = append(errs, err.Error())
+		}
+		if len(errs) > 0 {
+			return mismatch(at, "matches none of the schemas allowed: %s", strings.Join(errs, "; "))
+		}
+	}
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch(at, "must be an object")
+		}
+		return d.validateObject(s, obj, at)
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return mismatch(at, "must be an array")
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				if err := d.validate(s.Items, item, at+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return mismatch(at, "must be a boolean")
+		}
+		return nil
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return mismatch(at, "must be a number")
+		}
+		return validateNumber(s, n, at)
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return mismatch(at, "must be a string")
+		}
+		return validateString(s, str, at)
+	}
+	return nil
+}
+
+func (d *Document) validateObject(s *Schema, obj map[string]interface{}, at string) error {
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			return mismatch(at, "%s is required", name)
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	// In order, so that the same mismatch is always reported first
+	sort.Strings(names)
+	for _, name := range names {
+		member := at + "/" + strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+		if p, ok := s.Properties[name]; ok {
+			if err := d.validate(p, obj[name], member); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := s.AdditionalProperties.(type) {
+		case bool:
+			if !additional {
+				return mismatch(at, "unknown member %q", name)
+			}
+		case *Schema:
+			if err := d.validate(additional, obj[name], member); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateNumber(s *Schema, n json.Number, at string) error {
+	f, err := n.Float64()
+	if err != nil {
+		return mismatch(at, "%s is not a number", n)
+	}
+	if s.Type == "integer" {
+		if _, err := n.Int64(); err != nil {
+			return mismatch(at, "%s is not a whole number", n)
+		}
+	}
+	if s.Minimum != nil && f < *s.Minimum {
+		return mismatch(at, "%s is less than %v", n, *s.Minimum)
+	}
+	if s.Maximum != nil && f > *s.Maximum {
+		return mismatch(at, "%s is more than %v", n, *s.Maximum)
+	}
+	return nil
+}
+
+func validateString(s *Schema, str, at string) error {
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			found = found || e == str
+		}
+		if !found {
+			return mismatch(at, "%q is not one of %s", str, strings.Join(s.Enum, ", "))
+		}
+	}
+	if len(s.Pattern) > 0 {
+		re, ok := patterns.Load(s.Pattern)
+		if !ok {
+			compiled, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return mismatch(at, "invalid pattern %q: %s", s.Pattern, err)
+			}
+			re, _ = patterns.LoadOrStore(s.Pattern, compiled)
+		}
+		if !re.(*regexp.Regexp).MatchString(str) {
+			return mismatch(at, "%q does not match %s", str, s.Pattern)
+		}
+	}
+	var err error
+	switch s.Format {
+	case "uuid":
+		if !uuid.MatchString(str) {
+			return mismatch(at, "%q is not a UUID", str)
+		}
+	case "date":
+		_, err = time.Parse("2006-01-02", str)
+	case "date-time":
+		_, err = time.Parse(time.RFC3339Nano, str)
+	case "byte":
+		_, err = base64.StdEncoding.DecodeString(str)
+	}
+	if err != nil {
+		return mismatch(at, "%q is not a %s", str, s.Format)
+	}
+	return nil
+}
+
+// Validator checks requests and responses against the operations of the
+// document, found by the name of the route which matched. A request which
+// does not match is refused with 400 and a response which does not is
+// replaced with 500 and logged, so that clients and handlers which stray from
+// the document are caught. Responses are held in memory to be checked, so it
+// is meant for test environments.
+func (d *Document) Validator(next http.Handler) http.Handler {
+	operations := make(map[string]*Operation)
+	for _, item := range d.Paths {
+		for _, op := range *item {
+			operations[op.OperationID] = op
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var op *Operation
+		if route := mux.CurrentRoute(r); route != nil {
+			op = operations[route.GetName()]
+		}
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if status, err := d.validateRequest(op, r); err != nil {
+			problem.Write(w, status, fmt.Sprintf("request does not match the API: %s", err))
+			return
+		}
+		rec := &recorder{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if err := d.validateResponse(op, rec); err != nil {
+			logging.FromContext(r.Context()).Errorf("Response to %s %s does not match the API: %s",
+				r.Method, r.URL.Path, err)
+			problem.Write(w, http.StatusInternalServerError, fmt.Sprintf("response does not match the API: %s", err))
+			return
+		}
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+func (d *Document) validateRequest(op *Operation, r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	for _, p := range op.Parameters {
+		var values []string
+		switch p.In {
+		case "path":
+			values = []string{vars[p.Name]}
+		case "query":
+			values = query[p.Name]
+		case "header":
+			values = r.Header[http.CanonicalHeaderKey(p.Name)]
+		}
+		if len(values) == 0 && p.Required {
+			return http.StatusBadRequest, fmt.Errorf("%s is required", p.Name)
+		}
+		for _, value := range values {
+			if err := d.validateParameter(p, value); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+	}
+	for name := range query {
+		if findParameter(op, name, "query") == nil {
+			return http.StatusBadRequest, fmt.Errorf("unknown query parameter %s", name)
+		}
+	}
+
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		// Left for the handler to refuse, such as when it is too large
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return 0, nil
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if op.RequestBody == nil {
+		if len(body) > 0 {
+			return http.StatusBadRequest, fmt.Errorf("a body is not expected")
+		}
+		return 0, nil
+	}
+	if len(body) == 0 {
+		if op.RequestBody.Required {
+			return http.StatusBadRequest, fmt.Errorf("a body is required")
+		}
+		return 0, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	content, ok := op.RequestBody.Content[mediaType]
+	if !ok {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("Content-Type %q is not accepted", mediaType)
+	}
+	v, err := parse(body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := d.Validate(content.Schema, v); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return 0, nil
+}
+
+func findParameter(op *Operation, name, in string) *Parameter {
+	for _, p := range op.Parameters {
+		if p.Name == name && p.In == in {
+			return p
+		}
+	}
+	return nil
+}
+
+// validateParameter checks the text of a parameter, which is a number when
+// its schema says so
+func (d *Document) validateParameter(p *Parameter, value string) error {
+	var v interface{} = value
+	if p.Schema.Type == "integer" || p.Schema.Type == "number" {
+		v = json.Number(value)
+	}
+	if err := d.Validate(p.Schema, v); err != nil {
+		return fmt.Errorf("%s %s", p.Name, err)
+	}
+	return nil
+}
+
+func (d *Document) validateResponse(op *Operation, rec *recorder) error {
+	resp, listed := op.Responses[strconv.Itoa(rec.status)]
+	if !listed {
+		if rec.status < http.StatusBadRequest {
+			return fmt.Errorf("status %d is not expected", rec.status)
+		}
+		resp = op.Responses["default"]
+	}
+	body := rec.body.Bytes()
+	if len(body) == 0 {
+		if listed && len(resp.Content) > 0 {
+			return fmt.Errorf("a body is expected with status %d", rec.status)
+		}
+		return nil
+	}
+	if len(resp.Content) == 0 {
+		return fmt.Errorf("no body is expected with status %d", rec.status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(rec.header.Get("Content-Type"))
+	content, ok := resp.Content[mediaType]
+	if !ok {
+		return fmt.Errorf("Content-Type %q is not expected with status %d", mediaType, rec.status)
+	}
+	v, err := parse(body)
+	if err != nil {
+		return err
+	}
+	return d.Validate(content.Schema, v)
+}
+
+func parse(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("malformed JSON: %s", err)
+	}
+	return v, nil
+}
+
+// recorder holds a response until it has been checked
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wrote {
+		rec.status = status
+		rec.wrote = true
+	}
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wrote = true
+	return rec.body.Write(b)
+}
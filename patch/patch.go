@@ -0,0 +1,401 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents to JSON documents
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Media types of patch documents
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// Error is a patch which could not be applied
+type Error struct {
+	// Conflict is true when the patch is well formed but does not apply to
+	// the document, such as when a path is missing or a test fails
+	Conflict bool
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func invalid(format string, args ...interface{}) *Error {
+	return &Error{Detail: fmt.Sprintf(format, args...)}
+}
+
+func conflict(format string, args ...interface{}) *Error {
+	return &Error{Conflict: true, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Merge applies a JSON Merge Patch to doc. Members of the patch replace those
+// of the document, objects are merged recursively and null removes a member.
+func Merge(doc, patch []byte) ([]byte, error) {
+	target, err := parse(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parse(patch)
+	if err != nil {
+		return nil, invalid("malformed merge patch: %s", err)
+	}
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = merge(t[k], v)
+		}
+	}
+	return t
+}
+
+// operation is one step of a JSON Patch. Value is nil when the operation has
+// no value, and holds null when that is its value.
+type operation struct {
+	Op    string
+	Path  *string
+	From  *string
+	Value *json.RawMessage
+}
+
+// UnmarshalJSON decodes the members of an operation, telling a value of null
+// from no value
+func (op *operation) UnmarshalJSON(b []byte) error {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(b, &members); err != nil {
+		return err
+	}
+	for name, v := range map[string]interface{}{"op": &op.Op, "path": &op.Path, "from": &op.From} {
+		if raw, ok := members[name]; ok {
+			if err := json.Unmarshal(raw, v); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	if raw, ok := members["value"]; ok {
+		op.Value = &raw
+	}
+	return nil
+}
+
+// Apply applies a JSON Patch to doc. The operations are applied in order and
+// none of them are when any fails.
+func Apply(doc, patch []byte) ([]byte, error) {
+	target, err := parse(doc)
+	if err != nil {
+		return nil, err
+	}
+	var ops []operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, invalid("a JSON Patch must be an array of operations: %s", err)
+	}
+	for i, op := range ops {
+		if target, err = op.apply(target); err != nil {
+			if e, ok := err.(*Error); ok {
+				e.Detail = fmt.Sprintf("operation %d (%s): %s", i, op.Op, e.Detail)
+			}
+			return nil, err
+		}
+	}
+	return json.Marshal(target)
+}
+
+func (op *operation) apply(doc interface{}) (interface{}, error) {
+	if op.Path == nil {
+		return nil, invalid("path is required")
+	}
+	path, err := pointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, invalid("value is required")
+		}
+		value, err := parse(*op.Value)
+		if err != nil {
+			return nil, invalid("malformed value: %s", err)
+		}
+		switch op.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			if doc, _, err = remove(doc, path); err != nil {
+				return nil, err
+			}
+			return add(doc, path, value)
+		}
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(current, value) {
+			return nil, conflict("%s is not the value tested for", *op.Path)
+		}
+		return doc, nil
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "move", "copy":
+		if op.From == nil {
+			return nil, invalid("from is required")
+		}
+		from, err := pointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if op.Op == "move" {
+			if isPrefix(from, path) && len(from) < len(path) {
+				return nil, invalid("cannot move %s into itself", *op.From)
+			}
+			if doc, value, err = remove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if value, err = get(doc, from); err != nil {
+				return nil, err
+			}
+			// Copies must not share nested values with the original
+			if value, err = clone(value); err != nil {
+				return nil, err
+			}
+		}
+		return add(doc, path, value)
+	}
+	return nil, invalid("unknown operation %q", op.Op)
+}
+
+// pointer splits a JSON Pointer (RFC 6901) into its unescaped tokens
+func pointer(s string) ([]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	if s[0] != '/' {
+		return nil, invalid("path %q must be empty or start with /", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for i, token := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			member, ok := v[token]
+			if !ok {
+				return nil, missing(path[:i+1])
+			}
+			doc = member
+		case []interface{}:
+			index, err := arrayIndex(token, len(v)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[index]
+		default:
+			return nil, missing(path[:i+1])
+		}
+	}
+	return doc, nil
+}
+
+// add sets the member at path, or inserts into an array, returning the
+// changed document
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		v[last] = value
+		return doc, nil
+	case []interface{}:
+		index := len(v)
+		if last != "-" {
+			if index, err = arrayIndex(last, len(v)); err != nil {
+				return nil, err
+			}
+		}
+		grown := append(v[:index:index], append([]interface{}{value}, v[index:]...)...)
+		return set(doc, path[:len(path)-1], grown)
+	}
+	return nil, missing(path)
+}
+
+// set replaces the existing value at path, returning the changed document
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		v[last] = value
+	case []interface{}:
+		index, err := arrayIndex(last, len(v)-1)
+		if err != nil {
+			return nil, err
+		}
+		v[index] = value
+	}
+	return doc, nil
+}
+
+// remove deletes the member at path, returning the changed document and the
+// value removed
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		value, ok := v[last]
+		if !ok {
+			return nil, nil, missing(path)
+		}
+		delete(v, last)
+		return doc, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(v)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := v[index]
+		shrunk := append(v[:index:index], v[index+1:]...)
+		doc, err = set(doc, path[:len(path)-1], shrunk)
+		return doc, value, err
+	}
+	return nil, nil, missing(path)
+}
+
+// arrayIndex parses an array index, which must be no more than max
+func arrayIndex(token string, max int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, invalid("%q is not an array index", token)
+	}
+	if index > max {
+		return 0, conflict("array index %d is out of range", index)
+	}
+	return index, nil
+}
+
+func missing(path []string) *Error {
+	escaped := make([]string, len(path))
+	for i, t := range path {
+		escaped[i] = strings.Replace(strings.Replace(t, "~", "~0", -1), "/", "~1", -1)
+	}
+	return conflict("/%s does not exist", strings.Join(escaped, "/"))
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equal compares JSON values, with numbers equal when their values are
+func equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		m, okM := new(big.Rat).SetString(string(x))
+		n, okN := new(big.Rat).SetString(string(y))
+		return okM && okN && m.Cmp(n) == 0
+	}
+	return a == b
+}
+
+func clone(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return parse(b)
+}
+
+// parse decodes JSON keeping numbers as written, so that amounts and
+// references are not rounded
+func parse(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
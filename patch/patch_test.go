@@ -0,0 +1,118 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func sameJSON(t *testing.T, got []byte, want string) bool {
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid result '%s': %s", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("invalid expectation '%s': %s", want, err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+// The examples of RFC 7396 appendix A
+func TestMerge(t *testing.T) {
+	for _, test := range []struct{ doc, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		got, err := Merge([]byte(test.doc), []byte(test.patch))
+		if err != nil {
+			t.Errorf("merging %s into %s: %s", test.patch, test.doc, err)
+			continue
+		}
+		if !sameJSON(t, got, test.want) {
+			t.Errorf("merging %s into %s gave %s, we expected %s", test.patch, test.doc, got, test.want)
+		}
+	}
+	if _, err := Merge([]byte(`{}`), []byte(`{"a":`)); err == nil || err.(*Error).Conflict {
+		t.Errorf("malformed merge patch accepted or reported as a conflict: %v", err)
+	}
+}
+
+// Mostly the examples of RFC 6902 appendix A
+func TestApply(t *testing.T) {
+	for _, test := range []struct{ doc, patch, want string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			`{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			`{"foo":["bar",["abc","def"]]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"copy","from":"/~1","path":"/a"}]`,
+			`{"/":9,"~1":10,"a":9}`},
+		{`{"m":[[1,2],[3]]}`, `[{"op":"add","path":"/m/0/1","value":5},{"op":"remove","path":"/m/1/0"}]`,
+			`{"m":[[1,5,2],[]]}`},
+		{`{"foo":"bar","baz":null}`,
+			`[{"op":"test","path":"/baz","value":null},{"op":"replace","path":"/foo","value":null},` +
+				`{"op":"add","path":"/qux","value":null}]`,
+			`{"foo":null,"baz":null,"qux":null}`},
+	} {
+		got, err := Apply([]byte(test.doc), []byte(test.patch))
+		if err != nil {
+			t.Errorf("applying %s to %s: %s", test.patch, test.doc, err)
+			continue
+		}
+		if !sameJSON(t, got, test.want) {
+			t.Errorf("applying %s to %s gave %s, we expected %s", test.patch, test.doc, got, test.want)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	for _, test := range []struct {
+		doc, patch string
+		conflict   bool
+	}{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, true},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, true},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, true},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`, true},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, false},
+		{`{"foo":"bar"}`, `[{"op":"frobnicate","path":"/foo"}]`, false},
+		{`{"foo":["bar"]}`, `[{"op":"replace","path":"/foo/01","value":"qux"}]`, false},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, false},
+		{`{"foo":"bar"}`, `{"op":"remove","path":"/foo"}`, false},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`, false},
+	} {
+		_, err := Apply([]byte(test.doc), []byte(test.patch))
+		if err == nil {
+			t.Errorf("applying %s to %s succeeded", test.patch, test.doc)
+			continue
+		}
+		if e, ok := err.(*Error); !ok || e.Conflict != test.conflict {
+			t.Errorf("applying %s to %s: unexpected error %#v", test.patch, test.doc, err)
+		}
+	}
+}
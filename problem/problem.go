@@ -0,0 +1,40 @@
+// Package problem writes RFC 7807 problem details responses
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ContentType of a problem details response
+const ContentType = "application/problem+json"
+
+// Problem describes an error response
+type Problem struct {
+	Type   string `json:"type" openapi:"required"`
+	Title  string `json:"title" openapi:"required"`
+	Status int    `json:"status" openapi:"required,minimum=400,maximum=599"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// New returns a problem for an HTTP status
+func New(status int, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// Write sends a problem for an HTTP status
+func Write(w http.ResponseWriter, status int, detail string) {
+	New(status, detail).Write(w)
+}
+
+// Write sends the problem
+func (p *Problem) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
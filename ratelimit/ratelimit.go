@@ -0,0 +1,340 @@
+// Package ratelimit limits how often each caller may make requests, with
+// token buckets chosen by the tier of their organisation, and counts their
+// requests against a daily quota which is kept in the database
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/config"
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/logging"
+	"github.com/adampointer/restservice/problem"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Response headers, from the IETF RateLimit header fields draft
+const (
+	HeaderLimit     = "RateLimit-Limit"
+	HeaderRemaining = "RateLimit-Remaining"
+	HeaderReset     = "RateLimit-Reset"
+	HeaderPolicy    = "RateLimit-Policy"
+)
+
+// FlushInterval is how often quota usage is saved. Requests counted since
+// the last save are lost if the process is killed.
+const FlushInterval = 10 * time.Second
+
+// tierTTL is how long the tier of an organisation is remembered, so that a
+// change of tier applies within it
+const tierTTL = time.Minute
+
+// Limiter applies the rate limits and quotas of a configuration
+type Limiter struct {
+	cfg config.RateLimitConfig
+	db  *data.Client
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	tiers   map[string]*cachedTier
+	// usage counts the requests of each key today, once loaded from the
+	// database, and previous those of yesterday until they are saved
+	day         string
+	usage       map[string]int64
+	previousDay string
+	previous    map[string]int64
+	dirty       bool
+}
+
+type cachedTier struct {
+	name    string
+	fetched time.Time
+}
+
+// New returns a limiter which reads tiers and keeps quotas in db
+func New(cfg config.RateLimitConfig, db *data.Client) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		db:      db,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+		tiers:   make(map[string]*cachedTier),
+		usage:   make(map[string]int64),
+	}
+}
+
+// Middleware refuses requests over the caller's rate limit or quota with 429.
+// It must run after authentication has added the principal to the context.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.FromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route = current.GetName()
+		}
+		key := l.key(principal)
+		tier := l.tier(r, principal)
+		limit := &tier.Limit
+		bucketKey := key
+		if routeLimit, ok := tier.Routes[route]; ok {
+			limit = routeLimit
+			bucketKey = key + " " + route
+		}
+
+		counted := tier.DailyQuota > 0
+		if counted {
+			used, err := l.used(key)
+			if err != nil {
+				// Better to serve than to refuse everyone when quotas cannot be read.
+				// The request is not counted either, as counting from zero would
+				// save over the stored usage.
+				logging.FromContext(r.Context()).Errorf("Error reading quota usage: %s", err)
+				counted = false
+			} else if used >= tier.DailyQuota {
+				now := l.now().UTC()
+				midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(midnight.Sub(now))))
+				problem.Write(w, http.StatusTooManyRequests,
+					fmt.Sprintf("daily quota of %d requests exhausted", tier.DailyQuota))
+				return
+			}
+		}
+
+		allowed, remaining, reset, retry := l.take(bucketKey, limit)
+		w.Header().Set(HeaderLimit, strconv.Itoa(limit.Burst))
+		w.Header().Set(HeaderRemaining, strconv.Itoa(remaining))
+		w.Header().Set(HeaderReset, strconv.Itoa(ceilSeconds(reset)))
+		w.Header().Set(HeaderPolicy, fmt.Sprintf("%d;w=%d", limit.Burst,
+			ceilSeconds(time.Duration(float64(limit.Burst)/limit.Rate*float64(time.Second)))))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retry)))
+			problem.Write(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		if counted {
+			l.count(key)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// key chooses whose requests are limited together
+func (l *Limiter) key(p *auth.Principal) string {
+	if l.cfg.KeyBy == config.KeyByOrganisation && len(p.OrganisationID) > 0 {
+		return "organisation:" + p.OrganisationID
+	}
+	return "client:" + p.Subject
+}
+
+// tier returns the limits for the tier of the caller's organisation
+func (l *Limiter) tier(r *http.Request, p *auth.Principal) *config.TierConfig {
+	name := config.DefaultTier
+	if len(p.OrganisationID) > 0 {
+		l.mu.Lock()
+		cached, ok := l.tiers[p.OrganisationID]
+		l.mu.Unlock()
+		if ok && l.now().Sub(cached.fetched) < tierTTL {
+			name = cached.name
+		} else {
+			org, err := l.db.WithContext(r.Context()).FetchOrganisation(p.OrganisationID)
+			if err != nil && err.Error() != "not found" {
+				logging.FromContext(r.Context()).Errorf("Error getting organisation tier: %s", err)
+			}
+			if err == nil && org.Attributes != nil && len(org.Attributes.Tier) > 0 {
+				name = org.Attributes.Tier
+			}
+			l.mu.Lock()
+			l.tiers[p.OrganisationID] = &cachedTier{name: name, fetched: l.now()}
+			l.mu.Unlock()
+		}
+	}
+	if tier, ok := l.cfg.Tiers[name]; ok {
+		return tier
+	}
+	return l.cfg.Tiers[config.DefaultTier]
+}
+
+// take removes a token from a bucket, telling whether there was one, how
+// many are left, when the bucket will be full and, when there was none, when
+// there will be
+func (l *Limiter) take(key string, limit *config.Limit) (bool, int, time.Duration, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.limit = limit
+	b.refill(now)
+	allowed := b.tokens >= 1
+	var retry time.Duration
+	if allowed {
+		b.tokens--
+	} else {
+		retry = seconds((1 - b.tokens) / limit.Rate)
+	}
+	reset := seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+	return allowed, int(math.Floor(b.tokens)), reset, retry
+}
+
+// used returns the requests made by key today, loading them from the
+// database the first time the key is seen each day
+func (l *Limiter) used(key string) (int64, error) {
+	day := data.QuotaDay(l.now())
+	l.mu.Lock()
+	l.rollover(day)
+	used, ok := l.usage[key]
+	l.mu.Unlock()
+	if ok {
+		return used, nil
+	}
+	stored, err := l.db.FetchQuotaUsage(key, day)
+	if err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.day != day {
+		return stored, nil
+	}
+	if used, ok = l.usage[key]; !ok {
+		l.usage[key] = stored
+		used = stored
+	}
+	return used, nil
+}
+
+// count records a request by key against today's quota
+func (l *Limiter) count(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollover(data.QuotaDay(l.now()))
+	l.usage[key]++
+	l.dirty = true
+}
+
+// rollover starts counting a new day, keeping the counts of the last one to
+// be saved. The caller must hold the lock.
+func (l *Limiter) rollover(day string) {
+	if l.day == day {
+		return
+	}
+	if l.dirty && len(l.day) > 0 {
+		l.previous, l.previousDay = l.usage, l.day
+	}
+	l.day = day
+	l.usage = make(map[string]int64)
+	l.dirty = false
+}
+
+// Flush saves the quota usage counted since it was last saved, and forgets
+// buckets and tiers which are no longer needed
+func (l *Limiter) Flush() error {
+	now := l.now()
+	l.mu.Lock()
+	l.rollover(data.QuotaDay(now))
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	for id, cached := range l.tiers {
+		if now.Sub(cached.fetched) >= tierTTL {
+			delete(l.tiers, id)
+		}
+	}
+	previous, previousDay := l.previous, l.previousDay
+	var usage map[string]int64
+	if l.dirty {
+		usage = make(map[string]int64, len(l.usage))
+		for key, count := range l.usage {
+			usage[key] = count
+		}
+	}
+	day := l.day
+	l.previous = nil
+	l.dirty = false
+	l.mu.Unlock()
+
+	if previous != nil {
+		if err := l.db.SaveQuotaUsage(previousDay, previous); err != nil {
+			l.markUnsaved(previousDay, previous, nil)
+			return err
+		}
+	}
+	if usage != nil {
+		if err := l.db.SaveQuotaUsage(day, usage); err != nil {
+			l.markUnsaved("", nil, usage)
+			return err
+		}
+	}
+	return nil
+}
+
+// markUnsaved arranges for counts which could not be saved to be tried again
+func (l *Limiter) markUnsaved(previousDay string, previous, usage map[string]int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if previous != nil && l.previous == nil {
+		l.previous, l.previousDay = previous, previousDay
+	}
+	if usage != nil {
+		l.dirty = true
+	}
+}
+
+// FlushEvery saves quota usage periodically until stop is closed, and once
+// more before returning
+func (l *Limiter) FlushEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Flush(); err != nil {
+				log.Errorf("Error saving quota usage: %s", err)
+			}
+		case <-stop:
+			if err := l.Flush(); err != nil {
+				log.Errorf("Error saving quota usage: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// bucket holds the tokens of a caller, refilled continuously
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   *config.Limit
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+		b.updated = now
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,218 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adampointer/restservice/auth"
+	"github.com/adampointer/restservice/config"
+	"github.com/adampointer/restservice/data"
+	"github.com/gorilla/mux"
+)
+
+const (
+	testOrganisation    = "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"
+	premiumOrganisation = "3f4bc5a5-5ab3-4fbc-b4c4-b3d5e5ba6b4e"
+)
+
+func getTestDB(t *testing.T) *data.Client {
+	dir, err := ioutil.TempDir("", "ratelimit_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := data.NewClient(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, tier := range map[string]string{testOrganisation: "", premiumOrganisation: "premium"} {
+		org := &data.Organisation{ID: id, Attributes: &data.OrganisationAttributes{Name: "Test", Tier: tier}}
+		if err := db.CreateOrganisation(org); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func testConfig() config.RateLimitConfig {
+	return config.RateLimitConfig{
+		KeyBy: config.KeyByOrganisation,
+		Tiers: map[string]*config.TierConfig{
+			config.DefaultTier: {
+				Limit:      config.Limit{Rate: 1, Burst: 2},
+				DailyQuota: 3,
+				Routes:     map[string]*config.Limit{"payments.list": {Rate: 0.5, Burst: 1}},
+			},
+			"premium": {Limit: config.Limit{Rate: 10, Burst: 5}},
+		},
+	}
+}
+
+// clock is a time which tests move on by hand
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func limitedRouter(l *Limiter) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := &auth.Principal{Subject: "test", OrganisationID: r.Header.Get("X-Organisation")}
+			next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), p)))
+		})
+	}, l.Middleware)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/payments", ok).Name("payments.list")
+	router.HandleFunc("/payments/{id}", ok).Name("payments.get")
+	return router
+}
+
+func request(router http.Handler, organisationID, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("X-Organisation", organisationID)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimit(t *testing.T) {
+	db := getTestDB(t)
+	defer os.RemoveAll(filepath.Dir(db.Path()))
+	defer db.Close()
+	cfg := testConfig()
+	cfg.Tiers[config.DefaultTier].DailyQuota = 0
+	l := New(cfg, db)
+	c := &clock{t: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	l.now = c.now
+	router := limitedRouter(l)
+
+	for i, remaining := range []string{"1", "0"} {
+		rr := request(router, testOrganisation, "/payments/1")
+		if rr.Code != http.StatusOK || rr.Header().Get(HeaderRemaining) != remaining ||
+			rr.Header().Get(HeaderLimit) != "2" {
+			t.Errorf("request %d: status %d, headers %v", i, rr.Code, rr.Header())
+		}
+	}
+	rr := request(router, testOrganisation, "/payments/1")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" ||
+		rr.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("over the limit: status %d, headers %v", rr.Code, rr.Header())
+	}
+	if rr.Header().Get(HeaderReset) != "2" || rr.Header().Get(HeaderPolicy) != "2;w=2" {
+		t.Errorf("unexpected limit headers: %v", rr.Header())
+	}
+
+	// Routes with their own limit have their own bucket
+	if rr := request(router, testOrganisation, "/payments"); rr.Code != http.StatusOK {
+		t.Errorf("listing refused with status %d", rr.Code)
+	}
+	if rr := request(router, testOrganisation, "/payments"); rr.Code != http.StatusTooManyRequests ||
+		rr.Header().Get("Retry-After") != "2" {
+		t.Errorf("second listing: status %d, headers %v", rr.Code, rr.Header())
+	}
+	// Other organisations, and other tiers, are unaffected
+	for i := 0; i < 5; i++ {
+		if rr := request(router, premiumOrganisation, "/payments/1"); rr.Code != http.StatusOK {
+			t.Errorf("premium request %d refused with status %d", i, rr.Code)
+		}
+	}
+
+	c.t = c.t.Add(time.Second)
+	if rr := request(router, testOrganisation, "/payments/1"); rr.Code != http.StatusOK {
+		t.Errorf("refused after refilling with status %d", rr.Code)
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	db := getTestDB(t)
+	defer os.RemoveAll(filepath.Dir(db.Path()))
+	defer db.Close()
+	c := &clock{t: time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)}
+	l := New(testConfig(), db)
+	l.now = c.now
+	router := limitedRouter(l)
+
+	for i := 0; i < 2; i++ {
+		if rr := request(router, testOrganisation, "/payments/1"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d refused with status %d", i, rr.Code)
+		}
+		c.t = c.t.Add(time.Minute)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The count survives a restart
+	l = New(testConfig(), db)
+	l.now = c.now
+	router = limitedRouter(l)
+	if rr := request(router, testOrganisation, "/payments/1"); rr.Code != http.StatusOK {
+		t.Fatalf("last request of the quota refused with status %d", rr.Code)
+	}
+	c.t = c.t.Add(time.Minute)
+	rr := request(router, testOrganisation, "/payments/1")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "3420" {
+		t.Errorf("over the quota: status %d, headers %v", rr.Code, rr.Header())
+	}
+
+	// A new day brings a new quota, and yesterday's counts are saved
+	c.t = c.t.Add(time.Hour)
+	if rr := request(router, testOrganisation, "/payments/1"); rr.Code != http.StatusOK {
+		t.Errorf("refused the next day with status %d", rr.Code)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := db.FetchQuotaUsage("organisation:"+testOrganisation, "2026-01-02"); err != nil || used != 1 {
+		t.Errorf("%d requests saved for the new day: %v", used, err)
+	}
+	if used, _ := db.FetchQuotaUsage("organisation:"+testOrganisation, "2026-01-01"); used != 0 {
+		t.Errorf("%d requests kept for the previous day, we expected them removed", used)
+	}
+}
+
+func TestDailyQuotaUnreadable(t *testing.T) {
+	db := getTestDB(t)
+	path := db.Path()
+	defer os.RemoveAll(filepath.Dir(path))
+	c := &clock{t: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	l := New(testConfig(), db)
+	l.now = c.now
+	router := limitedRouter(l)
+
+	// Requests are served while the usage cannot be read
+	db.Close()
+	if rr := request(router, testOrganisation, "/payments/1"); rr.Code != http.StatusOK {
+		t.Fatalf("refused with status %d when usage could not be read", rr.Code)
+	}
+
+	// but not counted, so the stored usage is not started again from zero
+	db, err := data.NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key := "organisation:" + testOrganisation
+	if err := db.SaveQuotaUsage("2026-01-01", map[string]int64{key: 3}); err != nil {
+		t.Fatal(err)
+	}
+	l.db = db
+	c.t = c.t.Add(time.Minute)
+	if rr := request(router, testOrganisation, "/payments/1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("over the stored quota: status %d", rr.Code)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := db.FetchQuotaUsage(key, "2026-01-01"); err != nil || used != 3 {
+		t.Errorf("%d requests saved, we expected the stored 3: %v", used, err)
+	}
+}
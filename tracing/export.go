@@ -0,0 +1,153 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter sends finished spans somewhere they can be looked at
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// WriterExporter writes each span as a line of JSON, to a file or stdout
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterExporter returns an exporter writing to w
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// Export writes the spans
+func (e *WriterExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		if err := enc.Encode(otlpSpanOf(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP over
+// HTTP with JSON encoding
+type OTLPExporter struct {
+	// Endpoint is the collector's traces URL, such as
+	// http://localhost:4318/v1/traces
+	Endpoint    string
+	ServiceName string
+	Client      *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting to endpoint
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint:    endpoint,
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Export posts the spans as one request
+func (e *OTLPExporter) Export(spans []*Span) error {
+	otlp := make([]*otlpSpan, len(spans))
+	for i, s := range spans {
+		otlp[i] = otlpSpanOf(s)
+	}
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": e.ServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/adampointer/restservice/tracing"},
+				"spans": otlp,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpSpan is a span in the OTLP JSON encoding, where IDs are hex and times
+// are nanoseconds since the epoch written as strings
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []*otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus      `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpSpanOf(s *Span) *otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := &otlpSpan{
+		TraceID:           hex.EncodeToString(s.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.SpanID[:]),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.Attributes),
+	}
+	if s.Parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.Parent[:])
+	}
+	if len(s.Err) > 0 {
+		// STATUS_CODE_ERROR
+		o.Status = &otlpStatus{Code: 2, Message: s.Err}
+	}
+	return o
+}
+
+func otlpAttributes(attrs map[string]string) []*otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*otlpAttribute, len(keys))
+	for i, k := range keys {
+		out[i] = &otlpAttribute{Key: k, Value: map[string]string{"stringValue": attrs[k]}}
+	}
+	return out
+}
@@ -0,0 +1,292 @@
+// Package tracing records spans of work done for each request, continuing
+// traces from W3C traceparent headers, and exports them in batches
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adampointer/restservice/internal/httpstatus"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// HeaderTraceParent carries the trace context between services
+const HeaderTraceParent = "traceparent"
+
+// Span kinds, as numbered by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+// ErrInvalidTraceParent is returned for malformed traceparent headers
+var ErrInvalidTraceParent = errors.New("invalid traceparent")
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// ParseTraceParent reads a version 00 traceparent header
+func ParseTraceParent(h string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	// Later versions may add fields, but version 00 has exactly four
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, ErrInvalidTraceParent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// TraceParent formats the span context as a traceparent header
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	SpanContext
+	Parent     [8]byte
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        string
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttribute records a detail of the operation
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the operation as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err.Error()
+}
+
+// Finish ends the span and queues it for export when it is sampled
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Sampled && s.tracer != nil {
+		s.tracer.queue(s)
+	}
+}
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// FromContext returns the current span of a context, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// Start begins a child of the span in ctx. Nothing is recorded, and a nil
+// span returned, when ctx is not part of a trace, so that background work is
+// not traced. Methods of a nil span do nothing.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, KindInternal, parent.SpanContext)
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// Inject adds the trace context of ctx to the headers of an outgoing request
+func Inject(ctx context.Context, h http.Header) {
+	if s := FromContext(ctx); s != nil {
+		h.Set(HeaderTraceParent, s.TraceParent())
+	}
+}
+
+// Tracer creates spans and exports them in batches
+type Tracer struct {
+	exporter Exporter
+	spans    chan *Span
+	done     chan struct{}
+	mu       sync.Mutex
+	closed   bool
+}
+
+// batchSize is the most spans exported at once
+const batchSize = 512
+
+// NewTracer returns a tracer which exports to exporter every interval
+func NewTracer(exporter Exporter, interval time.Duration) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		spans:    make(chan *Span, 4*batchSize),
+		done:     make(chan struct{}),
+	}
+	go t.run(interval)
+	return t
+}
+
+// StartTrace begins a server span for an incoming request, continuing the
+// trace of its traceparent header when there is a valid one
+func (t *Tracer) StartTrace(r *http.Request, name string) (context.Context, *Span) {
+	parent, err := ParseTraceParent(r.Header.Get(HeaderTraceParent))
+	if err != nil {
+		parent = SpanContext{Sampled: true}
+		random(parent.TraceID[:])
+	}
+	s := t.newSpan(name, KindServer, parent)
+	return context.WithValue(r.Context(), spanKey, s), s
+}
+
+// Middleware traces each request with a server span named after its route
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		ctx, span := t.StartTrace(r, r.Method+" "+route)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		sw := httpstatus.NewWriter(w)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttribute("http.status_code", strconv.Itoa(sw.Status))
+		if sw.Status >= http.StatusInternalServerError {
+			span.SetError(errors.New(http.StatusText(sw.Status)))
+		}
+		span.Finish()
+	})
+}
+
+// Shutdown exports the spans still queued. Spans finished afterwards are
+// dropped.
+func (t *Tracer) Shutdown() {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.mu.Unlock()
+	<-t.done
+}
+
+func (t *Tracer) newSpan(name string, kind int, parent SpanContext) *Span {
+	s := &Span{
+		SpanContext: SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled},
+		Parent:      parent.SpanID,
+		Name:        name,
+		Kind:        kind,
+		Start:       time.Now(),
+		tracer:      t,
+	}
+	random(s.SpanID[:])
+	return s
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		log.Warn("dropping span, the export queue is full")
+	}
+}
+
+func (t *Tracer) run(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []*Span
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			log.Errorf("Error exporting spans: %s", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+func random(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("Error generating trace ID: %s", err)
+	}
+}
@@ -0,0 +1,179 @@
+package tracing_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adampointer/restservice/data"
+	"github.com/adampointer/restservice/tracing"
+	"github.com/gorilla/mux"
+)
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (e *memoryExporter) Export(spans []*tracing.Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memoryExporter) named(name string) *tracing.Span {
+	for _, s := range e.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestParseTraceParent(t *testing.T) {
+	sc, err := tracing.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(sc.TraceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(sc.SpanID[:]) != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("unexpected span context: %+v", sc)
+	}
+	if tp := sc.TraceParent(); tp != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("unexpected traceparent: %s", tp)
+	}
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, err := tracing.ParseTraceParent(h); err == nil {
+			t.Errorf("expected '%s' to be rejected", h)
+		}
+	}
+	// Later versions may carry more fields
+	if _, err := tracing.ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := data.NewClient(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	exporter := &memoryExporter{}
+	tracer := tracing.NewTracer(exporter, time.Hour)
+	router := mux.NewRouter()
+	router.Use(tracer.Middleware)
+	router.HandleFunc("/organisations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		org := &data.Organisation{ID: mux.Vars(r)["id"]}
+		if err := db.WithContext(r.Context()).CreateOrganisation(org); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	req := httptest.NewRequest("PUT", "/organisations/acme", nil)
+	req.Header.Set(tracing.HeaderTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	// Work outside a request is not traced
+	if _, err := db.FetchAllOrganisations(); err != nil {
+		t.Fatal(err)
+	}
+	tracer.Shutdown()
+
+	server := exporter.named("PUT /organisations/{id}")
+	if server == nil {
+		t.Fatalf("no server span in %d spans", len(exporter.spans))
+	}
+	if hex.EncodeToString(server.TraceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(server.Parent[:]) != "00f067aa0ba902b7" {
+		t.Errorf("server span does not continue the trace: %+v", server.SpanContext)
+	}
+	if server.Attributes["http.status_code"] != "201" || server.Kind != tracing.KindServer {
+		t.Errorf("unexpected server span: %+v", server)
+	}
+	op := exporter.named("data.CreateOrganisation")
+	if op == nil || op.Parent != server.SpanID || op.TraceID != server.TraceID {
+		t.Errorf("data operation is not a child of the server span: %+v", op)
+	}
+	if exporter.named("data.FetchAllOrganisations") != nil {
+		t.Error("background work was traced")
+	}
+}
+
+func TestUnsampled(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := tracing.NewTracer(exporter, time.Hour)
+	handler := tracer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The trace is still propagated downstream
+		h := http.Header{}
+		tracing.Inject(r.Context(), h)
+		sc, err := tracing.ParseTraceParent(h.Get(tracing.HeaderTraceParent))
+		if err != nil || sc.Sampled || hex.EncodeToString(sc.TraceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("unexpected traceparent: %s", h.Get(tracing.HeaderTraceParent))
+		}
+	}))
+	req := httptest.NewRequest("GET", "/payments", nil)
+	req.Header.Set(tracing.HeaderTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Shutdown()
+
+	if len(exporter.spans) != 0 {
+		t.Errorf("exported %d spans of an unsampled trace", len(exporter.spans))
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string][]struct {
+		ScopeSpans []struct {
+			Spans []map[string]interface{} `json:"spans"`
+		} `json:"scopeSpans"`
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export request: %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	tracer := tracing.NewTracer(tracing.NewOTLPExporter(collector.URL+"/v1/traces", "restservice"), time.Hour)
+	handler := tracer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/payments", nil))
+	tracer.Shutdown()
+
+	spans := body["resourceSpans"][0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, we expected 1", len(spans))
+	}
+	if spans[0]["name"] != "GET /payments" || len(spans[0]["traceId"].(string)) != 32 {
+		t.Errorf("unexpected span: %v", spans[0])
+	}
+	if status, ok := spans[0]["status"].(map[string]interface{}); !ok || status["code"] != float64(2) {
+		t.Errorf("span not marked as an error: %v", spans[0])
+	}
+}